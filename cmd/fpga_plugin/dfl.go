@@ -22,6 +22,8 @@ import (
 	"regexp"
 
 	"github.com/pkg/errors"
+
+	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
 )
 
 const (
@@ -61,7 +63,7 @@ func getSysFsInfoDFL(dp *devicePlugin, deviceFolder string, deviceFiles []os.Fil
 
 		if dp.fmeReg.MatchString(name) {
 			if len(regions) > 0 {
-				return nil, nil, errors.Errorf("Detected more than one FPGA region for device %s. Only one region per FPGA device is supported", fname)
+				return nil, nil, dpapi.Fatal(errors.Errorf("Detected more than one FPGA region for device %s. Only one region per FPGA device is supported", fname))
 			}
 
 			region, err := dp.getDFLRegion(deviceFolder, name)
@@ -91,6 +93,7 @@ func newDevicePluginDFL(sysfsDir string, devfsDir string, mode string) (*deviceP
 
 	return &devicePlugin{
 		name: "DFL",
+		mode: mode,
 
 		sysfsDir: sysfsDir,
 		devfsDir: devfsDir,
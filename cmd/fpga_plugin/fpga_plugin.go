@@ -22,6 +22,7 @@ import (
 	"path"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"k8s.io/klog"
@@ -50,8 +51,13 @@ const (
 	unhealthyAfuID       = "ffffffffffffffffffffffffffffffff"
 	unhealthyInterfaceID = "ffffffffffffffffffffffffffffffff"
 
-	// Frequency of device scans
-	scanFrequency = 5 * time.Second
+	// Period of retrying a mode switch postponed because of devices in use.
+	modeSwitchRetryPeriod = 30 * time.Second
+)
+
+var (
+	// Kernel subsystems whose uevents trigger device rescans.
+	ueventSubsystems = []string{"fpga", "fpga_region", "dfl"}
 )
 
 type getDevTreeFunc func(devices []device) dpapi.DeviceTree
@@ -164,8 +170,26 @@ type device struct {
 	regions []region
 }
 
+// pluginConfig contains the plugin's settings given in the configuration file.
+type pluginConfig struct {
+	Mode string `json:"mode"`
+}
+
+// Validate implements ConfigValidator interface.
+func (c *pluginConfig) Validate() error {
+	_, _, _, err := getPluginParams(c.Mode)
+	return err
+}
+
 type devicePlugin struct {
 	name string
+	mode string
+	// config overrides the mode if the plugin is given a configuration file.
+	config *dpapi.ConfigWatcher
+	// ledger, if set, postpones mode switches until no device is in use.
+	ledger *dpapi.Ledger
+	// devTree is the result of the last scan.
+	devTree dpapi.DeviceTree
 
 	sysfsDir string
 	devfsDir string
@@ -180,9 +204,10 @@ type devicePlugin struct {
 	ignoreAfuIDs       bool
 	ignoreEmptyRegions bool
 	annotationValue    string
+	// modeLock protects the mode dependent fields read outside Scan().
+	modeLock sync.Mutex
 
-	scanTicker *time.Ticker
-	scanDone   chan bool
+	scanDone chan bool
 }
 
 // newDevicePlugin returns new instance of devicePlugin
@@ -206,19 +231,49 @@ func newDevicePlugin(mode string, rootPath string) (*devicePlugin, error) {
 		return nil, err
 	}
 
-	dp.scanTicker = time.NewTicker(scanFrequency)
 	dp.scanDone = make(chan bool, 1) // buffered as we may send to it before Scan starts receiving from it
 
 	return dp, nil
 }
 
 func (dp *devicePlugin) PostAllocate(response *pluginapi.AllocateResponse) error {
+	dp.modeLock.Lock()
+	annotationValue := dp.annotationValue
+	dp.modeLock.Unlock()
+
 	// Set container annotations when programming is allowed
-	if len(dp.annotationValue) > 0 {
+	if len(annotationValue) > 0 {
 		for _, containerResponse := range response.GetContainerResponses() {
-			containerResponse.Annotations = map[string]string{
-				annotationName: dp.annotationValue,
+			// Keep the annotations set by the framework, e.g. for CDI.
+			if containerResponse.Annotations == nil {
+				containerResponse.Annotations = make(map[string]string)
 			}
+			containerResponse.Annotations[annotationName] = annotationValue
+		}
+	}
+
+	return nil
+}
+
+// GetDevicePluginOptions implements DevicePluginOptionsProvider interface.
+// Only the regions programmed at container start in region mode need
+// PreStartContainer().
+func (dp *devicePlugin) GetDevicePluginOptions(devType string) *pluginapi.DevicePluginOptions {
+	dp.modeLock.Lock()
+	defer dp.modeLock.Unlock()
+
+	return &pluginapi.DevicePluginOptions{
+		PreStartRequired: dp.mode == regionMode && strings.HasPrefix(devType, regionMode+"-"),
+	}
+}
+
+// PreStartContainer implements ContainerPreStarter interface. It checks the
+// FME devices of the allocated regions still exist, so that containers fail
+// to start rather than run with regions that can't be programmed.
+func (dp *devicePlugin) PreStartContainer(rqt *pluginapi.PreStartContainerRequest) error {
+	for _, id := range rqt.GetDevicesIDs() {
+		if _, err := dp.getDevNode(id); err != nil {
+			return errors.Wrapf(err, "Can't program region %s", id)
 		}
 	}
 
@@ -227,21 +282,111 @@ func (dp *devicePlugin) PostAllocate(response *pluginapi.AllocateResponse) error
 
 // Scan starts scanning FPGA devices on the host
 func (dp *devicePlugin) Scan(notifier dpapi.Notifier) error {
-	defer dp.scanTicker.Stop()
+	watcher, err := dpapi.NewWatcher(ueventSubsystems, []string{dp.devfsDir})
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	var configChanges <-chan struct{}
+	var retry <-chan time.Time
+	if dp.config != nil {
+		dp.applyConfig()
+		configChanges = dp.config.Changes()
+	}
+
 	for {
+		start := time.Now()
 		devTree, err := dp.scanFPGAs()
+		dpapi.ObserveScan(start, err)
 		if err != nil {
 			return err
 		}
 
+		dp.devTree = devTree
 		notifier.Notify(devTree)
 
 		select {
 		case <-dp.scanDone:
 			return nil
-		case <-dp.scanTicker.C:
+		case <-watcher.Triggers():
+		case <-configChanges:
+			retry = nil
+			if !dp.applyConfig() {
+				retry = time.After(modeSwitchRetryPeriod)
+			}
+		case <-retry:
+			retry = nil
+			if !dp.applyConfig() {
+				retry = time.After(modeSwitchRetryPeriod)
+			}
+		}
+	}
+}
+
+// applyConfig switches the plugin to the mode of the last valid configuration.
+// It returns false if the switch is postponed because devices of the current
+// mode are in use.
+func (dp *devicePlugin) applyConfig() bool {
+	mode := dp.config.Config().(*pluginConfig).Mode
+	if mode == dp.mode {
+		return true
+	}
+
+	if resource, id := dp.deviceInUse(); id != "" {
+		klog.Warningf("Postponing switch to %s mode while %s %s is in use", mode, resource, id)
+		return false
+	}
+
+	if err := dp.setMode(mode); err != nil {
+		// Can't happen as ConfigWatcher accepts only validated configurations.
+		klog.Warningf("Ignoring configuration: %+v", err)
+		return true
+	}
+	klog.V(1).Infof("FPGA device plugin switched to %s mode", mode)
+
+	return true
+}
+
+// deviceInUse returns the resource name and ID of a device found by the last
+// scan that is allocated to a container, if any.
+func (dp *devicePlugin) deviceInUse() (string, string) {
+	if dp.ledger == nil {
+		return "", ""
+	}
+
+	for devType, devices := range dp.devTree {
+		for id := range devices {
+			if dp.ledger.DeviceInUse(namespace, devType, id) {
+				return namespace + "/" + devType, id
+			}
 		}
 	}
+
+	return "", ""
+}
+
+// setMode sets the mode dependent fields of the plugin.
+func (dp *devicePlugin) setMode(mode string) error {
+	getDevTree, ignoreAfuIDs, annotationValue, err := getPluginParams(mode)
+	if err != nil {
+		return err
+	}
+
+	dp.modeLock.Lock()
+	defer dp.modeLock.Unlock()
+
+	dp.mode = mode
+	dp.getDevTree = getDevTree
+	dp.ignoreAfuIDs = ignoreAfuIDs
+	dp.annotationValue = annotationValue
+
+	return nil
+}
+
+// StopScan implements ScanStopper interface.
+func (dp *devicePlugin) StopScan() {
+	dp.scanDone <- true
 }
 
 func (dp *devicePlugin) getDevNode(devName string) (string, error) {
@@ -374,12 +519,14 @@ func main() {
 	var kubeconfig string
 	var master string
 	var nodename string
+	var configFile string
 
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file")
 	flag.StringVar(&master, "master", "", "master url")
 	flag.StringVar(&nodename, "node-name", os.Getenv("NODE_NAME"), "node name in the cluster to query mode annotation from")
 	flag.StringVar(&mode, "mode", string(afMode),
 		fmt.Sprintf("device plugin mode: '%s' (default), '%s' or '%s'", afMode, regionMode, regionDevelMode))
+	flag.StringVar(&configFile, "config", "", "YAML configuration file overriding the mode, reloaded on changes")
 	flag.Parse()
 
 	nodeMode, err := getModeOverrideFromCluster(nodename, kubeconfig, master, mode)
@@ -402,5 +549,21 @@ func main() {
 
 	klog.V(1).Infof("FPGA device plugin (%s) started in %s mode%s", plugin.name, mode, modeMessage)
 	manager := dpapi.NewManager(namespace, plugin)
-	manager.Run()
+	if configFile != "" {
+		plugin.config, err = dpapi.NewConfigWatcher(configFile, func() interface{} {
+			return &pluginConfig{Mode: mode}
+		})
+		if err != nil {
+			klog.Fatalf("%+v", err)
+		}
+		plugin.ledger = dpapi.NewLedger(dpapi.PodResourcesSocket)
+		manager.SetLedger(plugin.ledger)
+	}
+	err = manager.Run(dpapi.SetupSignalHandler())
+	if plugin.config != nil {
+		plugin.config.Close()
+	}
+	if err != nil {
+		klog.Fatalf("%+v", err)
+	}
 }
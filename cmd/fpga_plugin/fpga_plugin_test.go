@@ -15,17 +15,24 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
+	"reflect"
 	"testing"
 
 	"github.com/pkg/errors"
+	"google.golang.org/grpc"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesapi "k8s.io/kubernetes/pkg/kubelet/apis/podresources/v1alpha1"
 
 	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+	dptesting "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin/testing"
+	"github.com/intel/intel-device-plugins-for-kubernetes/pkg/fpga"
 )
 
 func init() {
@@ -83,6 +90,190 @@ func TestPostAllocate(t *testing.T) {
 	}
 }
 
+func TestPostAllocateKeepsAnnotations(t *testing.T) {
+	const cdiAnnotation = "cdi.k8s.io/fpga_intel_com_region"
+
+	response := &pluginapi.AllocateResponse{
+		ContainerResponses: []*pluginapi.ContainerAllocateResponse{
+			{
+				Annotations: map[string]string{cdiAnnotation: "fpga.intel.com/region=intel-fpga-dev.0"},
+			},
+		},
+	}
+
+	dp := &devicePlugin{
+		annotationValue: "some value",
+	}
+	if err := dp.PostAllocate(response); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	expected := map[string]string{
+		cdiAnnotation:  "fpga.intel.com/region=intel-fpga-dev.0",
+		annotationName: "some value",
+	}
+	if annotations := response.ContainerResponses[0].Annotations; !reflect.DeepEqual(annotations, expected) {
+		t.Errorf("Expected annotations %v, but got %v", expected, annotations)
+	}
+}
+
+func TestGetDevicePluginOptions(t *testing.T) {
+	tcases := []struct {
+		mode             string
+		devType          string
+		expectedPreStart bool
+	}{
+		{mode: regionMode, devType: "region-ce48969398f05f33946d560708be108a", expectedPreStart: true},
+		{mode: regionDevelMode, devType: "region-ce48969398f05f33946d560708be108a"},
+		{mode: afMode, devType: "af-f7d.d7a.zTnfB17CxNYw3dfTnBQxTB"},
+	}
+	for _, tt := range tcases {
+		t.Run(tt.mode, func(t *testing.T) {
+			dp := &devicePlugin{mode: tt.mode}
+			if options := dp.GetDevicePluginOptions(tt.devType); options.PreStartRequired != tt.expectedPreStart {
+				t.Errorf("Expected pre-start required %v, but got %v", tt.expectedPreStart, options.PreStartRequired)
+			}
+		})
+	}
+}
+
+func TestPreStartContainer(t *testing.T) {
+	devfs, err := ioutil.TempDir("", "fpgaplugin-prestart")
+	if err != nil {
+		t.Fatalf("Unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(devfs)
+
+	if err = createTestDirs(devfs, "", []string{"intel-fpga-fme.0"}, nil, nil); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	dp := &devicePlugin{devfsDir: devfs}
+	if err = dp.PreStartContainer(&pluginapi.PreStartContainerRequest{DevicesIDs: []string{"intel-fpga-fme.0"}}); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	if err = dp.PreStartContainer(&pluginapi.PreStartContainerRequest{DevicesIDs: []string{"intel-fpga-fme.0", "intel-fpga-fme.1"}}); err == nil {
+		t.Error("Expected error for a missing region, but got success")
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "fpgaplugin-config")
+	if err != nil {
+		t.Fatalf("Unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	configFile := path.Join(tmpdir, "config.yaml")
+	if err = ioutil.WriteFile(configFile, []byte("mode: region\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %+v", err)
+	}
+
+	dp, err := newDevicePluginOPAE("", "", afMode)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	dp.config, err = dpapi.NewConfigWatcher(configFile, func() interface{} {
+		return &pluginConfig{Mode: afMode}
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	defer dp.config.Close()
+
+	dp.applyConfig()
+	if dp.mode != regionMode {
+		t.Errorf("Expected %s mode, but got %s", regionMode, dp.mode)
+	}
+	if dp.annotationValue != namespace+"/"+regionMode {
+		t.Errorf("Unexpected annotation value %q", dp.annotationValue)
+	}
+
+	if err = (&pluginConfig{Mode: "unknown"}).Validate(); err == nil {
+		t.Error("Expected unknown mode to be rejected")
+	}
+}
+
+// podResourcesStub is a fake kubelet pod-resources service.
+type podResourcesStub struct {
+	resp *podresourcesapi.ListPodResourcesResponse
+}
+
+func (s *podResourcesStub) List(context.Context, *podresourcesapi.ListPodResourcesRequest) (*podresourcesapi.ListPodResourcesResponse, error) {
+	return s.resp, nil
+}
+
+func TestApplyConfigInUse(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "fpgaplugin-inuse")
+	if err != nil {
+		t.Fatalf("Unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	configFile := path.Join(tmpdir, "config.yaml")
+	if err = ioutil.WriteFile(configFile, []byte("mode: region\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %+v", err)
+	}
+
+	socket := path.Join(tmpdir, "kubelet.sock")
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Unable to listen to %s: %+v", socket, err)
+	}
+	stub := &podResourcesStub{
+		resp: &podresourcesapi.ListPodResourcesResponse{
+			PodResources: []*podresourcesapi.PodResources{
+				{
+					Name:      "pod1",
+					Namespace: "default",
+					Containers: []*podresourcesapi.ContainerResources{
+						{
+							Name: "app",
+							Devices: []*podresourcesapi.ContainerDevices{
+								{ResourceName: namespace + "/af-f7d", DeviceIds: []string{"intel-fpga-port.0"}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	srv := grpc.NewServer()
+	podresourcesapi.RegisterPodResourcesListerServer(srv, stub)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	dp, err := newDevicePluginOPAE("", "", afMode)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	dp.config, err = dpapi.NewConfigWatcher(configFile, func() interface{} {
+		return &pluginConfig{Mode: afMode}
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	defer dp.config.Close()
+	dp.ledger = dpapi.NewLedger(socket)
+	if err = dp.ledger.Update(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	dp.devTree = dpapi.NewDeviceTree()
+	dp.devTree.AddDevice("af-f7d", "intel-fpga-port.0", dpapi.NewDeviceInfo(pluginapi.Healthy, nil, nil, nil))
+
+	if dp.applyConfig() || dp.mode != afMode {
+		t.Errorf("Expected the switch to be postponed, but the plugin is in %s mode", dp.mode)
+	}
+
+	stub.resp = &podresourcesapi.ListPodResourcesResponse{}
+	if err = dp.ledger.Update(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if !dp.applyConfig() || dp.mode != regionMode {
+		t.Errorf("Expected %s mode, but got %s", regionMode, dp.mode)
+	}
+}
+
 func TestNewDevicePlugin(t *testing.T) {
 	root, err := ioutil.TempDir("", "test_new_device_plugin")
 	if err != nil {
@@ -236,3 +427,55 @@ func TestScan(t *testing.T) {
 		})
 	}
 }
+
+func TestConformance(t *testing.T) {
+	root, err := ioutil.TempDir("", "fpgaplugin-conformance")
+	if err != nil {
+		t.Fatalf("can't create temporary directory: %+v", err)
+	}
+	defer os.RemoveAll(root)
+
+	interfaceID := "ce48969398f05f33946d560708be108a"
+	afuID := "d8424dc4a4a3c413f89e433683f9040b"
+	err = createTestDirs(path.Join(root, "dev"), path.Join(root, "sys", "class", "fpga"),
+		[]string{
+			"intel-fpga-port.0", "intel-fpga-fme.0",
+			"intel-fpga-port.1", "intel-fpga-fme.1",
+		},
+		[]string{
+			"intel-fpga-dev.0/intel-fpga-port.0",
+			"intel-fpga-dev.0/intel-fpga-fme.0/pr",
+			"intel-fpga-dev.1/intel-fpga-port.1",
+			"intel-fpga-dev.1/intel-fpga-fme.1/pr",
+		},
+		map[string][]byte{
+			"intel-fpga-dev.0/intel-fpga-port.0/afu_id":         []byte(afuID + "\n"),
+			"intel-fpga-dev.1/intel-fpga-port.1/afu_id":         []byte(unhealthyAfuID + "\n"),
+			"intel-fpga-dev.0/intel-fpga-fme.0/pr/interface_id": []byte(interfaceID + "\n"),
+			"intel-fpga-dev.1/intel-fpga-fme.1/pr/interface_id": []byte(interfaceID + "\n"),
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deviceTypes []string
+	for _, id := range []string{afuID, unhealthyAfuID} {
+		devType, err := fpga.GetAfuDevType(interfaceID, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deviceTypes = append(deviceTypes, devType)
+	}
+
+	plugin, err := newDevicePlugin(afMode, root)
+	if err != nil {
+		t.Fatalf("failed to create a device plugin: %+v", err)
+	}
+
+	suite := &dptesting.Conformance{
+		Namespace:   namespace,
+		Plugin:      plugin,
+		DeviceTypes: deviceTypes,
+	}
+	suite.Run(t)
+}
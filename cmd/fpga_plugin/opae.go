@@ -20,6 +20,8 @@ import (
 	"regexp"
 
 	"github.com/pkg/errors"
+
+	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
 )
 
 const (
@@ -36,7 +38,7 @@ func getSysFsInfoOPAE(dp *devicePlugin, deviceFolder string, deviceFiles []os.Fi
 
 		if dp.fmeReg.MatchString(name) {
 			if len(regions) > 0 {
-				return nil, nil, errors.Errorf("Detected more than one FPGA region for device %s. Only one region per FPGA device is supported", fname)
+				return nil, nil, dpapi.Fatal(errors.Errorf("Detected more than one FPGA region for device %s. Only one region per FPGA device is supported", fname))
 			}
 			interfaceIDFile := path.Join(deviceFolder, name, "pr", "interface_id")
 			region, err := dp.getFME(interfaceIDFile, name)
@@ -66,6 +68,7 @@ func newDevicePluginOPAE(sysfsDir string, devfsDir string, mode string) (*device
 
 	return &devicePlugin{
 		name: "OPAE",
+		mode: mode,
 
 		sysfsDir: sysfsDir,
 		devfsDir: devfsDir,
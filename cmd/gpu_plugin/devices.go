@@ -0,0 +1,100 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Resource naming schemes.
+const (
+	// All GPUs are exposed as gpu.intel.com/i915.
+	i915Naming = "i915"
+	// GPUs are exposed per family, e.g. gpu.intel.com/gen9.
+	familyNaming = "family"
+	// GPUs are exposed as gpu.intel.com/integrated or gpu.intel.com/discrete.
+	typeNaming = "type"
+
+	integratedType = "integrated"
+	discreteType   = "discrete"
+)
+
+// gpuFamily describes the GPUs sharing the same PCI device IDs.
+type gpuFamily struct {
+	name     string
+	discrete bool
+}
+
+var (
+	gen9  = gpuFamily{name: "gen9"}
+	gen11 = gpuFamily{name: "gen11"}
+	gen12 = gpuFamily{name: "gen12"}
+	dg1   = gpuFamily{name: "dg1", discrete: true}
+)
+
+// knownDevices maps the PCI device IDs of the known GPUs to their families.
+var knownDevices = map[string]gpuFamily{
+	// Skylake
+	"0x1902": gen9, "0x1906": gen9, "0x190b": gen9, "0x1912": gen9,
+	"0x1916": gen9, "0x191b": gen9, "0x191d": gen9, "0x191e": gen9,
+	"0x1926": gen9, "0x193b": gen9, "0x193d": gen9,
+	// Kaby Lake
+	"0x5902": gen9, "0x5906": gen9, "0x5912": gen9, "0x5916": gen9,
+	"0x591b": gen9, "0x591d": gen9, "0x591e": gen9, "0x5926": gen9,
+	// Coffee Lake and Comet Lake
+	"0x3e90": gen9, "0x3e91": gen9, "0x3e92": gen9, "0x3e96": gen9,
+	"0x3e98": gen9, "0x3e9a": gen9, "0x3e9b": gen9, "0x3ea0": gen9,
+	"0x9b41": gen9, "0x9bc5": gen9, "0x9bc8": gen9, "0x9bca": gen9,
+	// Ice Lake
+	"0x8a51": gen11, "0x8a52": gen11, "0x8a53": gen11, "0x8a56": gen11,
+	"0x8a5a": gen11, "0x8a5c": gen11,
+	// Tiger Lake
+	"0x9a40": gen12, "0x9a49": gen12, "0x9a60": gen12, "0x9a68": gen12,
+	"0x9a70": gen12, "0x9a78": gen12,
+	// DG1
+	"0x4905": dg1, "0x4906": dg1, "0x4907": dg1, "0x4908": dg1,
+}
+
+func validateResourceNaming(naming string) error {
+	switch naming {
+	case i915Naming, familyNaming, typeNaming:
+		return nil
+	}
+
+	return errors.Errorf("Unknown resource naming scheme %q", naming)
+}
+
+// deviceTypeName returns the device type of the GPU with the given PCI
+// device ID in the given naming scheme. Unknown GPUs are of type i915.
+func deviceTypeName(naming, deviceID string) string {
+	family, known := knownDevices[strings.ToLower(strings.TrimSpace(deviceID))]
+	if !known {
+		return deviceType
+	}
+
+	switch naming {
+	case familyNaming:
+		return family.name
+	case typeNaming:
+		if family.discrete {
+			return discreteType
+		}
+		return integratedType
+	}
+
+	return deviceType
+}
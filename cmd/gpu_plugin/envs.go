@@ -0,0 +1,168 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// Environment variables describing the allocated cards in containers.
+	// The lists are sorted by the card index.
+	cardsEnv        = "GPU_CARDS"
+	pciAddressesEnv = "GPU_PCI_ADDRESSES"
+	shareIndexEnv   = "GPU_SHARE_INDEX"
+
+	// shareEnvPrefix prefixes the per device variables carrying the share
+	// index of a device to PostAllocate, which replaces them with shareIndexEnv.
+	// They're allocate envs, so they don't leak to containers via CDI specs.
+	shareEnvPrefix = "GPU_SHARE_INDEX_"
+)
+
+var envNameReplacer = strings.NewReplacer("-", "_", ".", "_", ":", "_")
+
+// cardShare is an allocated share of a card.
+type cardShare struct {
+	card  int
+	share int
+}
+
+// cardIndex returns the index of the given card, -1 for IDs of other devices.
+func cardIndex(card string) int {
+	if !strings.HasPrefix(card, "card") {
+		return -1
+	}
+
+	index, err := strconv.Atoi(strings.TrimPrefix(card, "card"))
+	if err != nil {
+		return -1
+	}
+
+	return index
+}
+
+// shareEnvs returns the envs carrying the share index of the given device to
+// PostAllocate, nil if the cards are not shared.
+func (dp *devicePlugin) shareEnvs(devID, card string, share int) map[string]string {
+	if dp.options.sharedDevNum < 2 {
+		return nil
+	}
+
+	return map[string]string{
+		shareEnvPrefix + strings.ToUpper(envNameReplacer.Replace(devID)): fmt.Sprintf("%d:%d", cardIndex(card), share),
+	}
+}
+
+// setCardEnvs tells the containers the indices and the PCI addresses of
+// the cards they are given, and the shares of the cards if they are shared
+// according to the given options.
+func (dp *devicePlugin) setCardEnvs(response *pluginapi.AllocateResponse, options cliOptions) {
+	for _, cresp := range response.ContainerResponses {
+		cards := map[int]string{}
+		for _, dev := range cresp.Devices {
+			if card := dp.cardOfNode(dev.HostPath); card != "" {
+				cards[cardIndex(card)] = card
+			}
+		}
+
+		shares := takeShares(cresp)
+		if options.sharedDevNum < 2 {
+			shares = nil
+		}
+
+		if len(cards) == 0 && len(shares) == 0 {
+			continue
+		}
+		if cresp.Envs == nil {
+			cresp.Envs = make(map[string]string)
+		}
+
+		if len(cards) > 0 {
+			indices := make([]int, 0, len(cards))
+			for index := range cards {
+				indices = append(indices, index)
+			}
+			sort.Ints(indices)
+
+			names := make([]string, 0, len(indices))
+			addresses := make([]string, 0, len(indices))
+			for _, index := range indices {
+				names = append(names, strconv.Itoa(index))
+				if address := dp.pciAddress(cards[index]); address != "" {
+					addresses = append(addresses, address)
+				}
+			}
+			cresp.Envs[cardsEnv] = strings.Join(names, ",")
+			// The addresses are given only if all are known to keep
+			// the lists aligned.
+			if len(addresses) == len(names) {
+				cresp.Envs[pciAddressesEnv] = strings.Join(addresses, ",")
+			}
+		}
+
+		if len(shares) > 0 {
+			cresp.Envs[shareIndexEnv] = strings.Join(shares, ",")
+		}
+	}
+}
+
+// takeShares removes the per device share envs of the given container and
+// returns the shares as sorted "card:share" pairs.
+func takeShares(cresp *pluginapi.ContainerAllocateResponse) []string {
+	unique := map[cardShare]bool{}
+	for key, value := range cresp.Envs {
+		if !strings.HasPrefix(key, shareEnvPrefix) {
+			continue
+		}
+		delete(cresp.Envs, key)
+
+		var s cardShare
+		if _, err := fmt.Sscanf(value, "%d:%d", &s.card, &s.share); err == nil {
+			unique[s] = true
+		}
+	}
+
+	sorted := make([]cardShare, 0, len(unique))
+	for s := range unique {
+		sorted = append(sorted, s)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].card != sorted[j].card {
+			return sorted[i].card < sorted[j].card
+		}
+		return sorted[i].share < sorted[j].share
+	})
+
+	shares := make([]string, 0, len(sorted))
+	for _, s := range sorted {
+		shares = append(shares, fmt.Sprintf("%d:%d", s.card, s.share))
+	}
+
+	return shares
+}
+
+// pciAddress returns the PCI address of the given card, empty if unknown.
+func (dp *devicePlugin) pciAddress(card string) string {
+	if dev := dp.pciDevice(card); dev != nil {
+		return dev.BDF
+	}
+
+	return ""
+}
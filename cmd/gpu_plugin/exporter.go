@@ -0,0 +1,204 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog"
+
+	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+)
+
+const exporterNamespace = "gpu"
+
+// allocationLister lists the devices allocated to containers.
+type allocationLister interface {
+	Allocations(namespace string) map[string]map[string][]dpapi.Allocation
+}
+
+// cardMetric is a metric read from a sysfs file of a card.
+type cardMetric struct {
+	// files are the candidate paths relative to the card directory, the
+	// first one found is read. Globs are allowed.
+	files     []string
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	// scale converts the value to the unit of the metric.
+	scale float64
+}
+
+func newCardDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(exporterNamespace, "", name), help,
+		[]string{"card"}, nil)
+}
+
+// allocationDesc describes the pods the cards are allocated to. It's kept
+// apart from the card metrics so that their series don't change with the
+// pods, and can be joined with them on the card label.
+var allocationDesc = prometheus.NewDesc(prometheus.BuildFQName(exporterNamespace, "", "allocation_info"),
+	"Pods the GPU is allocated to, one series per pod with the value 1.",
+	[]string{"card", "namespace", "pod"}, nil)
+
+var cardMetrics = []cardMetric{
+	{
+		files:     []string{"gt_cur_freq_mhz", "gt/gt0/rps_cur_freq_mhz"},
+		desc:      newCardDesc("current_frequency_mhz", "Frequency requested by the GPU in MHz."),
+		valueType: prometheus.GaugeValue,
+		scale:     1,
+	},
+	{
+		files:     []string{"gt_act_freq_mhz", "gt/gt0/rps_act_freq_mhz"},
+		desc:      newCardDesc("actual_frequency_mhz", "Actual frequency of the GPU in MHz."),
+		valueType: prometheus.GaugeValue,
+		scale:     1,
+	},
+	{
+		files:     []string{"gt_max_freq_mhz", "gt/gt0/rps_max_freq_mhz"},
+		desc:      newCardDesc("max_frequency_mhz", "Maximum frequency of the GPU in MHz."),
+		valueType: prometheus.GaugeValue,
+		scale:     1,
+	},
+	{
+		files:     []string{"power/rc6_residency_ms", "gt/gt0/rc6_residency_ms"},
+		desc:      newCardDesc("rc6_residency_seconds_total", "Time the GPU has spent in the RC6 power saving state."),
+		valueType: prometheus.CounterValue,
+		scale:     1e-3,
+	},
+	{
+		files:     []string{"device/hwmon/hwmon*/energy1_input"},
+		desc:      newCardDesc("energy_joules_total", "Energy consumed by the GPU."),
+		valueType: prometheus.CounterValue,
+		scale:     1e-6,
+	},
+	{
+		files:     []string{"device/hwmon/hwmon*/power1_input"},
+		desc:      newCardDesc("power_watts", "Power drawn by the GPU."),
+		valueType: prometheus.GaugeValue,
+		scale:     1e-6,
+	},
+}
+
+// exporter implements prometheus.Collector interface. It reads the metrics
+// of the Intel GPUs from sysfs on every scrape.
+type exporter struct {
+	sysfsDir     string
+	gpuDeviceReg *regexp.Regexp
+	allocations  allocationLister
+}
+
+func newExporter(sysfsDir string, allocations allocationLister) *exporter {
+	return &exporter{
+		sysfsDir:     sysfsDir,
+		gpuDeviceReg: regexp.MustCompile(gpuDeviceRE),
+		allocations:  allocations,
+	}
+}
+
+// Describe implements prometheus.Collector interface.
+func (e *exporter) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range cardMetrics {
+		ch <- m.desc
+	}
+	ch <- allocationDesc
+}
+
+// Collect implements prometheus.Collector interface.
+func (e *exporter) Collect(ch chan<- prometheus.Metric) {
+	files, err := ioutil.ReadDir(e.sysfsDir)
+	if err != nil {
+		klog.Warningf("Can't read sysfs folder: %+v", err)
+		return
+	}
+
+	holders := e.holders()
+	for _, f := range files {
+		card := f.Name()
+		if !e.gpuDeviceReg.MatchString(card) {
+			continue
+		}
+		dat, err := ioutil.ReadFile(path.Join(e.sysfsDir, card, "device/vendor"))
+		if err != nil || strings.TrimSpace(string(dat)) != vendorString {
+			continue
+		}
+
+		for _, m := range cardMetrics {
+			value, ok := e.read(card, m.files)
+			if !ok {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(m.desc, m.valueType, value*m.scale, card)
+		}
+		for pod := range holders[card] {
+			ch <- prometheus.MustNewConstMetric(allocationDesc, prometheus.GaugeValue, 1, card, pod.Namespace, pod.Pod)
+		}
+	}
+}
+
+// read returns the value of the first of the given files found for the card.
+func (e *exporter) read(card string, files []string) (float64, bool) {
+	for _, file := range files {
+		matches, _ := filepath.Glob(path.Join(e.sysfsDir, card, file))
+		for _, match := range matches {
+			dat, err := ioutil.ReadFile(match)
+			if err != nil {
+				continue
+			}
+			value, err := strconv.ParseFloat(strings.TrimSpace(string(dat)), 64)
+			if err != nil {
+				klog.V(4).Infof("Invalid value in %s: %+v", match, err)
+				continue
+			}
+			return value, true
+		}
+	}
+
+	return 0, false
+}
+
+// cardHolders maps cards to the pods they are allocated to.
+type cardHolders map[string]map[dpapi.Allocation]bool
+
+// holders returns the pods holding the cards. Containers of the same pod
+// count once.
+func (e *exporter) holders() cardHolders {
+	holders := cardHolders{}
+	if e.allocations == nil {
+		return holders
+	}
+
+	for _, devices := range e.allocations.Allocations(namespace) {
+		for id, allocations := range devices {
+			card := cardOf(id)
+			if !e.gpuDeviceReg.MatchString(card) {
+				continue
+			}
+			if holders[card] == nil {
+				holders[card] = make(map[dpapi.Allocation]bool)
+			}
+			for _, a := range allocations {
+				holders[card][dpapi.Allocation{Namespace: a.Namespace, Pod: a.Pod}] = true
+			}
+		}
+	}
+
+	return holders
+}
@@ -22,6 +22,7 @@ import (
 	"path"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -38,37 +39,157 @@ const (
 	gpuDeviceRE       = `^card[0-9]+$`
 	controlDeviceRE   = `^controlD[0-9]+$`
 	vendorString      = "0x8086"
+	drmSubsystem      = "drm"
 
 	// Device plugin settings.
 	namespace  = "gpu.intel.com"
 	deviceType = "i915"
 )
 
+// cliOptions contains the plugin's settings given in the command line.
+type cliOptions struct {
+	sharedDevNum     int
+	allocationPolicy dpapi.AllocationPolicy
+	resourceNaming   string
+	memoryResource   bool
+	memoryMiB        int
+	memoryUnitMiB    int
+	nodeSelection    string
+	sriovResources   bool
+}
+
+// pluginConfig contains the plugin's settings given in the configuration file.
+// The settings missing in the file default to the command line options.
+type pluginConfig struct {
+	SharedDevNum     int    `json:"sharedDevNum"`
+	AllocationPolicy string `json:"allocationPolicy"`
+	ResourceNaming   string `json:"resourceNaming"`
+	MemoryResource   bool   `json:"memoryResource"`
+	MemoryMiB        int    `json:"memoryMiB"`
+	MemoryUnitMiB    int    `json:"memoryUnitMiB"`
+	NodeSelection    string `json:"nodeSelection"`
+	SriovResources   bool   `json:"sriovResources"`
+}
+
+// Validate implements ConfigValidator interface.
+func (c *pluginConfig) Validate() error {
+	_, err := c.options()
+	return err
+}
+
+func (c *pluginConfig) options() (cliOptions, error) {
+	if c.SharedDevNum < 1 {
+		return cliOptions{}, errors.New("The number of containers sharing the same GPU must greater than zero")
+	}
+
+	policy, err := dpapi.NewAllocationPolicy(c.AllocationPolicy)
+	if err != nil {
+		return cliOptions{}, err
+	}
+
+	naming := c.ResourceNaming
+	if naming == "" {
+		naming = i915Naming
+	}
+	if err = validateResourceNaming(naming); err != nil {
+		return cliOptions{}, err
+	}
+
+	if err = validateMemoryMiB(c.MemoryMiB); err != nil {
+		return cliOptions{}, err
+	}
+
+	unit := c.MemoryUnitMiB
+	if unit == 0 {
+		unit = defaultMemoryUnitMiB
+	}
+	if err = validateMemoryUnitMiB(unit); err != nil {
+		return cliOptions{}, err
+	}
+
+	selection := c.NodeSelection
+	if selection == "" {
+		selection = bothNodes
+	}
+	if err = validateNodeSelection(selection); err != nil {
+		return cliOptions{}, err
+	}
+
+	return cliOptions{
+		sharedDevNum:     c.SharedDevNum,
+		allocationPolicy: policy,
+		resourceNaming:   naming,
+		memoryResource:   c.MemoryResource,
+		memoryMiB:        c.MemoryMiB,
+		memoryUnitMiB:    unit,
+		nodeSelection:    selection,
+		sriovResources:   c.SriovResources,
+	}, nil
+}
+
 type devicePlugin struct {
 	sysfsDir string
 	devfsDir string
+	// debugfsDir is the i915 debugfs directory, health checks skip
+	// debugfs if empty.
+	debugfsDir string
+	// vfioDir is the VFIO device directory, VFs bound to vfio-pci are
+	// skipped if empty.
+	vfioDir string
 
-	sharedDevNum int
+	// options are replaced by applyConfig in the Scan() goroutine with
+	// devicesLock held. The other goroutines read them with the lock held.
+	options cliOptions
+	// config overrides options if the plugin is given a configuration file.
+	config *dpapi.ConfigWatcher
 
 	gpuDeviceReg     *regexp.Regexp
 	controlDeviceReg *regexp.Regexp
+	renderDeviceReg  *regexp.Regexp
+
+	// card of the unpaired allocation if the memory resource is enabled.
+	hint        cardHint
+	devicesLock sync.Mutex
+
+	// Card -> its health checked last.
+	cardHealth map[string]cardHealth
+	healthLock sync.Mutex
+
+	scanDone chan bool
 }
 
-func newDevicePlugin(sysfsDir, devfsDir string, sharedDevNum int) *devicePlugin {
+func newDevicePlugin(sysfsDir, devfsDir string, options cliOptions) *devicePlugin {
 	return &devicePlugin{
 		sysfsDir:         sysfsDir,
 		devfsDir:         devfsDir,
-		sharedDevNum:     sharedDevNum,
+		options:          options,
 		gpuDeviceReg:     regexp.MustCompile(gpuDeviceRE),
 		controlDeviceReg: regexp.MustCompile(controlDeviceRE),
+		renderDeviceReg:  regexp.MustCompile(renderDeviceRE),
+		cardHealth:       make(map[string]cardHealth),
+		scanDone:         make(chan bool, 1),
 	}
 }
 
 func (dp *devicePlugin) Scan(notifier dpapi.Notifier) error {
 	var previouslyFound int = -1
 
+	watcher, err := dpapi.NewWatcher([]string{drmSubsystem, vfioSubsystem}, []string{dp.devfsDir, dp.vfioDir})
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	var configChanges <-chan struct{}
+	if dp.config != nil {
+		dp.applyConfig()
+		configChanges = dp.config.Changes()
+	}
+
 	for {
+		start := time.Now()
 		devTree, err := dp.scan()
+		dpapi.ObserveScan(start, err)
 		if err != nil {
 			klog.Warning("Failed to scan: ", err)
 		}
@@ -81,10 +202,60 @@ func (dp *devicePlugin) Scan(notifier dpapi.Notifier) error {
 
 		notifier.Notify(devTree)
 
-		time.Sleep(5 * time.Second)
+		select {
+		case <-dp.scanDone:
+			return nil
+		case <-watcher.Triggers():
+		case <-configChanges:
+			dp.applyConfig()
+		}
 	}
 }
 
+// applyConfig switches the plugin to the last valid configuration.
+func (dp *devicePlugin) applyConfig() {
+	options, err := dp.config.Config().(*pluginConfig).options()
+	if err != nil {
+		// Can't happen as ConfigWatcher accepts only validated configurations.
+		klog.Warningf("Ignoring configuration: %+v", err)
+		return
+	}
+
+	dp.devicesLock.Lock()
+	defer dp.devicesLock.Unlock()
+
+	dp.options = options
+}
+
+// currentOptions returns a snapshot of the options for the goroutines
+// other than Scan().
+func (dp *devicePlugin) currentOptions() cliOptions {
+	dp.devicesLock.Lock()
+	defer dp.devicesLock.Unlock()
+
+	return dp.options
+}
+
+// StopScan implements ScanStopper interface.
+func (dp *devicePlugin) StopScan() {
+	dp.scanDone <- true
+}
+
+// AllocationPolicy implements PreferredAllocator interface.
+func (dp *devicePlugin) AllocationPolicy(devType string, rqt *pluginapi.PreferredAllocationRequest) dpapi.AllocationPolicy {
+	dp.devicesLock.Lock()
+	defer dp.devicesLock.Unlock()
+
+	policy := dp.options.allocationPolicy
+	if dp.options.memoryResource {
+		if card := dp.hintedCard(devType, rqt); card != "" {
+			policy = preferCard(policy, card)
+		}
+	}
+
+	return policy
+}
+
 func (dp *devicePlugin) scan() (dpapi.DeviceTree, error) {
 	files, err := ioutil.ReadDir(dp.sysfsDir)
 	if err != nil {
@@ -135,32 +306,116 @@ func (dp *devicePlugin) scan() (dpapi.DeviceTree, error) {
 		}
 
 		if len(nodes) > 0 {
-			for i := 0; i < dp.sharedDevNum; i++ {
-				devID := fmt.Sprintf("%s-%d", f.Name(), i)
-				// Currently only one device type (i915) is supported.
-				// TODO: check model ID to differentiate device models.
-				devTree.AddDevice(deviceType, devID, dpapi.NewDeviceInfo(pluginapi.Healthy, nodes, nil, nil))
-			}
+			dp.addDevices(devTree, f.Name(), nodes)
 		}
+		dp.addVfioFunctions(devTree, f.Name())
 	}
 
 	return devTree, nil
 }
 
+// deviceType returns the device type of the given card according to
+// its PCI device ID, the resource naming scheme and its SR-IOV function.
+func (dp *devicePlugin) deviceType(card string) string {
+	return dp.namedType(card) + dp.sriovSuffix(card)
+}
+
+// namedType returns the device type of the given card according to
+// its PCI device ID and the resource naming scheme.
+func (dp *devicePlugin) namedType(card string) string {
+	if dp.options.resourceNaming == i915Naming {
+		return deviceType
+	}
+
+	dat, err := ioutil.ReadFile(path.Join(dp.sysfsDir, card, "device/device"))
+	if err != nil {
+		klog.Warningf("Can't read device ID of %s, exposing it as %s: %+v", card, deviceType, err)
+		return deviceType
+	}
+
+	return deviceTypeName(dp.options.resourceNaming, string(dat))
+}
+
 func main() {
-	var sharedDevNum int
+	var defaults pluginConfig
+	var configFile string
+	var numVFs int64
+	var exportMetrics bool
 
-	flag.IntVar(&sharedDevNum, "shared-dev-num", 1, "number of containers sharing the same GPU device")
+	flag.IntVar(&defaults.SharedDevNum, "shared-dev-num", 1, "number of containers sharing the same GPU device")
+	flag.StringVar(&defaults.AllocationPolicy, "allocation-policy", dpapi.NonePolicyName,
+		fmt.Sprintf("preferred allocation policy: '%s' (default), '%s', '%s' or '%s'",
+			dpapi.NonePolicyName, dpapi.PackedPolicyName, dpapi.BalancedPolicyName, dpapi.NUMALocalPolicyName))
+	flag.StringVar(&defaults.ResourceNaming, "resource-naming", i915Naming,
+		fmt.Sprintf("resource naming scheme: '%s' (default) exposes all GPUs as %s/%s, '%s' per GPU family (e.g. %s/%s), '%s' as %s/%s or %s/%s",
+			i915Naming, namespace, deviceType, familyNaming, namespace, gen9.name, typeNaming, namespace, integratedType, namespace, discreteType))
+	flag.BoolVar(&defaults.MemoryResource, "memory-resource", false,
+		fmt.Sprintf("expose GPU memory as %s/%s in units of -memory-unit-mib in addition to the shared GPUs", namespace, memoryDeviceType(defaultMemoryUnitMiB)))
+	flag.IntVar(&defaults.MemoryMiB, "memory-mib", 0,
+		fmt.Sprintf("memory in MiB of GPUs not reporting their local memory in %s (no memory resource if 0)", lmemTotalFile))
+	flag.IntVar(&defaults.MemoryUnitMiB, "memory-unit-mib", defaultMemoryUnitMiB,
+		fmt.Sprintf("size of the GPU memory units in MiB, e.g. 1 exposes the memory as %s/%s", namespace, memoryDeviceType(1)))
+	flag.StringVar(&defaults.NodeSelection, "node-selection", bothNodes,
+		fmt.Sprintf("GPU device nodes given to containers: '%s' (default) primary and render nodes, '%s' render nodes only, '%s' primary nodes only, '%s' both as separate resources with '%s' and '%s' suffixes",
+			bothNodes, renderNodes, primaryNodes, splitNodes, renderSuffix, primarySuffix))
+	flag.BoolVar(&defaults.SriovResources, "sriov-resources", false,
+		fmt.Sprintf("expose SR-IOV physical and virtual functions as separate resources with '%s' and '%s' suffixes, and VFs bound to %s with '%s%s' suffix",
+			pfSuffix, vfSuffix, vfioDriver, vfSuffix, vfioSuffix))
+	flag.Int64Var(&numVFs, "sriov-numvfs", 0, "number of SR-IOV virtual functions to create on GPUs supporting SR-IOV at startup (unchanged if 0)")
+	flag.BoolVar(&exportMetrics, "exporter", false,
+		fmt.Sprintf("export frequency, RC6 residency and power metrics of GPUs prefixed with '%s_' at -metrics-address", exporterNamespace))
+	flag.StringVar(&configFile, "config", "", "YAML configuration file overriding the command line options, reloaded on changes")
 	flag.Parse()
 
-	if sharedDevNum < 1 {
-		klog.Warning("The number of containers sharing the same GPU must greater than zero")
+	opts, err := defaults.options()
+	if err == nil {
+		err = validateNumVFs(numVFs)
+	}
+	if err != nil {
+		klog.Warning(err)
 		os.Exit(1)
 	}
 
 	klog.V(1).Info("GPU device plugin started")
 
-	plugin := newDevicePlugin(sysfsDrmDirectory, devfsDriDirectory, sharedDevNum)
+	plugin := newDevicePlugin(sysfsDrmDirectory, devfsDriDirectory, opts)
+	if _, err = os.Stat(debugfsDriDirectory); err == nil {
+		plugin.debugfsDir = debugfsDriDirectory
+	} else {
+		klog.Warningf("Not checking if GPUs are wedged, %s is not mounted: %+v", debugfsDriDirectory, err)
+	}
+	plugin.vfioDir = devfsVfioDirectory
+	if numVFs > 0 {
+		if err = plugin.provisionVFs(numVFs); err != nil {
+			klog.Fatalf("%+v", err)
+		}
+	}
+	if configFile != "" {
+		plugin.config, err = dpapi.NewConfigWatcher(configFile, func() interface{} {
+			config := defaults
+			return &config
+		})
+		if err != nil {
+			klog.Fatalf("%+v", err)
+		}
+	}
+
 	manager := dpapi.NewManager(namespace, plugin)
-	manager.Run()
+	if exportMetrics {
+		if flag.Lookup("metrics-address").Value.String() == "" {
+			klog.Warning("GPU metrics are exported only with -metrics-address")
+		}
+		ledger := dpapi.NewLedger(dpapi.PodResourcesSocket)
+		if err = dpapi.RegisterCollector(newExporter(sysfsDrmDirectory, ledger)); err != nil {
+			klog.Fatalf("%+v", err)
+		}
+		manager.SetLedger(ledger)
+	}
+	err = manager.Run(dpapi.SetupSignalHandler())
+	if plugin.config != nil {
+		plugin.config.Close()
+	}
+	if err != nil {
+		klog.Fatalf("%+v", err)
+	}
 }
@@ -20,8 +20,17 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+	dptesting "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin/testing"
 )
 
 func init() {
@@ -92,9 +101,34 @@ func TestScan(t *testing.T) {
 			expectedDevs: 0,
 			expectedErr:  false,
 		},
+		{
+			sysfsdirs: []string{
+				"card0/device/drm/card0",
+				"card1/device/drm/card1",
+			},
+			sysfsfiles: map[string][]byte{
+				"card0/device/vendor": []byte("0x8086"),
+				"card1/device/vendor": []byte("0x8086"),
+			},
+			devfsdirs:    []string{"card0", "card1"},
+			expectedDevs: 2,
+			expectedErr:  false,
+		},
+		{
+			sysfsdirs: []string{
+				"card0/device/drm/card0",
+				"card0/device/drm/renderD128",
+			},
+			sysfsfiles: map[string][]byte{
+				"card0/device/vendor": []byte("0x8086"),
+			},
+			devfsdirs:    []string{"card0", "renderD128"},
+			expectedDevs: 1,
+			expectedErr:  false,
+		},
 	}
 
-	testPlugin := newDevicePlugin(sysfs, devfs, 1)
+	testPlugin := newDevicePlugin(sysfs, devfs, cliOptions{sharedDevNum: 1})
 
 	if testPlugin == nil {
 		t.Fatal("Failed to create a deviceManager")
@@ -137,3 +171,1001 @@ func TestScan(t *testing.T) {
 		}
 	}
 }
+
+func TestScanDeviceTypes(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "gpuplugin-devicetypes")
+	if err != nil {
+		t.Fatalf("Unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	sysfs := path.Join(tmpdir, "sysfs")
+	devfs := path.Join(tmpdir, "devfs")
+	// card3 has no device ID.
+	deviceIDs := map[string]string{
+		"card0": "0x3e92\n",
+		"card1": "0x4905\n",
+		"card2": "0xffff\n",
+		"card3": "",
+	}
+	for card, deviceID := range deviceIDs {
+		if err = os.MkdirAll(path.Join(sysfs, card, "device/drm", card), 0755); err != nil {
+			t.Fatalf("Failed to create fake device directory: %+v", err)
+		}
+		if err = ioutil.WriteFile(path.Join(sysfs, card, "device/vendor"), []byte("0x8086"), 0644); err != nil {
+			t.Fatalf("Failed to create fake vendor file: %+v", err)
+		}
+		if deviceID != "" {
+			if err = ioutil.WriteFile(path.Join(sysfs, card, "device/device"), []byte(deviceID), 0644); err != nil {
+				t.Fatalf("Failed to create fake device file: %+v", err)
+			}
+		}
+		if err = os.MkdirAll(path.Join(devfs, card), 0755); err != nil {
+			t.Fatalf("Failed to create fake device directory: %+v", err)
+		}
+	}
+
+	tcases := []struct {
+		naming   string
+		expected map[string][]string
+	}{
+		{
+			naming: i915Naming,
+			expected: map[string][]string{
+				"i915": {"card0-0", "card1-0", "card2-0", "card3-0"},
+			},
+		},
+		{
+			naming: familyNaming,
+			expected: map[string][]string{
+				"gen9": {"card0-0"},
+				"dg1":  {"card1-0"},
+				"i915": {"card2-0", "card3-0"},
+			},
+		},
+		{
+			naming: typeNaming,
+			expected: map[string][]string{
+				"integrated": {"card0-0"},
+				"discrete":   {"card1-0"},
+				"i915":       {"card2-0", "card3-0"},
+			},
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.naming, func(t *testing.T) {
+			testPlugin := newDevicePlugin(sysfs, devfs, cliOptions{sharedDevNum: 1, resourceNaming: tc.naming})
+			tree, err := testPlugin.scan()
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+
+			result := make(map[string][]string)
+			for devType, devices := range tree {
+				for id := range devices {
+					result[devType] = append(result[devType], id)
+				}
+				sort.Strings(result[devType])
+			}
+			if !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("Expected %v, but got %v", tc.expected, result)
+			}
+		})
+	}
+}
+
+// preferredAllocation orders the devices of the given type like the server
+// of the type does with the policy of the plugin.
+func preferredAllocation(dp *devicePlugin, tree dpapi.DeviceTree, devType string, rqt *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	return dpapi.PreferredAllocation(dp.AllocationPolicy(devType, rqt), tree[devType], rqt)
+}
+
+func TestGetPreferredAllocation(t *testing.T) {
+	tmpdir := fmt.Sprintf("/tmp/gpuplugin-test-%d", time.Now().Unix())
+	sysfs := path.Join(tmpdir, "sysfs")
+	devfs := path.Join(tmpdir, "devfs")
+	defer os.RemoveAll(tmpdir)
+
+	for _, card := range []string{"card0", "card1"} {
+		if err := os.MkdirAll(path.Join(sysfs, card, "device/drm", card), 0755); err != nil {
+			t.Fatalf("Failed to create fake device directory: %+v", err)
+		}
+		if err := ioutil.WriteFile(path.Join(sysfs, card, "device/vendor"), []byte("0x8086"), 0644); err != nil {
+			t.Fatalf("Failed to create fake vendor file: %+v", err)
+		}
+		if err := os.MkdirAll(path.Join(devfs, card), 0755); err != nil {
+			t.Fatalf("Failed to create fake device directory: %+v", err)
+		}
+	}
+
+	testPlugin := newDevicePlugin(sysfs, devfs, cliOptions{
+		sharedDevNum:     2,
+		allocationPolicy: dpapi.BalancedPolicy,
+	})
+	tree, err := testPlugin.scan()
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	resp, err := preferredAllocation(testPlugin, tree, deviceType, &pluginapi.PreferredAllocationRequest{
+		ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+			{
+				AvailableDeviceIDs: []string{"card0-0", "card0-1", "card1-0", "card1-1"},
+				AllocationSize:     2,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	expected := []string{"card0-0", "card1-0"}
+	if !reflect.DeepEqual(resp.ContainerResponses[0].DeviceIDs, expected) {
+		t.Errorf("Expected %v, but got %v", expected, resp.ContainerResponses[0].DeviceIDs)
+	}
+}
+
+func TestPluginConfig(t *testing.T) {
+	tcases := []struct {
+		name        string
+		config      pluginConfig
+		expectedErr bool
+	}{
+		{
+			name:   "Valid config",
+			config: pluginConfig{SharedDevNum: 2, AllocationPolicy: dpapi.BalancedPolicyName},
+		},
+		{
+			name:        "No sharing",
+			config:      pluginConfig{SharedDevNum: 0, AllocationPolicy: dpapi.NonePolicyName},
+			expectedErr: true,
+		},
+		{
+			name:   "Resource naming",
+			config: pluginConfig{SharedDevNum: 1, AllocationPolicy: dpapi.NonePolicyName, ResourceNaming: familyNaming},
+		},
+		{
+			name:        "Unknown resource naming",
+			config:      pluginConfig{SharedDevNum: 1, AllocationPolicy: dpapi.NonePolicyName, ResourceNaming: "model"},
+			expectedErr: true,
+		},
+		{
+			name:        "Negative memory",
+			config:      pluginConfig{SharedDevNum: 1, AllocationPolicy: dpapi.NonePolicyName, MemoryMiB: -1},
+			expectedErr: true,
+		},
+		{
+			name:        "Negative memory unit",
+			config:      pluginConfig{SharedDevNum: 1, AllocationPolicy: dpapi.NonePolicyName, MemoryUnitMiB: -1},
+			expectedErr: true,
+		},
+		{
+			name:        "Unknown policy",
+			config:      pluginConfig{SharedDevNum: 1, AllocationPolicy: "random"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tcases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.expectedErr && err == nil {
+				t.Error("expected error, but got nothing")
+			}
+			if !tt.expectedErr && err != nil {
+				t.Errorf("unexpected error: %+v", err)
+			}
+		})
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "gpuplugin-config")
+	if err != nil {
+		t.Fatalf("Unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	configFile := path.Join(tmpdir, "config.yaml")
+	if err = ioutil.WriteFile(configFile, []byte("sharedDevNum: 3\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %+v", err)
+	}
+
+	testPlugin := newDevicePlugin("", "", cliOptions{sharedDevNum: 1})
+	testPlugin.config, err = dpapi.NewConfigWatcher(configFile, func() interface{} {
+		return &pluginConfig{SharedDevNum: 1, AllocationPolicy: dpapi.PackedPolicyName}
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	defer testPlugin.config.Close()
+
+	// Allocations read the options concurrently, which the race detector
+	// checks.
+	allocated := make(chan struct{})
+	go func() {
+		defer close(allocated)
+		for i := 0; i < 100; i++ {
+			_ = testPlugin.PostAllocate(&pluginapi.AllocateResponse{
+				ContainerResponses: []*pluginapi.ContainerAllocateResponse{{}},
+			})
+		}
+	}()
+	testPlugin.applyConfig()
+	<-allocated
+
+	if testPlugin.options.sharedDevNum != 3 {
+		t.Errorf("Expected 3 shared devices, but got %d", testPlugin.options.sharedDevNum)
+	}
+	if testPlugin.options.allocationPolicy == nil {
+		t.Error("Expected allocation policy to default to the command line option")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "gpuplugin-conformance")
+	if err != nil {
+		t.Fatalf("Unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	sysfs := path.Join(tmpdir, "sysfs")
+	devfs := path.Join(tmpdir, "devfs")
+	for _, card := range []string{"card0", "card1"} {
+		if err = os.MkdirAll(path.Join(sysfs, card, "device/drm", card), 0755); err != nil {
+			t.Fatalf("Failed to create fake device directory: %+v", err)
+		}
+		if err = ioutil.WriteFile(path.Join(sysfs, card, "device/vendor"), []byte("0x8086"), 0644); err != nil {
+			t.Fatalf("Failed to create fake vendor file: %+v", err)
+		}
+		if err = os.Symlink("../../../bus/pci/drivers/i915", path.Join(sysfs, card, "device/driver")); err != nil {
+			t.Fatalf("Failed to create fake driver link: %+v", err)
+		}
+		if err = os.MkdirAll(path.Join(devfs, card), 0755); err != nil {
+			t.Fatalf("Failed to create fake device directory: %+v", err)
+		}
+	}
+
+	suite := &dptesting.Conformance{
+		Namespace:   namespace,
+		Plugin:      newDevicePlugin(sysfs, devfs, cliOptions{sharedDevNum: 2, allocationPolicy: dpapi.BalancedPolicy}),
+		DeviceTypes: []string{deviceType},
+		MakeUnhealthy: func() error {
+			// card0 hangs.
+			return ioutil.WriteFile(path.Join(sysfs, "card0", errorStateFile), []byte("GPU HANG: ecode 9:1:0x00000000"), 0644)
+		},
+	}
+	suite.Run(t)
+}
+
+func TestScanMemory(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "gpuplugin-memory")
+	if err != nil {
+		t.Fatalf("Unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	sysfs := path.Join(tmpdir, "sysfs")
+	devfs := path.Join(tmpdir, "devfs")
+	// card0 has 4 MiB local memory, card1 doesn't report it, card2 reports garbage.
+	lmem := map[string]string{
+		"card0": "4194304\n",
+		"card1": "",
+		"card2": "plenty\n",
+	}
+	for card, size := range lmem {
+		if err = os.MkdirAll(path.Join(sysfs, card, "device/drm", card), 0755); err != nil {
+			t.Fatalf("Failed to create fake device directory: %+v", err)
+		}
+		if err = ioutil.WriteFile(path.Join(sysfs, card, "device/vendor"), []byte("0x8086"), 0644); err != nil {
+			t.Fatalf("Failed to create fake vendor file: %+v", err)
+		}
+		if size != "" {
+			if err = ioutil.WriteFile(path.Join(sysfs, card, lmemTotalFile), []byte(size), 0644); err != nil {
+				t.Fatalf("Failed to create fake memory file: %+v", err)
+			}
+		}
+		if err = os.MkdirAll(path.Join(devfs, card), 0755); err != nil {
+			t.Fatalf("Failed to create fake device directory: %+v", err)
+		}
+	}
+
+	tcases := []struct {
+		name     string
+		options  cliOptions
+		expected map[string]int
+	}{
+		{
+			name:     "disabled",
+			options:  cliOptions{sharedDevNum: 2, resourceNaming: i915Naming, memoryMiB: 2},
+			expected: map[string]int{"i915": 6},
+		},
+		{
+			name:     "local memory only",
+			options:  cliOptions{sharedDevNum: 2, resourceNaming: i915Naming, memoryResource: true, memoryUnitMiB: 1},
+			expected: map[string]int{"i915": 6, "memory.MiB": 4},
+		},
+		{
+			name:     "default memory",
+			options:  cliOptions{sharedDevNum: 1, resourceNaming: i915Naming, memoryResource: true, memoryMiB: 2, memoryUnitMiB: 1},
+			expected: map[string]int{"i915": 3, "memory.MiB": 8},
+		},
+		{
+			name:     "larger units",
+			options:  cliOptions{sharedDevNum: 1, resourceNaming: i915Naming, memoryResource: true, memoryMiB: 3, memoryUnitMiB: 2},
+			expected: map[string]int{"i915": 3, "memory.2MiB": 4},
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			tree, err := newDevicePlugin(sysfs, devfs, tc.options).scan()
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+
+			result := make(map[string]int)
+			for devType, devices := range tree {
+				result[devType] = len(devices)
+			}
+			if !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("Expected %v, but got %v", tc.expected, result)
+			}
+			if tc.options.memoryResource {
+				if _, ok := tree[memoryDeviceType(tc.options.memoryUnitMiB)][memoryDeviceID("card0", 1)]; !ok {
+					t.Errorf("Expected memory unit %s", memoryDeviceID("card0", 1))
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryCardHint(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "gpuplugin-hint")
+	if err != nil {
+		t.Fatalf("Unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	sysfs := path.Join(tmpdir, "sysfs")
+	devfs := path.Join(tmpdir, "devfs")
+	for _, card := range []string{"card0", "card1"} {
+		if err = os.MkdirAll(path.Join(sysfs, card, "device/drm", card), 0755); err != nil {
+			t.Fatalf("Failed to create fake device directory: %+v", err)
+		}
+		if err = ioutil.WriteFile(path.Join(sysfs, card, "device/vendor"), []byte("0x8086"), 0644); err != nil {
+			t.Fatalf("Failed to create fake vendor file: %+v", err)
+		}
+		if err = os.MkdirAll(path.Join(devfs, card), 0755); err != nil {
+			t.Fatalf("Failed to create fake device directory: %+v", err)
+		}
+	}
+
+	testPlugin := newDevicePlugin(sysfs, devfs, cliOptions{
+		sharedDevNum:     1,
+		allocationPolicy: dpapi.PackedPolicy,
+		resourceNaming:   i915Naming,
+		memoryResource:   true,
+		memoryMiB:        2,
+		memoryUnitMiB:    1,
+	})
+	tree, err := testPlugin.scan()
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	memoryRequest := &pluginapi.PreferredAllocationRequest{
+		ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+			{
+				AvailableDeviceIDs: []string{"card0-mem-0", "card0-mem-1", "card1-mem-0", "card1-mem-1"},
+				AllocationSize:     2,
+			},
+		},
+	}
+	preferred := func() []string {
+		resp, err := preferredAllocation(testPlugin, tree, memoryDeviceType(1), memoryRequest)
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		return resp.ContainerResponses[0].DeviceIDs
+	}
+
+	allocate := func(card string, memory bool) error {
+		cresp := &pluginapi.ContainerAllocateResponse{
+			Devices: []*pluginapi.DeviceSpec{{HostPath: path.Join(devfs, card)}},
+		}
+		if memory {
+			cresp.Envs = map[string]string{memoryEnvPrefix + strings.ToUpper(card) + "_MEM_0": card}
+		}
+		err := testPlugin.PostAllocate(&pluginapi.AllocateResponse{
+			ContainerResponses: []*pluginapi.ContainerAllocateResponse{cresp},
+		})
+		for key := range cresp.Envs {
+			if strings.HasPrefix(key, memoryEnvPrefix) {
+				t.Errorf("Memory env %s left in the response", key)
+			}
+		}
+		return err
+	}
+
+	// The GPU share of the container comes from card1.
+	if err = allocate("card1", false); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	if ids := preferred(); !reflect.DeepEqual(ids, []string{"card1-mem-0", "card1-mem-1"}) {
+		t.Errorf("Expected the memory of card1, but got %v", ids)
+	}
+
+	// The memory allocation completes the pair, the next container isn't steered.
+	if err = allocate("card1", true); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	if ids := preferred(); !reflect.DeepEqual(ids, []string{"card0-mem-0", "card0-mem-1"}) {
+		t.Errorf("Expected the memory of card0, but got %v", ids)
+	}
+
+	// The memory of the next container comes first, so the memory isn't steered.
+	if err = allocate("card0", true); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	if ids := preferred(); !reflect.DeepEqual(ids, []string{"card0-mem-0", "card0-mem-1"}) {
+		t.Errorf("Expected the memory of card0, but got %v", ids)
+	}
+
+	// The share from another card is rejected.
+	if err = allocate("card1", false); err == nil {
+		t.Error("Expected an error for the share of another card")
+	}
+
+	// The rejection ends the pair.
+	if err = allocate("card1", false); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	if err = allocate("card1", true); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+}
+
+func TestPairedWith(t *testing.T) {
+	tcases := []struct {
+		name     string
+		cards    map[string]bool
+		hinted   map[string]bool
+		expected bool
+	}{
+		{name: "same card", cards: map[string]bool{"card1": true}, expected: true},
+		{name: "no cards", cards: map[string]bool{}},
+		{name: "other card", cards: map[string]bool{"card0": true}},
+		{name: "several cards", cards: map[string]bool{"card0": true, "card1": true}},
+		{name: "several hinted cards", cards: map[string]bool{"card1": true}, hinted: map[string]bool{"card0": true, "card1": true}},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			hinted := tc.hinted
+			if hinted == nil {
+				hinted = map[string]bool{"card1": true}
+			}
+			if paired := pairedWith(tc.cards, hinted); paired != tc.expected {
+				t.Errorf("Expected %v, but got %v", tc.expected, paired)
+			}
+		})
+	}
+}
+
+func TestNodeSelection(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "gpuplugin-nodes")
+	if err != nil {
+		t.Fatalf("Unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	sysfs := path.Join(tmpdir, "sysfs")
+	devfs := path.Join(tmpdir, "devfs")
+	for _, dir := range []string{"card0/device/drm/card0", "card0/device/drm/renderD128", "renderD128/device/drm/card0"} {
+		if err = os.MkdirAll(path.Join(sysfs, dir), 0755); err != nil {
+			t.Fatalf("Failed to create fake device directory: %+v", err)
+		}
+	}
+	if err = ioutil.WriteFile(path.Join(sysfs, "card0/device/vendor"), []byte("0x8086"), 0644); err != nil {
+		t.Fatalf("Failed to create fake vendor file: %+v", err)
+	}
+	for _, node := range []string{"card0", "renderD128"} {
+		if err = os.MkdirAll(path.Join(devfs, node), 0755); err != nil {
+			t.Fatalf("Failed to create fake device directory: %+v", err)
+		}
+	}
+
+	node := func(name string) pluginapi.DeviceSpec {
+		return pluginapi.DeviceSpec{
+			HostPath:      path.Join(devfs, name),
+			ContainerPath: path.Join(devfs, name),
+			Permissions:   "rw",
+		}
+	}
+	device := func(nodes ...string) dpapi.DeviceInfo {
+		specs := []pluginapi.DeviceSpec{}
+		for _, name := range nodes {
+			specs = append(specs, node(name))
+		}
+		return dpapi.NewDeviceInfo(pluginapi.Healthy, specs, nil, nil)
+	}
+
+	tcases := []struct {
+		selection   string
+		expected    dpapi.DeviceTree
+		allocated   []string
+		expectedEnv map[string]string
+	}{
+		{
+			selection: bothNodes,
+			expected: dpapi.DeviceTree{
+				"i915": {"card0-0": device("card0", "renderD128")},
+			},
+			allocated: []string{"card0", "renderD128"},
+			expectedEnv: map[string]string{
+				renderNodeEnv:  path.Join(devfs, "renderD128"),
+				primaryNodeEnv: path.Join(devfs, "card0"),
+				cardsEnv:       "0",
+			},
+		},
+		{
+			selection: renderNodes,
+			expected: dpapi.DeviceTree{
+				"i915": {"card0-0": device("renderD128")},
+			},
+			allocated:   []string{"renderD128"},
+			expectedEnv: map[string]string{renderNodeEnv: path.Join(devfs, "renderD128"), cardsEnv: "0"},
+		},
+		{
+			selection: primaryNodes,
+			expected: dpapi.DeviceTree{
+				"i915": {"card0-0": device("card0")},
+			},
+			allocated:   []string{"card0"},
+			expectedEnv: map[string]string{primaryNodeEnv: path.Join(devfs, "card0"), cardsEnv: "0"},
+		},
+		{
+			selection: splitNodes,
+			expected: dpapi.DeviceTree{
+				"i915-render":  {"card0-render-0": device("renderD128")},
+				"i915-primary": {"card0-primary-0": device("card0")},
+			},
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.selection, func(t *testing.T) {
+			testPlugin := newDevicePlugin(sysfs, devfs, cliOptions{
+				sharedDevNum:   1,
+				resourceNaming: i915Naming,
+				nodeSelection:  tc.selection,
+			})
+			tree, err := testPlugin.scan()
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			if !reflect.DeepEqual(tree, tc.expected) {
+				t.Errorf("Expected %+v, but got %+v", tc.expected, tree)
+			}
+
+			if tc.allocated == nil {
+				return
+			}
+			specs := []*pluginapi.DeviceSpec{}
+			for _, name := range tc.allocated {
+				spec := node(name)
+				specs = append(specs, &spec)
+			}
+			response := &pluginapi.AllocateResponse{
+				ContainerResponses: []*pluginapi.ContainerAllocateResponse{{Devices: specs}},
+			}
+			if err = testPlugin.PostAllocate(response); err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			if envs := response.ContainerResponses[0].Envs; !reflect.DeepEqual(envs, tc.expectedEnv) {
+				t.Errorf("Expected envs %v, but got %v", tc.expectedEnv, envs)
+			}
+		})
+	}
+
+	testPlugin := newDevicePlugin(sysfs, devfs, cliOptions{})
+	if card := testPlugin.cardOfNode(path.Join(devfs, "renderD128")); card != "card0" {
+		t.Errorf("Expected renderD128 to belong to card0, but got %q", card)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	tcases := []struct {
+		name           string
+		noDriver       bool
+		noDeviceNode   bool
+		errorState     string
+		wedged         string
+		expectedHealth string
+	}{
+		{
+			name:           "healthy",
+			errorState:     "No error state collected\n",
+			wedged:         "0\n",
+			expectedHealth: pluginapi.Healthy,
+		},
+		{
+			name:           "driver unbound",
+			noDriver:       true,
+			expectedHealth: pluginapi.Unhealthy,
+		},
+		{
+			name:           "device node missing",
+			noDeviceNode:   true,
+			expectedHealth: pluginapi.Unhealthy,
+		},
+		{
+			name:           "GPU hang",
+			errorState:     "GPU HANG: ecode 9:1:0x00000000, in gem_exec [1234]\n",
+			expectedHealth: pluginapi.Unhealthy,
+		},
+		{
+			name:           "wedged",
+			wedged:         "1\n",
+			expectedHealth: pluginapi.Unhealthy,
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "gpuplugin-health")
+			if err != nil {
+				t.Fatalf("Unable to create test directory: %+v", err)
+			}
+			defer os.RemoveAll(tmpdir)
+
+			sysfs := path.Join(tmpdir, "sysfs")
+			devfs := path.Join(tmpdir, "devfs")
+			debugfs := path.Join(tmpdir, "debugfs")
+			for _, dir := range []string{"card0/device/drm/card0", "card0/device/drm/renderD128"} {
+				if err = os.MkdirAll(path.Join(sysfs, dir), 0755); err != nil {
+					t.Fatalf("Failed to create fake device directory: %+v", err)
+				}
+			}
+			if !tc.noDriver {
+				if err = os.Symlink("../../../bus/pci/drivers/i915", path.Join(sysfs, "card0/device/driver")); err != nil {
+					t.Fatalf("Failed to create fake driver link: %+v", err)
+				}
+			}
+			nodes := []string{"card0", "renderD128"}
+			if tc.noDeviceNode {
+				nodes = nodes[:1]
+			}
+			for _, node := range nodes {
+				if err = os.MkdirAll(path.Join(devfs, node), 0755); err != nil {
+					t.Fatalf("Failed to create fake device directory: %+v", err)
+				}
+			}
+			if tc.errorState != "" {
+				if err = ioutil.WriteFile(path.Join(sysfs, "card0", errorStateFile), []byte(tc.errorState), 0600); err != nil {
+					t.Fatalf("Failed to create fake error state: %+v", err)
+				}
+			}
+			if tc.wedged != "" {
+				if err = os.MkdirAll(path.Join(debugfs, "0"), 0755); err != nil {
+					t.Fatalf("Failed to create fake debugfs directory: %+v", err)
+				}
+				if err = ioutil.WriteFile(path.Join(debugfs, "0", wedgedFile), []byte(tc.wedged), 0600); err != nil {
+					t.Fatalf("Failed to create fake wedged file: %+v", err)
+				}
+			}
+
+			testPlugin := newDevicePlugin(sysfs, devfs, cliOptions{sharedDevNum: 1})
+			testPlugin.debugfsDir = debugfs
+			for _, id := range []string{"card0-0", "card0-mem-1"} {
+				health, reason := testPlugin.CheckHealth("i915", id, dpapi.DeviceInfo{})
+				if health != tc.expectedHealth {
+					t.Errorf("%s: expected %s, but got %s (%s)", id, tc.expectedHealth, health, reason)
+				}
+			}
+
+			// The card recovers at the next check, which clears the error state.
+			if tc.errorState != "" && tc.expectedHealth == pluginapi.Unhealthy {
+				errorPath := path.Join(sysfs, "card0", errorStateFile)
+				recheck := func() (string, string) {
+					cached := testPlugin.cardHealth["card0"]
+					cached.time = time.Time{}
+					testPlugin.cardHealth["card0"] = cached
+					return testPlugin.CheckHealth("i915", "card0-0", dpapi.DeviceInfo{})
+				}
+				if health, reason := recheck(); health != pluginapi.Healthy {
+					t.Errorf("expected recovery, but got %s (%s)", health, reason)
+				}
+				if dat, err := ioutil.ReadFile(errorPath); err != nil || string(dat) == tc.errorState {
+					t.Errorf("expected the error state cleared, but got %q (%v)", dat, err)
+				}
+
+				// Cleared by the kernel, the next hang is detected again.
+				if err = ioutil.WriteFile(errorPath, []byte(noErrorState+"\n"), 0600); err != nil {
+					t.Fatalf("Failed to clear fake error state: %+v", err)
+				}
+				if health, reason := recheck(); health != pluginapi.Healthy {
+					t.Errorf("expected healthy, but got %s (%s)", health, reason)
+				}
+				if err = ioutil.WriteFile(errorPath, []byte(tc.errorState), 0600); err != nil {
+					t.Fatalf("Failed to create fake error state: %+v", err)
+				}
+				if health, reason := recheck(); health != pluginapi.Unhealthy {
+					t.Errorf("expected the next hang unhealthy, but got %s (%s)", health, reason)
+				}
+			}
+		})
+	}
+}
+
+func TestSriov(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "gpuplugin-sriov")
+	if err != nil {
+		t.Fatalf("Unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// 0000:00:02.0 is a PF with VF 0000:00:02.1 bound to i915 and
+	// VF 0000:00:02.2 bound to vfio-pci.
+	pciDevices := path.Join(tmpdir, "sys/devices/pci0000:00")
+	sysfs := path.Join(tmpdir, "sys/class/drm")
+	devfs := path.Join(tmpdir, "devfs")
+	vfio := path.Join(tmpdir, "vfio")
+	files := map[string]string{
+		"0000:00:02.0/vendor":         "0x8086",
+		"0000:00:02.0/device":         "0x4905",
+		"0000:00:02.0/sriov_totalvfs": "7",
+		"0000:00:02.0/sriov_numvfs":   "2",
+		"0000:00:02.1/vendor":         "0x8086",
+		"0000:00:02.1/device":         "0x4905",
+		"0000:00:02.2/vendor":         "0x8086",
+		"0000:00:02.2/device":         "0x4905",
+	}
+	for file, content := range files {
+		if err = os.MkdirAll(path.Dir(path.Join(pciDevices, file)), 0755); err != nil {
+			t.Fatalf("Failed to create fake device directory: %+v", err)
+		}
+		if err = ioutil.WriteFile(path.Join(pciDevices, file), []byte(content+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create fake device file: %+v", err)
+		}
+	}
+	links := map[string]string{
+		"0000:00:02.0/virtfn0":     "../0000:00:02.1",
+		"0000:00:02.0/virtfn1":     "../0000:00:02.2",
+		"0000:00:02.1/physfn":      "../0000:00:02.0",
+		"0000:00:02.2/physfn":      "../0000:00:02.0",
+		"0000:00:02.2/driver":      "../../../bus/pci/drivers/vfio-pci",
+		"0000:00:02.2/iommu_group": "../../../kernel/iommu_groups/5",
+	}
+	for link, target := range links {
+		if err = os.Symlink(target, path.Join(pciDevices, link)); err != nil {
+			t.Fatalf("Failed to create fake link: %+v", err)
+		}
+	}
+	for card, function := range map[string]string{"card0": "0000:00:02.0", "card1": "0000:00:02.1"} {
+		for _, dir := range []string{path.Join(pciDevices, function, "drm", card), path.Join(sysfs, card), path.Join(devfs, card)} {
+			if err = os.MkdirAll(dir, 0755); err != nil {
+				t.Fatalf("Failed to create fake device directory: %+v", err)
+			}
+		}
+		if err = os.Symlink(path.Join(pciDevices, function), path.Join(sysfs, card, "device")); err != nil {
+			t.Fatalf("Failed to create fake device link: %+v", err)
+		}
+	}
+	for _, node := range []string{"5", "vfio"} {
+		if err = os.MkdirAll(path.Join(vfio, node), 0755); err != nil {
+			t.Fatalf("Failed to create fake device directory: %+v", err)
+		}
+	}
+
+	tcases := []struct {
+		name           string
+		sriovResources bool
+		expected       map[string][]string
+	}{
+		{
+			name: "disabled",
+			expected: map[string][]string{
+				"dg1": {"card0-0", "card1-0"},
+			},
+		},
+		{
+			name:           "enabled",
+			sriovResources: true,
+			expected: map[string][]string{
+				"dg1-pf":      {"card0-0"},
+				"dg1-vf":      {"card1-0"},
+				"dg1-vf-vfio": {"0000:00:02.2"},
+			},
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			testPlugin := newDevicePlugin(sysfs, devfs, cliOptions{
+				sharedDevNum:   1,
+				resourceNaming: familyNaming,
+				sriovResources: tc.sriovResources,
+			})
+			testPlugin.vfioDir = vfio
+			tree, err := testPlugin.scan()
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+
+			result := make(map[string][]string)
+			for devType, devices := range tree {
+				for id := range devices {
+					result[devType] = append(result[devType], id)
+				}
+				sort.Strings(result[devType])
+			}
+			if !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("Expected %v, but got %v", tc.expected, result)
+			}
+		})
+	}
+
+	testPlugin := newDevicePlugin(sysfs, devfs, cliOptions{sharedDevNum: 1})
+	if health, reason := testPlugin.CheckHealth("dg1-vf-vfio", "0000:00:02.2", dpapi.DeviceInfo{}); health != pluginapi.Healthy {
+		t.Errorf("Expected healthy VF, but got %s (%s)", health, reason)
+	}
+
+	if err = testPlugin.provisionVFs(8); err == nil {
+		t.Error("Expected error for too many VFs, but got success")
+	}
+	if err = testPlugin.provisionVFs(4); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if dat, err := ioutil.ReadFile(path.Join(pciDevices, "0000:00:02.0/sriov_numvfs")); err != nil || string(dat) != "4" {
+		t.Errorf("Expected 4 VFs, but got %q", dat)
+	}
+}
+
+func TestCardEnvs(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "gpuplugin-envs")
+	if err != nil {
+		t.Fatalf("Unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	pciDevices := path.Join(tmpdir, "sys/devices/pci0000:00")
+	sysfs := path.Join(tmpdir, "sys/class/drm")
+	devfs := path.Join(tmpdir, "devfs")
+	for card, function := range map[string]string{"card0": "0000:00:02.0", "card10": "0000:03:00.0"} {
+		for _, dir := range []string{path.Join(pciDevices, function, "drm", card), path.Join(sysfs, card), path.Join(devfs, card)} {
+			if err = os.MkdirAll(dir, 0755); err != nil {
+				t.Fatalf("Failed to create fake device directory: %+v", err)
+			}
+		}
+		for file, content := range map[string]string{"vendor": "0x8086", "device": "0x4905"} {
+			if err = ioutil.WriteFile(path.Join(pciDevices, function, file), []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to create fake device file: %+v", err)
+			}
+		}
+		if err = os.Symlink(path.Join(pciDevices, function), path.Join(sysfs, card, "device")); err != nil {
+			t.Fatalf("Failed to create fake device link: %+v", err)
+		}
+	}
+
+	testPlugin := newDevicePlugin(sysfs, devfs, cliOptions{sharedDevNum: 2, resourceNaming: i915Naming, nodeSelection: bothNodes})
+	tree, err := testPlugin.scan()
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	nodes := []pluginapi.DeviceSpec{{HostPath: path.Join(devfs, "card10"), ContainerPath: path.Join(devfs, "card10"), Permissions: "rw"}}
+	expected := dpapi.NewDeviceInfo(pluginapi.Healthy, nodes, nil, nil).WithAllocateEnvs(map[string]string{"GPU_SHARE_INDEX_CARD10_1": "10:1"})
+	if info := tree[deviceType]["card10-1"]; !reflect.DeepEqual(info, expected) {
+		t.Errorf("Expected %+v, but got %+v", expected, info)
+	}
+
+	// The container is given card10-1, card0-0 and card0-1.
+	card0 := pluginapi.DeviceSpec{HostPath: path.Join(devfs, "card0"), ContainerPath: path.Join(devfs, "card0"), Permissions: "rw"}
+	response := &pluginapi.AllocateResponse{
+		ContainerResponses: []*pluginapi.ContainerAllocateResponse{
+			{
+				Devices: []*pluginapi.DeviceSpec{&nodes[0], &card0, &card0},
+				Envs: map[string]string{
+					"GPU_SHARE_INDEX_CARD10_1": "10:1",
+					"GPU_SHARE_INDEX_CARD0_0":  "0:0",
+					"GPU_SHARE_INDEX_CARD0_1":  "0:1",
+				},
+			},
+			{},
+		},
+	}
+	if err = testPlugin.PostAllocate(response); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	expectedEnvs := map[string]string{
+		primaryNodeEnv:  path.Join(devfs, "card0") + "," + path.Join(devfs, "card10"),
+		cardsEnv:        "0,10",
+		pciAddressesEnv: "0000:00:02.0,0000:03:00.0",
+		shareIndexEnv:   "0:0,0:1,10:1",
+	}
+	if envs := response.ContainerResponses[0].Envs; !reflect.DeepEqual(envs, expectedEnvs) {
+		t.Errorf("Expected envs %v, but got %v", expectedEnvs, envs)
+	}
+	if envs := response.ContainerResponses[1].Envs; envs != nil {
+		t.Errorf("Expected no envs for container without GPUs, but got %v", envs)
+	}
+}
+
+// allocationListerStub lists the given allocations.
+type allocationListerStub map[string]map[string][]dpapi.Allocation
+
+func (s allocationListerStub) Allocations(namespace string) map[string]map[string][]dpapi.Allocation {
+	return s
+}
+
+func TestExporter(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "gpuplugin-exporter")
+	if err != nil {
+		t.Fatalf("Unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// card0 has the legacy attributes and hwmon, card1 only per GT
+	// attributes and card2 is not an Intel GPU.
+	files := map[string]string{
+		"card0/device/vendor":                     "0x8086",
+		"card0/gt_cur_freq_mhz":                   "300",
+		"card0/gt_act_freq_mhz":                   "350",
+		"card0/gt_max_freq_mhz":                   "1100",
+		"card0/power/rc6_residency_ms":            "2500",
+		"card0/device/hwmon/hwmon2/energy1_input": "5000000",
+		"card0/device/hwmon/hwmon2/power1_input":  "12500000",
+		"card1/device/vendor":                     "0x8086",
+		"card1/gt/gt0/rps_cur_freq_mhz":           "100",
+		"card1/gt_max_freq_mhz":                   "invalid",
+		"card2/device/vendor":                     "0xbeef",
+		"card2/gt_cur_freq_mhz":                   "200",
+	}
+	for file, content := range files {
+		if err = os.MkdirAll(path.Dir(path.Join(tmpdir, file)), 0755); err != nil {
+			t.Fatalf("Failed to create fake device directory: %+v", err)
+		}
+		if err = ioutil.WriteFile(path.Join(tmpdir, file), []byte(content+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to create fake device file: %+v", err)
+		}
+	}
+
+	allocations := allocationListerStub{
+		"gpu.intel.com/i915": {
+			"card0-0": {{Namespace: "default", Pod: "pod1", Container: "init"}, {Namespace: "default", Pod: "pod1", Container: "app"}},
+			"card0-1": {{Namespace: "batch", Pod: "pod2", Container: "app"}},
+		},
+		"gpu.intel.com/memory.MiB": {
+			"card0-mem-5": {{Namespace: "default", Pod: "pod1", Container: "app"}},
+		},
+		"gpu.intel.com/i915-vf-vfio": {
+			"0000:00:02.1": {{Namespace: "vms", Pod: "vm1", Container: "compute"}},
+		},
+	}
+
+	expected := `
+# HELP gpu_actual_frequency_mhz Actual frequency of the GPU in MHz.
+# TYPE gpu_actual_frequency_mhz gauge
+gpu_actual_frequency_mhz{card="card0"} 350
+# HELP gpu_allocation_info Pods the GPU is allocated to, one series per pod with the value 1.
+# TYPE gpu_allocation_info gauge
+gpu_allocation_info{card="card0",namespace="batch",pod="pod2"} 1
+gpu_allocation_info{card="card0",namespace="default",pod="pod1"} 1
+# HELP gpu_current_frequency_mhz Frequency requested by the GPU in MHz.
+# TYPE gpu_current_frequency_mhz gauge
+gpu_current_frequency_mhz{card="card0"} 300
+gpu_current_frequency_mhz{card="card1"} 100
+# HELP gpu_energy_joules_total Energy consumed by the GPU.
+# TYPE gpu_energy_joules_total counter
+gpu_energy_joules_total{card="card0"} 5
+# HELP gpu_max_frequency_mhz Maximum frequency of the GPU in MHz.
+# TYPE gpu_max_frequency_mhz gauge
+gpu_max_frequency_mhz{card="card0"} 1100
+# HELP gpu_power_watts Power drawn by the GPU.
+# TYPE gpu_power_watts gauge
+gpu_power_watts{card="card0"} 12.5
+# HELP gpu_rc6_residency_seconds_total Time the GPU has spent in the RC6 power saving state.
+# TYPE gpu_rc6_residency_seconds_total counter
+gpu_rc6_residency_seconds_total{card="card0"} 2.5
+`
+	if err = testutil.CollectAndCompare(newExporter(tmpdir, allocations), strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
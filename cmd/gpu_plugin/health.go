@@ -0,0 +1,143 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+)
+
+const (
+	debugfsDriDirectory = "/sys/kernel/debug/dri"
+
+	// errorStateFile holds the error state captured on the last GPU hang.
+	// Writing to it clears the state, so that the next hang is captured.
+	errorStateFile = "error"
+	noErrorState   = "No error state collected"
+	// wedgedFile tells if the GPU is wedged after a failed reset.
+	wedgedFile = "i915_wedged"
+
+	// cardHealthTimeout is the time the health of a card is cached for.
+	// All the devices of a card are checked at once.
+	cardHealthTimeout = time.Second
+)
+
+// cardHealth is the cached health of a card.
+type cardHealth struct {
+	health string
+	reason string
+	time   time.Time
+	// errorState is the hash of the error state already reported, zero
+	// if none.
+	errorState uint64
+}
+
+// CheckHealth implements HealthChecker interface. All the devices of a card
+// share its health. VFs bound to vfio-pci are not checked.
+func (dp *devicePlugin) CheckHealth(devType, id string, info dpapi.DeviceInfo) (string, string) {
+	card := cardOf(id)
+	if !dp.gpuDeviceReg.MatchString(card) {
+		return pluginapi.Healthy, "not a GPU"
+	}
+
+	dp.healthLock.Lock()
+	defer dp.healthLock.Unlock()
+
+	cached, ok := dp.cardHealth[card]
+	if !ok || time.Since(cached.time) > cardHealthTimeout {
+		cached = dp.checkCard(card, cached)
+		cached.time = time.Now()
+		dp.cardHealth[card] = cached
+	}
+
+	return cached.health, cached.reason
+}
+
+// checkCard checks the signals of a GPU hang or failure of the given card.
+// An error state makes the card unhealthy for one check: the next check
+// finding no other failures clears it.
+func (dp *devicePlugin) checkCard(card string, last cardHealth) cardHealth {
+	if reason := dp.cardFailure(card); reason != "" {
+		return cardHealth{health: pluginapi.Unhealthy, reason: reason, errorState: last.errorState}
+	}
+
+	errorPath := path.Join(dp.sysfsDir, card, errorStateFile)
+	dat, err := ioutil.ReadFile(errorPath)
+	if err != nil {
+		return cardHealth{health: pluginapi.Healthy, reason: "no GPU failures detected"}
+	}
+	state := strings.TrimSpace(string(dat))
+	if state == "" || strings.HasPrefix(state, noErrorState) {
+		return cardHealth{health: pluginapi.Healthy, reason: "no GPU failures detected"}
+	}
+
+	h := fnv.New64a()
+	h.Write(dat)
+	if sum := h.Sum64(); sum != last.errorState {
+		return cardHealth{health: pluginapi.Unhealthy, reason: "GPU hang error state captured", errorState: sum}
+	}
+
+	// The hang has been reported and the card works, clear the error
+	// state. A state that can't be cleared isn't reported again.
+	if err = ioutil.WriteFile(errorPath, []byte("1"), 0600); err != nil {
+		klog.Warningf("Failed to clear the error state of %s, the next GPU hang isn't detected: %+v", card, err)
+	}
+
+	return cardHealth{health: pluginapi.Healthy, reason: "GPU hang error state cleared", errorState: last.errorState}
+}
+
+// cardFailure returns the failure of the given card other than a GPU hang,
+// an empty string if none is detected.
+func (dp *devicePlugin) cardFailure(card string) string {
+	cardDir := path.Join(dp.sysfsDir, card)
+
+	if _, err := os.Lstat(path.Join(cardDir, "device/driver")); err != nil {
+		return "driver unbound"
+	}
+
+	drmFiles, err := ioutil.ReadDir(path.Join(cardDir, "device/drm"))
+	if err != nil {
+		return "device removed"
+	}
+	for _, drmFile := range drmFiles {
+		if dp.controlDeviceReg.MatchString(drmFile.Name()) {
+			continue
+		}
+		if _, err = os.Stat(path.Join(dp.devfsDir, drmFile.Name())); err != nil {
+			return "device node " + drmFile.Name() + " missing"
+		}
+	}
+
+	if dp.debugfsDir != "" {
+		minor := strings.TrimPrefix(card, "card")
+		if dat, err := ioutil.ReadFile(path.Join(dp.debugfsDir, minor, wedgedFile)); err == nil {
+			if wedged, err := strconv.ParseInt(strings.TrimSpace(string(dat)), 0, 64); err == nil && wedged != 0 {
+				return "GPU wedged"
+			}
+		}
+	}
+
+	return ""
+}
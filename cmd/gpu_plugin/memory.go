@@ -0,0 +1,244 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+)
+
+const (
+	// defaultMemoryUnitMiB is the default size of the GPU memory units.
+	// A device per MiB would make the device lists of GPUs with gigabytes
+	// of memory needlessly long.
+	defaultMemoryUnitMiB = 256
+	// lmemTotalFile reports the local memory of discrete GPUs in bytes.
+	lmemTotalFile = "lmem_total_bytes"
+
+	// memoryEnvPrefix prefixes the per unit variables telling PostAllocate
+	// that the allocation is of GPU memory. They're allocate envs, so they
+	// don't leak to containers via CDI specs.
+	memoryEnvPrefix = "GPU_MEMORY_UNIT_"
+)
+
+// cardHint has the cards of the first allocation of a pair of GPU memory
+// and a GPU share. kubelet allocates the resources of a container back to
+// back, one at a time and without telling which container they belong to,
+// so the allocations are paired in turns: an allocation of the other
+// resource than the hinted one completes the pair and must come from the
+// same single card.
+type cardHint struct {
+	cards map[string]bool
+	// memory is set if the first allocation was of GPU memory.
+	memory bool
+}
+
+// memoryDeviceType returns the resource of GPU memory in units of the given
+// size, e.g. memory.256MiB, or memory.MiB for 1 MiB units.
+func memoryDeviceType(unitMiB int) string {
+	if unitMiB == 1 {
+		return "memory.MiB"
+	}
+	return fmt.Sprintf("memory.%dMiB", unitMiB)
+}
+
+// memoryMiB returns the memory of the given card in MiB. Cards not reporting
+// their local memory have the memory given in the options. It's called by
+// Scan() only.
+func (dp *devicePlugin) memoryMiB(card string) int {
+	dat, err := ioutil.ReadFile(path.Join(dp.sysfsDir, card, lmemTotalFile))
+	if err != nil {
+		klog.V(4).Infof("No local memory info for %s, using %d MiB: %+v", card, dp.options.memoryMiB, err)
+		return dp.options.memoryMiB
+	}
+
+	bytes, err := strconv.ParseUint(strings.TrimSpace(string(dat)), 0, 64)
+	if err != nil {
+		klog.Warningf("Invalid local memory size of %s, using %d MiB: %+v", card, dp.options.memoryMiB, err)
+		return dp.options.memoryMiB
+	}
+
+	return int(bytes >> 20)
+}
+
+// addMemory adds the memory of the given card to the device tree as
+// units giving access to the card. The memory left over from the last
+// whole unit isn't exposed.
+func (dp *devicePlugin) addMemory(devTree dpapi.DeviceTree, card string, nodes []pluginapi.DeviceSpec) {
+	if !dp.options.memoryResource {
+		return
+	}
+
+	devType := memoryDeviceType(dp.options.memoryUnitMiB)
+	for i := 0; i < dp.memoryMiB(card)/dp.options.memoryUnitMiB; i++ {
+		id := memoryDeviceID(card, i)
+		devTree.AddDevice(devType, id, dpapi.NewDeviceInfo(pluginapi.Healthy, nodes, nil, nil).WithAllocateEnvs(map[string]string{
+			memoryEnvPrefix + strings.ToUpper(envNameReplacer.Replace(id)): card,
+		}))
+	}
+}
+
+// isMemoryType checks if the given device type is GPU memory.
+func isMemoryType(devType string) bool {
+	return strings.HasPrefix(devType, "memory.")
+}
+
+// takeMemory removes the per unit memory envs of the given container and
+// reports if there were any.
+func takeMemory(cresp *pluginapi.ContainerAllocateResponse) bool {
+	memory := false
+	for key := range cresp.Envs {
+		if strings.HasPrefix(key, memoryEnvPrefix) {
+			delete(cresp.Envs, key)
+			memory = true
+		}
+	}
+
+	return memory
+}
+
+func memoryDeviceID(card string, unit int) string {
+	return card + "-mem-" + strconv.Itoa(unit)
+}
+
+// cardOf returns the card of the given device ID of any resource.
+func cardOf(id string) string {
+	return strings.SplitN(id, "-", 2)[0]
+}
+
+// PostAllocate implements PostAllocator interface. It sets the node and
+// card environment variables. If the memory resource is enabled, it rejects
+// the second allocation of a pair of GPU memory and a GPU share if it
+// doesn't come from the card of the first one.
+func (dp *devicePlugin) PostAllocate(response *pluginapi.AllocateResponse) error {
+	options := dp.currentOptions()
+
+	memory := false
+	for _, cresp := range response.ContainerResponses {
+		if takeMemory(cresp) {
+			memory = true
+		}
+	}
+
+	dp.setNodeEnvs(response)
+	dp.setCardEnvs(response, options)
+
+	if !options.memoryResource || len(response.ContainerResponses) != 1 {
+		return nil
+	}
+
+	cards := map[string]bool{}
+	for _, dev := range response.ContainerResponses[0].Devices {
+		if card := dp.cardOfNode(dev.HostPath); card != "" {
+			cards[card] = true
+		}
+	}
+	if len(cards) == 0 {
+		// Not a GPU memory or share allocation, e.g. of VFIO functions.
+		return nil
+	}
+
+	dp.devicesLock.Lock()
+	defer dp.devicesLock.Unlock()
+
+	hint := dp.hint
+	dp.hint = cardHint{}
+	if hint.cards != nil && hint.memory != memory {
+		if !pairedWith(cards, hint.cards) {
+			return errors.Errorf("GPU memory and shares of a container must come from the same card: %v expected, but %v allocated", sortedCards(hint.cards), sortedCards(cards))
+		}
+		return nil
+	}
+	dp.hint = cardHint{cards: cards, memory: memory}
+
+	return nil
+}
+
+// pairedWith checks if the given cards of the second allocation of a pair
+// are the same single card as the hinted cards of the first one.
+func pairedWith(cards, hinted map[string]bool) bool {
+	if len(cards) != 1 || len(hinted) != 1 {
+		return false
+	}
+	for card := range cards {
+		return hinted[card]
+	}
+
+	return false
+}
+
+func sortedCards(cards map[string]bool) []string {
+	sorted := make([]string, 0, len(cards))
+	for card := range cards {
+		sorted = append(sorted, card)
+	}
+	sort.Strings(sorted)
+
+	return sorted
+}
+
+// hintedCard returns the card the preferred allocation of the given device
+// type should prefer, if any. It's called with devicesLock held.
+func (dp *devicePlugin) hintedCard(devType string, rqt *pluginapi.PreferredAllocationRequest) string {
+	if len(dp.hint.cards) != 1 || dp.hint.memory == isMemoryType(devType) || len(rqt.ContainerRequests) != 1 {
+		return ""
+	}
+
+	return sortedCards(dp.hint.cards)[0]
+}
+
+// preferCard returns a policy preferring the devices of the given card over
+// the ones the given policy prefers.
+func preferCard(policy dpapi.AllocationPolicy, card string) dpapi.AllocationPolicy {
+	return func(devices map[string]dpapi.DeviceInfo, candidates, mustInclude []string) []string {
+		if policy != nil {
+			candidates = policy(devices, candidates, mustInclude)
+		}
+
+		ordered := make([]string, len(candidates))
+		copy(ordered, candidates)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return cardOf(ordered[i]) == card && cardOf(ordered[j]) != card
+		})
+
+		return ordered
+	}
+}
+
+func validateMemoryMiB(memoryMiB int) error {
+	if memoryMiB < 0 {
+		return errors.New("The GPU memory size can't be negative")
+	}
+
+	return nil
+}
+
+func validateMemoryUnitMiB(unitMiB int) error {
+	if unitMiB < 1 {
+		return errors.New("The GPU memory unit size must be greater than zero")
+	}
+
+	return nil
+}
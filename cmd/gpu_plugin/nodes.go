@@ -0,0 +1,174 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+)
+
+// Node selection policies.
+const (
+	// Containers get both the primary and the render nodes of GPUs.
+	bothNodes = "both"
+	// Containers get only the render nodes for compute workloads.
+	renderNodes = "render"
+	// Containers get only the primary nodes for display workloads.
+	primaryNodes = "primary"
+	// The render and the primary nodes are separate resources.
+	splitNodes = "split"
+
+	renderSuffix  = "-render"
+	primarySuffix = "-primary"
+
+	renderDeviceRE = `^renderD[0-9]+$`
+
+	// Environment variables listing the allocated nodes in containers.
+	renderNodeEnv  = "GPU_RENDER_NODE"
+	primaryNodeEnv = "GPU_PRIMARY_NODE"
+)
+
+func validateNodeSelection(selection string) error {
+	switch selection {
+	case bothNodes, renderNodes, primaryNodes, splitNodes:
+		return nil
+	}
+
+	return errors.Errorf("Unknown node selection policy %q", selection)
+}
+
+// partitionNodes divides the nodes of a GPU into render and primary nodes.
+func (dp *devicePlugin) partitionNodes(nodes []pluginapi.DeviceSpec) (render, primary []pluginapi.DeviceSpec) {
+	for _, node := range nodes {
+		name := path.Base(node.HostPath)
+		switch {
+		case dp.renderDeviceReg.MatchString(name):
+			render = append(render, node)
+		case dp.gpuDeviceReg.MatchString(name):
+			primary = append(primary, node)
+		}
+	}
+
+	return render, primary
+}
+
+// addDevices adds the devices of the given card with the given nodes
+// according to the node selection policy.
+func (dp *devicePlugin) addDevices(devTree dpapi.DeviceTree, card string, nodes []pluginapi.DeviceSpec) {
+	devType := dp.deviceType(card)
+	render, primary := dp.partitionNodes(nodes)
+
+	memoryNodes := nodes
+	switch dp.options.nodeSelection {
+	case renderNodes:
+		dp.addShares(devTree, devType, card, render)
+		memoryNodes = render
+	case primaryNodes:
+		dp.addShares(devTree, devType, card, primary)
+		memoryNodes = primary
+	case splitNodes:
+		dp.addShares(devTree, devType+renderSuffix, card+renderSuffix, render)
+		dp.addShares(devTree, devType+primarySuffix, card+primarySuffix, primary)
+		memoryNodes = render
+	default:
+		dp.addShares(devTree, devType, card, nodes)
+	}
+
+	if len(memoryNodes) > 0 {
+		dp.addMemory(devTree, card, memoryNodes)
+	}
+}
+
+// addShares adds the shares of a GPU with the given nodes, if any.
+func (dp *devicePlugin) addShares(devTree dpapi.DeviceTree, devType, idPrefix string, nodes []pluginapi.DeviceSpec) {
+	if len(nodes) == 0 {
+		return
+	}
+
+	for i := 0; i < dp.options.sharedDevNum; i++ {
+		devID := fmt.Sprintf("%s-%d", idPrefix, i)
+		devTree.AddDevice(devType, devID, dpapi.NewDeviceInfo(pluginapi.Healthy, nodes, nil, nil).WithAllocateEnvs(dp.shareEnvs(devID, cardOf(idPrefix), i)))
+	}
+}
+
+// cardOfNode returns the card the given device node belongs to.
+func (dp *devicePlugin) cardOfNode(hostPath string) string {
+	name := path.Base(hostPath)
+	if dp.gpuDeviceReg.MatchString(name) {
+		return name
+	}
+	if !dp.renderDeviceReg.MatchString(name) {
+		return ""
+	}
+
+	// The render node shares the device/drm directory with its card.
+	drmFiles, err := ioutil.ReadDir(path.Join(dp.sysfsDir, name, "device/drm"))
+	if err != nil {
+		return ""
+	}
+	for _, drmFile := range drmFiles {
+		if dp.gpuDeviceReg.MatchString(drmFile.Name()) {
+			return drmFile.Name()
+		}
+	}
+
+	return ""
+}
+
+// setNodeEnvs tells the containers the render and primary nodes they
+// are given.
+func (dp *devicePlugin) setNodeEnvs(response *pluginapi.AllocateResponse) {
+	for _, cresp := range response.ContainerResponses {
+		render := map[string]bool{}
+		primary := map[string]bool{}
+		for _, dev := range cresp.Devices {
+			name := path.Base(dev.HostPath)
+			switch {
+			case dp.renderDeviceReg.MatchString(name):
+				render[dev.ContainerPath] = true
+			case dp.gpuDeviceReg.MatchString(name):
+				primary[dev.ContainerPath] = true
+			}
+		}
+
+		for env, paths := range map[string]map[string]bool{renderNodeEnv: render, primaryNodeEnv: primary} {
+			if len(paths) == 0 {
+				continue
+			}
+			if cresp.Envs == nil {
+				cresp.Envs = make(map[string]string)
+			}
+			cresp.Envs[env] = joinPaths(paths)
+		}
+	}
+}
+
+func joinPaths(paths map[string]bool) string {
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	return strings.Join(sorted, ",")
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+	"github.com/intel/intel-device-plugins-for-kubernetes/pkg/pci"
+)
+
+const (
+	devfsVfioDirectory = "/dev/vfio"
+	vfioSubsystem      = "vfio"
+	vfioDriver         = "vfio-pci"
+
+	// Suffixes of the resources of SR-IOV physical and virtual functions.
+	pfSuffix   = "-pf"
+	vfSuffix   = "-vf"
+	vfioSuffix = "-vfio"
+)
+
+// pciDevice returns the PCI device of the given card, nil if it's not found.
+func (dp *devicePlugin) pciDevice(card string) *pci.Device {
+	// The DRM class directory is /sys/class/drm.
+	sysfs := path.Dir(path.Dir(dp.sysfsDir))
+	dev, err := pci.NewDeviceIn(sysfs, path.Join(dp.sysfsDir, card, "device"))
+	if err != nil {
+		klog.V(4).Infof("No PCI device for %s: %+v", card, err)
+		return nil
+	}
+
+	return dev
+}
+
+// sriovSuffix returns the resource suffix of the given card if it's an
+// SR-IOV physical or virtual function and SR-IOV resources are enabled.
+func (dp *devicePlugin) sriovSuffix(card string) string {
+	if !dp.options.sriovResources {
+		return ""
+	}
+
+	dev := dp.pciDevice(card)
+	switch {
+	case dev == nil:
+		return ""
+	case dev.PhysFn != nil:
+		return vfSuffix
+	case dev.MaxVFs() > 0:
+		return pfSuffix
+	}
+
+	return ""
+}
+
+// addVfioFunctions adds the VFs of the given card bound to vfio-pci, i.e.
+// having no DRM nodes, for VMs. Each VF is given to one container.
+func (dp *devicePlugin) addVfioFunctions(devTree dpapi.DeviceTree, card string) {
+	if !dp.options.sriovResources || dp.vfioDir == "" {
+		return
+	}
+
+	pf := dp.pciDevice(card)
+	if pf == nil || pf.PhysFn != nil {
+		return
+	}
+
+	vfs, err := pf.GetVFs()
+	if err != nil {
+		klog.Warningf("Can't read VFs of %s: %+v", card, err)
+		return
+	}
+
+	devType := dp.namedType(card) + vfSuffix + vfioSuffix
+	for _, vf := range vfs {
+		if vf.Driver() != vfioDriver || vf.IOMMUGroup() == "" {
+			continue
+		}
+
+		groupPath := path.Join(dp.vfioDir, vf.IOMMUGroup())
+		if _, err := os.Stat(groupPath); err != nil {
+			klog.V(4).Infof("Skipping VF %s of %s: %+v", vf.BDF, card, err)
+			continue
+		}
+
+		klog.V(4).Infof("Adding VF %s of %s", vf.BDF, card)
+		nodes := []pluginapi.DeviceSpec{
+			{HostPath: groupPath, ContainerPath: groupPath, Permissions: "rw"},
+			{HostPath: path.Join(dp.vfioDir, "vfio"), ContainerPath: path.Join(dp.vfioDir, "vfio"), Permissions: "rw"},
+		}
+		devTree.AddDevice(devType, vf.BDF, dpapi.NewDeviceInfo(pluginapi.Healthy, nodes, nil, nil))
+	}
+}
+
+// provisionVFs creates the given number of VFs on the Intel GPUs supporting
+// SR-IOV. GPUs without SR-IOV support are skipped.
+func (dp *devicePlugin) provisionVFs(numVFs int64) error {
+	files, err := ioutil.ReadDir(dp.sysfsDir)
+	if err != nil {
+		return errors.Wrap(err, "Can't read sysfs folder")
+	}
+
+	provisioned := make(map[string]bool)
+	for _, f := range files {
+		if !dp.gpuDeviceReg.MatchString(f.Name()) {
+			continue
+		}
+
+		pf := dp.pciDevice(f.Name())
+		if pf == nil || pf.Vendor != vendorString || pf.PhysFn != nil || provisioned[pf.BDF] {
+			continue
+		}
+		if pf.MaxVFs() == 0 {
+			klog.V(1).Infof("%s doesn't support SR-IOV, not creating VFs", f.Name())
+			continue
+		}
+
+		if err = pf.SetNumVFs(numVFs); err != nil {
+			return errors.WithMessagef(err, "Can't create VFs of %s", f.Name())
+		}
+		provisioned[pf.BDF] = true
+		klog.V(1).Infof("%s has %d VFs", f.Name(), numVFs)
+	}
+
+	return nil
+}
+
+func validateNumVFs(numVFs int64) error {
+	if numVFs < 0 {
+		return errors.New("The number of VFs can't be negative")
+	}
+
+	return nil
+}
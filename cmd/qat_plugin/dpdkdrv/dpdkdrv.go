@@ -18,10 +18,12 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -46,6 +48,28 @@ const (
 	envVarPrefix       = "QAT"
 )
 
+var (
+	// Kernel subsystems whose uevents trigger device rescans.
+	ueventSubsystems = []string{"pci", "vfio", "uio"}
+)
+
+// Config contains the plugin's settings given in a configuration file.
+// The settings missing in the file default to the command line options.
+type Config struct {
+	MaxNumDevices   int    `json:"maxNumDevices"`
+	KernelVfDrivers string `json:"kernelVfDrivers"`
+}
+
+// Validate implements ConfigValidator interface.
+func (c *Config) Validate() error {
+	if c.MaxNumDevices < 0 {
+		return errors.Errorf("negative maximum number of devices: %d", c.MaxNumDevices)
+	}
+	_, err := parseKernelVfDrivers(c.KernelVfDrivers)
+
+	return err
+}
+
 // DevicePlugin represents vfio based QAT plugin.
 type DevicePlugin struct {
 	maxDevices      int
@@ -53,6 +77,10 @@ type DevicePlugin struct {
 	pciDeviceDir    string
 	kernelVfDrivers []string
 	dpdkDriver      string
+	// config overrides the settings given to NewDevicePlugin if set.
+	config *dpapi.ConfigWatcher
+
+	scanDone chan bool
 }
 
 // NewDevicePlugin returns new instance of vfio based QAT plugin.
@@ -61,6 +89,21 @@ func NewDevicePlugin(maxDevices int, kernelVfDrivers string, dpdkDriver string)
 		return nil, errors.Errorf("wrong DPDK device driver: %s", dpdkDriver)
 	}
 
+	kernelDrivers, err := parseKernelVfDrivers(kernelVfDrivers)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDevicePlugin(pciDriverDirectory, pciDeviceDirectory, maxDevices, kernelDrivers, dpdkDriver), nil
+}
+
+// SetConfig makes the plugin apply the configurations loaded by the given
+// ConfigWatcher. The watcher must load *Config values.
+func (dp *DevicePlugin) SetConfig(config *dpapi.ConfigWatcher) {
+	dp.config = config
+}
+
+func parseKernelVfDrivers(kernelVfDrivers string) ([]string, error) {
 	kernelDrivers := strings.Split(kernelVfDrivers, ",")
 	for _, driver := range kernelDrivers {
 		if !isValidKerneDriver(driver) {
@@ -68,7 +111,7 @@ func NewDevicePlugin(maxDevices int, kernelVfDrivers string, dpdkDriver string)
 		}
 	}
 
-	return newDevicePlugin(pciDriverDirectory, pciDeviceDirectory, maxDevices, kernelDrivers, dpdkDriver), nil
+	return kernelDrivers, nil
 }
 
 func newDevicePlugin(pciDriverDir, pciDeviceDir string, maxDevices int, kernelVfDrivers []string, dpdkDriver string) *DevicePlugin {
@@ -78,23 +121,63 @@ func newDevicePlugin(pciDriverDir, pciDeviceDir string, maxDevices int, kernelVf
 		pciDeviceDir:    pciDeviceDir,
 		kernelVfDrivers: kernelVfDrivers,
 		dpdkDriver:      dpdkDriver,
+		scanDone:        make(chan bool, 1),
 	}
 }
 
 // Scan implements Scanner interface for vfio based QAT plugin.
 func (dp *DevicePlugin) Scan(notifier dpapi.Notifier) error {
+	watcher, err := dpapi.NewWatcher(ueventSubsystems, []string{vfioDevicePath})
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	var configChanges <-chan struct{}
+	if dp.config != nil {
+		dp.applyConfig()
+		configChanges = dp.config.Changes()
+	}
+
 	for {
+		start := time.Now()
 		devTree, err := dp.scan()
+		dpapi.ObserveScan(start, err)
 		if err != nil {
 			return err
 		}
 
 		notifier.Notify(devTree)
 
-		time.Sleep(5 * time.Second)
+		select {
+		case <-dp.scanDone:
+			return nil
+		case <-watcher.Triggers():
+		case <-configChanges:
+			dp.applyConfig()
+		}
 	}
 }
 
+// applyConfig switches the plugin to the last valid configuration.
+func (dp *DevicePlugin) applyConfig() {
+	config := dp.config.Config().(*Config)
+	kernelDrivers, err := parseKernelVfDrivers(config.KernelVfDrivers)
+	if err != nil {
+		// Can't happen as ConfigWatcher accepts only validated configurations.
+		klog.Warningf("Ignoring configuration: %+v", err)
+		return
+	}
+
+	dp.maxDevices = config.MaxNumDevices
+	dp.kernelVfDrivers = kernelDrivers
+}
+
+// StopScan implements ScanStopper interface for vfio based QAT plugin.
+func (dp *DevicePlugin) StopScan() {
+	dp.scanDone <- true
+}
+
 func (dp *DevicePlugin) getDpdkDevice(id string) (string, error) {
 
 	devicePCIAdd := "0000:" + id
@@ -206,8 +289,11 @@ func (dp *DevicePlugin) bindDevice(id string) error {
 	// Unbind from the kernel driver
 	err := ioutil.WriteFile(unbindDevicePath, []byte(devicePCIAddr), 0644)
 	if err != nil {
-		return errors.Wrapf(err, "Unbinding from kernel driver failed for the device %s", id)
-
+		err = errors.Wrapf(err, "Unbinding from kernel driver failed for the device %s", id)
+		if isReadOnly(err) {
+			return dpapi.Fatal(err)
+		}
+		return err
 	}
 	vfdevID, err := dp.getDeviceID(devicePCIAddr)
 	if err != nil {
@@ -217,11 +303,28 @@ func (dp *DevicePlugin) bindDevice(id string) error {
 	//Bind to the the dpdk driver
 	err = ioutil.WriteFile(bindDevicePath, []byte(vendorPrefix+vfdevID), 0644)
 	if err != nil {
-		return errors.Wrapf(err, "Binding to the DPDK driver failed for the device %s", id)
+		err = errors.Wrapf(err, "Binding to the DPDK driver failed for the device %s", id)
+		if isReadOnly(err) {
+			return dpapi.Fatal(err)
+		}
+		return err
 	}
 	return nil
 }
 
+// isReadOnly checks if a sysfs write failed because the plugin isn't
+// allowed to write to sysfs. Rescanning doesn't help with that.
+func isReadOnly(err error) bool {
+	cause := errors.Cause(err)
+	if os.IsPermission(cause) {
+		return true
+	}
+	if pathErr, ok := cause.(*os.PathError); ok {
+		return pathErr.Err == syscall.EROFS
+	}
+	return false
+}
+
 func isValidKerneDriver(kernelvfDriver string) bool {
 	switch kernelvfDriver {
 	case "dh895xccvf", "c6xxvf", "c3xxxvf", "d15xxvf":
@@ -26,6 +26,9 @@ import (
 	"github.com/pkg/errors"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+	dptesting "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin/testing"
 )
 
 func init() {
@@ -110,6 +113,43 @@ func TestNewDevicePlugin(t *testing.T) {
 	}
 }
 
+func TestApplyConfig(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "qatplugin-config")
+	if err != nil {
+		t.Fatalf("Unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	configFile := path.Join(tmpdir, "config.yaml")
+	if err = ioutil.WriteFile(configFile, []byte("maxNumDevices: 2\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %+v", err)
+	}
+
+	dp := newDevicePlugin("", "", 32, []string{"c6xxvf"}, "vfio-pci")
+	config, err := dpapi.NewConfigWatcher(configFile, func() interface{} {
+		return &Config{MaxNumDevices: 32, KernelVfDrivers: "c6xxvf,d15xxvf"}
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	defer config.Close()
+	dp.SetConfig(config)
+
+	dp.applyConfig()
+	if dp.maxDevices != 2 {
+		t.Errorf("Expected 2 devices at most, but got %d", dp.maxDevices)
+	}
+	if len(dp.kernelVfDrivers) != 2 {
+		t.Errorf("Expected kernel VF drivers to default to the command line option, but got %v", dp.kernelVfDrivers)
+	}
+
+	for _, invalid := range []Config{{MaxNumDevices: -1, KernelVfDrivers: "c6xxvf"}, {MaxNumDevices: 1, KernelVfDrivers: "i915"}} {
+		if err = invalid.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", invalid)
+		}
+	}
+}
+
 func TestScanPrivate(t *testing.T) {
 	tmpdir := fmt.Sprintf("/tmp/qatplugin-TestScanPrivate-%d", time.Now().Unix())
 	pciDrvDir := path.Join(tmpdir, "sys/bus/pci/drivers")
@@ -463,3 +503,38 @@ func TestPostAllocate(t *testing.T) {
 		}
 	}
 }
+
+func TestConformance(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "qatplugin-conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	err = createTestFiles(tmpdir,
+		[]string{
+			"sys/bus/pci/drivers/vfio-pci",
+			"sys/bus/pci/drivers/c6xxvf/0000:02:00.0",
+			"sys/bus/pci/devices/0000:02:00.0/driver",
+			"sys/bus/pci/devices/0000:02:00.0/vfio-pci/vfiotestfile",
+		},
+		map[string][]byte{
+			"sys/bus/pci/devices/0000:02:00.0/driver/unbind": []byte("some junk"),
+			"sys/bus/pci/devices/0000:02:00.0/device":        []byte("0x37c9"),
+			"sys/bus/pci/drivers/vfio-pci/new_id":            []byte("some junk"),
+		},
+		map[string]string{
+			"sys/bus/pci/devices/0000:02:00.0/iommu_group": "sys/kernel/iommu_groups/vfiotestfile",
+		})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	suite := &dptesting.Conformance{
+		Namespace: "qat.intel.com",
+		Plugin: newDevicePlugin(path.Join(tmpdir, "sys/bus/pci/drivers"), path.Join(tmpdir, "sys/bus/pci/devices"),
+			1, []string{"c6xxvf"}, "vfio-pci"),
+		DeviceTypes: []string{"generic"},
+	}
+	suite.Run(t)
+}
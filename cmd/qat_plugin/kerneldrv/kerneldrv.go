@@ -35,7 +35,8 @@ import (
 )
 
 const (
-	namespace = "qat.intel.com"
+	namespace    = "qat.intel.com"
+	pciSubsystem = "pci"
 )
 
 var (
@@ -120,6 +121,9 @@ func getDevTree(sysfs string, qatDevs []device, config map[string]section) (dpap
 type DevicePlugin struct {
 	execer    utilsexec.Interface
 	configDir string
+	sysfsDir  string
+
+	scanDone chan bool
 }
 
 // NewDevicePlugin returns new instance of kernel based QAT plugin.
@@ -131,11 +135,17 @@ func newDevicePlugin(configDir string, execer utilsexec.Interface) *DevicePlugin
 	return &DevicePlugin{
 		execer:    execer,
 		configDir: configDir,
+		sysfsDir:  "/sys",
+		scanDone:  make(chan bool, 1),
 	}
 }
 
 func (dp *DevicePlugin) getOnlineDevices(iommuOn bool) ([]device, error) {
 	outputBytes, err := dp.execer.Command("adf_ctl", "status").CombinedOutput()
+	if err == utilsexec.ErrExecutableNotFound {
+		// Rescanning doesn't help until the image is fixed.
+		return nil, dpapi.Fatal(errors.Wrap(err, "Can't find adf_ctl"))
+	}
 	if err != nil {
 		return nil, errors.Wrapf(err, "Can't get driver status")
 	}
@@ -286,8 +296,8 @@ func (drvConfig driverConfig) update(devID string, iniSection *ini.Section) erro
 	return nil
 }
 
-func getIOMMUStatus() (bool, error) {
-	iommus, err := ioutil.ReadDir("/sys/class/iommu/")
+func getIOMMUStatus(sysfs string) (bool, error) {
+	iommus, err := ioutil.ReadDir(filepath.Join(sysfs, "class", "iommu"))
 	if err != nil {
 		return false, errors.Wrapf(err, "Unable to read IOMMU status")
 	}
@@ -301,31 +311,54 @@ func getIOMMUStatus() (bool, error) {
 
 // Scan implements Scanner interface for kernel based QAT plugin.
 func (dp *DevicePlugin) Scan(notifier dpapi.Notifier) error {
+	watcher, err := dpapi.NewWatcher([]string{pciSubsystem}, []string{dp.configDir})
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
 	for {
-		iommuOn, err := getIOMMUStatus()
+		start := time.Now()
+		devTree, err := dp.scan()
+		dpapi.ObserveScan(start, err)
 		if err != nil {
 			return err
 		}
 
-		devices, err := dp.getOnlineDevices(iommuOn)
-		if err != nil {
-			return err
-		}
+		notifier.Notify(devTree)
 
-		driverConfig, err := dp.parseConfigs(devices)
-		if err != nil {
-			return err
+		select {
+		case <-dp.scanDone:
+			return nil
+		case <-watcher.Triggers():
 		}
+	}
+}
 
-		devTree, err := getDevTree("/sys", devices, driverConfig)
-		if err != nil {
-			return err
-		}
+func (dp *DevicePlugin) scan() (dpapi.DeviceTree, error) {
+	iommuOn, err := getIOMMUStatus(dp.sysfsDir)
+	if err != nil {
+		return nil, err
+	}
 
-		notifier.Notify(devTree)
+	devices, err := dp.getOnlineDevices(iommuOn)
+	if err != nil {
+		return nil, err
+	}
 
-		time.Sleep(5 * time.Second)
+	driverConfig, err := dp.parseConfigs(devices)
+	if err != nil {
+		// The config files are watched, so the error may come from a file
+		// being written. It's retried after a backoff.
+		return nil, err
 	}
+
+	return getDevTree(dp.sysfsDir, devices, driverConfig)
+}
+
+// StopScan implements ScanStopper interface for kernel based QAT plugin.
+func (dp *DevicePlugin) StopScan() {
+	dp.scanDone <- true
 }
 
 // PostAllocate implements PostAllocator interface for kernel based QAT plugin.
@@ -20,6 +20,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -32,6 +33,9 @@ import (
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 	"k8s.io/utils/exec"
 	fakeexec "k8s.io/utils/exec/testing"
+
+	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+	dptesting "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin/testing"
 )
 
 const (
@@ -70,6 +74,7 @@ func TestGetOnlineDevices(t *testing.T) {
 		adfCtlError    error
 		expectedDevNum int
 		expectedErr    bool
+		expectedFatal  bool
 		iommuOn        bool
 	}{
 		{
@@ -95,6 +100,12 @@ func TestGetOnlineDevices(t *testing.T) {
 			adfCtlError: errors.New("fake error"),
 			expectedErr: true,
 		},
+		{
+			name:          "adf_ctl isn't installed",
+			adfCtlError:   exec.ErrExecutableNotFound,
+			expectedErr:   true,
+			expectedFatal: true,
+		},
 	}
 	for _, tt := range tcases {
 		t.Run(tt.name, func(t *testing.T) {
@@ -122,6 +133,9 @@ func TestGetOnlineDevices(t *testing.T) {
 			if !tt.expectedErr && err != nil {
 				t.Errorf("Unexpected error: %+v", err)
 			}
+			if dpapi.IsFatal(err) != tt.expectedFatal {
+				t.Errorf("Expected fatal error: %v, but got %+v", tt.expectedFatal, err)
+			}
 			if len(devices) != tt.expectedDevNum {
 				t.Errorf("Wrong number of device detected: %d instead of %d", len(devices), tt.expectedDevNum)
 			}
@@ -389,3 +403,50 @@ func TestPostAllocate(t *testing.T) {
 		klog.V(4).Info(response)
 	}
 }
+
+// adfCtlExec is a fake executor of adf_ctl returning the given output every
+// time it's run.
+type adfCtlExec struct {
+	exec.Interface
+	output string
+}
+
+func (e *adfCtlExec) Command(cmd string, args ...string) exec.Cmd {
+	fcmd := &fakeexec.FakeCmd{
+		CombinedOutputScript: []fakeexec.FakeAction{
+			func() ([]byte, []byte, error) {
+				return []byte(e.output), []byte{}, nil
+			},
+		},
+	}
+
+	return fakeexec.InitFakeCmd(fcmd, cmd, args...)
+}
+
+func TestConformance(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "qatplugin-conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	sysfs := filepath.Join(tmpdir, "sys")
+	if err = os.MkdirAll(filepath.Join(sysfs, "class", "iommu"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i, bsf := range []string{"0000:3b:00.0", "0000:3d:00.0", "0000:d8:00.0"} {
+		if err = os.MkdirAll(filepath.Join(getUIODeviceListPath(sysfs, "c6xx", bsf), fmt.Sprintf("uio%d", i)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dp := newDevicePlugin("./test_data/all_is_good", &adfCtlExec{output: adfCtlOutput})
+	dp.sysfsDir = sysfs
+
+	suite := &dptesting.Conformance{
+		Namespace:   "qat.intel.com",
+		Plugin:      dp,
+		DeviceTypes: []string{"cy1_dc0", "cy6_dc2"},
+	}
+	suite.Run(t)
+}
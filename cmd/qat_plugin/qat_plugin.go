@@ -40,12 +40,25 @@ func main() {
 	dpdkDriver := flag.String("dpdk-driver", "vfio-pci", "DPDK Device driver for configuring the QAT device")
 	kernelVfDrivers := flag.String("kernel-vf-drivers", "dh895xccvf,c6xxvf,c3xxxvf,d15xxvf", "Comma separated VF Device Driver of the QuickAssist Devices in the system. Devices supported: DH895xCC,C62x,C3xxx and D15xx")
 	maxNumDevices := flag.Int("max-num-devices", 32, "maximum number of QAT devices to be provided to the QuickAssist device plugin")
+	configFile := flag.String("config", "", "YAML configuration file overriding -max-num-devices and -kernel-vf-drivers in dpdk mode, reloaded on changes")
 	flag.Parse()
 
+	var config *deviceplugin.ConfigWatcher
 	switch *mode {
 	case "dpdk":
-		plugin, err = dpdkdrv.NewDevicePlugin(*maxNumDevices, *kernelVfDrivers, *dpdkDriver)
+		var dpdkPlugin *dpdkdrv.DevicePlugin
+		dpdkPlugin, err = dpdkdrv.NewDevicePlugin(*maxNumDevices, *kernelVfDrivers, *dpdkDriver)
+		if err == nil && *configFile != "" {
+			config, err = deviceplugin.NewConfigWatcher(*configFile, func() interface{} {
+				return &dpdkdrv.Config{MaxNumDevices: *maxNumDevices, KernelVfDrivers: *kernelVfDrivers}
+			})
+			dpdkPlugin.SetConfig(config)
+		}
+		plugin = dpdkPlugin
 	case "kernel":
+		if *configFile != "" {
+			err = errors.New("Configuration file is supported only in dpdk mode")
+		}
 		plugin = kerneldrv.NewDevicePlugin()
 	default:
 		err = errors.Errorf("Unknown mode: %s", *mode)
@@ -57,5 +70,11 @@ func main() {
 
 	klog.V(1).Infof("QAT device plugin started in '%s' mode", *mode)
 	manager := deviceplugin.NewManager(namespace, plugin)
-	manager.Run()
+	err = manager.Run(deviceplugin.SetupSignalHandler())
+	if config != nil {
+		config.Close()
+	}
+	if err != nil {
+		klog.Fatalf("%+v", err)
+	}
 }
@@ -0,0 +1,224 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+)
+
+const (
+	sysfsPciDirectory = "/sys/bus/pci/devices"
+	devfsDirectory    = "/dev"
+	pciSubsystem      = "pci"
+
+	// pcieDeviceType is the resource of PCIe attached VPUs.
+	pcieDeviceType = "pcie"
+
+	// Keem Bay VPU
+	defaultPCIIDs = "8086:6240"
+
+	pciAddressRE = `^[[:xdigit:]]{4}:[[:xdigit:]]{2}:[[:xdigit:]]{2}\.[[:xdigit:]]$`
+
+	// maxNodeDepth is the depth of the directories under a PCI device the
+	// device nodes of its drivers are looked for in, e.g. xlink/xlnk0.
+	maxNodeDepth = 3
+)
+
+// pciID is the vendor and device ID of a PCI device.
+type pciID struct {
+	vendor uint64
+	device uint64
+}
+
+// parsePCIIDs parses a comma separated list of vendor:device ID pairs in hex,
+// e.g. "8086:6240".
+func parsePCIIDs(ids string) (map[pciID]bool, error) {
+	parsed := make(map[pciID]bool)
+	for _, id := range strings.Split(ids, ",") {
+		parts := strings.Split(strings.TrimSpace(id), ":")
+		if len(parts) != 2 {
+			return nil, errors.Errorf("Invalid PCI ID %q, expected vendor:device", id)
+		}
+		vendor, err := strconv.ParseUint(strings.TrimPrefix(parts[0], "0x"), 16, 16)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid vendor ID in %q", id)
+		}
+		device, err := strconv.ParseUint(strings.TrimPrefix(parts[1], "0x"), 16, 16)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid device ID in %q", id)
+		}
+		parsed[pciID{vendor: vendor, device: device}] = true
+	}
+
+	return parsed, nil
+}
+
+// pcieScanner finds the VPUs with the given PCI IDs in sysfs and exposes
+// the device nodes their drivers create. Each VPU is a device with the ID
+// of its PCI address.
+type pcieScanner struct {
+	sysfsDir      string
+	devfsDir      string
+	ids           map[pciID]bool
+	pciAddressReg *regexp.Regexp
+}
+
+func newPCIeScanner(sysfsDir, devfsDir string, ids map[pciID]bool) *pcieScanner {
+	return &pcieScanner{
+		sysfsDir:      sysfsDir,
+		devfsDir:      devfsDir,
+		ids:           ids,
+		pciAddressReg: regexp.MustCompile(pciAddressRE),
+	}
+}
+
+// scan implements scanner interface.
+func (s *pcieScanner) scan() (dpapi.DeviceTree, error) {
+	files, err := ioutil.ReadDir(s.sysfsDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't read PCI devices")
+	}
+
+	devTree := dpapi.NewDeviceTree()
+	for _, f := range files {
+		bdf := f.Name()
+		if !s.matches(bdf) {
+			continue
+		}
+
+		nodes := s.deviceNodes(bdf)
+		if len(nodes) == 0 {
+			klog.V(4).Infof("Skipping VPU %s without device nodes", bdf)
+			continue
+		}
+
+		specs := make([]pluginapi.DeviceSpec, 0, len(nodes))
+		for _, node := range nodes {
+			klog.V(4).Infof("Adding %s to VPU %s", node, bdf)
+			specs = append(specs, pluginapi.DeviceSpec{
+				HostPath:      node,
+				ContainerPath: node,
+				Permissions:   "rw",
+			})
+		}
+		devTree.AddDevice(pcieDeviceType, bdf, dpapi.NewDeviceInfo(pluginapi.Healthy, specs, nil, nil))
+	}
+
+	return devTree, nil
+}
+
+// watched implements scanner interface. The drivers create the device
+// nodes of the VPUs after the PCI devices are added.
+func (s *pcieScanner) watched() (string, string) {
+	return pciSubsystem, s.devfsDir
+}
+
+// matches tells if the PCI device at the given address is a VPU.
+func (s *pcieScanner) matches(bdf string) bool {
+	var id pciID
+	for file, value := range map[string]*uint64{"vendor": &id.vendor, "device": &id.device} {
+		dat, err := ioutil.ReadFile(path.Join(s.sysfsDir, bdf, file))
+		if err != nil {
+			return false
+		}
+		if *value, err = strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(string(dat)), "0x"), 16, 16); err != nil {
+			return false
+		}
+	}
+
+	return s.ids[id]
+}
+
+// deviceNodes returns the existing device nodes of the PCI device at the
+// given address. They are named in the uevent files of the devices the
+// drivers of the PCI device create, e.g. DEVNAME=xlnk0.
+func (s *pcieScanner) deviceNodes(bdf string) []string {
+	root, err := filepath.EvalSymlinks(path.Join(s.sysfsDir, bdf))
+	if err != nil {
+		return nil
+	}
+
+	nodes := []string{}
+	// Walk doesn't follow symlinks, so e.g. driver and subsystem are skipped.
+	_ = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		if info.IsDir() && p != root && (strings.Count(rel, "/") >= maxNodeDepth || s.pciAddressReg.MatchString(info.Name())) {
+			// Functions behind bridges are devices of their own.
+			return filepath.SkipDir
+		}
+		if info.Name() != "uevent" || p == path.Join(root, "uevent") {
+			return nil
+		}
+
+		if node := s.devName(p); node != "" {
+			nodes = append(nodes, node)
+		}
+		return nil
+	})
+	sort.Strings(nodes)
+
+	return nodes
+}
+
+// devName returns the existing device node named in the given uevent file.
+func (s *pcieScanner) devName(ueventPath string) string {
+	dat, err := ioutil.ReadFile(ueventPath)
+	if err != nil {
+		return ""
+	}
+
+	for _, line := range strings.Split(string(dat), "\n") {
+		if !strings.HasPrefix(line, "DEVNAME=") {
+			continue
+		}
+		node := path.Join(s.devfsDir, strings.TrimPrefix(line, "DEVNAME="))
+		if _, err := os.Stat(node); err != nil {
+			klog.V(4).Infof("Device node %s missing: %+v", node, err)
+			return ""
+		}
+		return node
+	}
+
+	return ""
+}
+
+// checkHealth tells if the VPU at the given PCI address is bound to a driver
+// and has device nodes.
+func (s *pcieScanner) checkHealth(bdf string) (string, string) {
+	if _, err := os.Lstat(path.Join(s.sysfsDir, bdf, "driver")); err != nil {
+		return pluginapi.Unhealthy, "driver unbound"
+	}
+	if len(s.deviceNodes(bdf)) == 0 {
+		return pluginapi.Unhealthy, "device nodes missing"
+	}
+
+	return pluginapi.Healthy, "bound to driver"
+}
@@ -0,0 +1,220 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+)
+
+const (
+	sysfsUsbDirectory = "/sys/bus/usb/devices"
+	devfsUsbDirectory = "/dev/bus/usb"
+
+	// myriadDeviceType is the resource of individual Myriad X VPUs.
+	myriadDeviceType = "myriadx"
+
+	// myriadBootProductID is the product ID of Myriad X VPUs whose firmware
+	// isn't booted. Booting the firmware makes them re-enumerate with
+	// another product ID and bus address.
+	myriadBootProductID = 0x2485
+
+	// usbPortPathRE matches the sysfs names of USB devices, i.e. the bus
+	// followed by the ports from the root hub, e.g. 1-2.3.
+	usbPortPathRE = `^[0-9]+-[0-9]+(\.[0-9]+)*$`
+
+	// reenumerationGracePeriod is the time a disappeared VPU is kept as
+	// unhealthy. Myriad X VPUs re-enumerate e.g. when their firmware is
+	// booted.
+	reenumerationGracePeriod = 30 * time.Second
+)
+
+// usbDevice is a USB device found in sysfs.
+type usbDevice struct {
+	vendor  int
+	product int
+	// node is the device node of the current bus address.
+	node string
+}
+
+// readUSBDevice reads the USB device at the given bus/port path from sysfs.
+func (dp *devicePlugin) readUSBDevice(portPath string) (*usbDevice, error) {
+	values := map[string]int{}
+	for file, base := range map[string]int{"idVendor": 16, "idProduct": 16, "busnum": 10, "devnum": 10} {
+		dat, err := ioutil.ReadFile(path.Join(dp.sysfsDir, portPath, file))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Can't read %s of %s", file, portPath)
+		}
+		value, err := strconv.ParseInt(strings.TrimSpace(string(dat)), base, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid %s of %s", file, portPath)
+		}
+		values[file] = int(value)
+	}
+
+	return &usbDevice{
+		vendor:  values["idVendor"],
+		product: values["idProduct"],
+		node:    path.Join(dp.devfsDir, fmt.Sprintf("%03d", values["busnum"]), fmt.Sprintf("%03d", values["devnum"])),
+	}, nil
+}
+
+// isMyriad tells if the given USB device is a Myriad X VPU.
+func (dp *devicePlugin) isMyriad(dev *usbDevice) bool {
+	if dev.vendor != dp.vendorID {
+		return false
+	}
+	for _, product := range dp.productIDs {
+		if dev.product == product {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scanMyriads exposes every Myriad X VPU as a device with the ID of its
+// bus/port path, so the IDs stay the same when the VPUs re-enumerate or
+// are plugged in again to the same port.
+func (dp *devicePlugin) scanMyriads() (dpapi.DeviceTree, error) {
+	files, err := ioutil.ReadDir(dp.sysfsDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't read USB devices")
+	}
+
+	now := time.Now()
+	devTree := dpapi.NewDeviceTree()
+	ports := make(map[string]string)
+	for _, f := range files {
+		portPath := f.Name()
+		if !dp.usbPortPathReg.MatchString(portPath) {
+			continue
+		}
+
+		dev, err := dp.readUSBDevice(portPath)
+		if err != nil {
+			klog.V(4).Infof("Skipping USB device: %+v", err)
+			continue
+		}
+		if !dp.isMyriad(dev) {
+			continue
+		}
+
+		klog.V(4).Infof("Adding Myriad X at %s with %s", portPath, dev.node)
+		dp.lastSeen[portPath] = now
+		if dp.bootedOnly && dev.product == myriadBootProductID {
+			devTree.AddDevice(myriadDeviceType, portPath, dpapi.NewDeviceInfo(pluginapi.Unhealthy, nil, nil, nil))
+			continue
+		}
+		ports[dev.node] = portPath
+		nodes := []pluginapi.DeviceSpec{
+			{
+				HostPath:      dev.node,
+				ContainerPath: dev.node,
+				Permissions:   "rw",
+			},
+		}
+		devTree.AddDevice(myriadDeviceType, portPath, dpapi.NewDeviceInfo(pluginapi.Healthy, nodes, nil, nil))
+	}
+
+	for portPath, seen := range dp.lastSeen {
+		if _, found := devTree[myriadDeviceType][portPath]; found {
+			continue
+		}
+		if now.Sub(seen) > reenumerationGracePeriod {
+			klog.V(1).Infof("Myriad X at %s removed", portPath)
+			delete(dp.lastSeen, portPath)
+			continue
+		}
+		devTree.AddDevice(myriadDeviceType, portPath, dpapi.NewDeviceInfo(pluginapi.Unhealthy, nil, nil, nil))
+	}
+
+	dp.myriadLock.Lock()
+	dp.myriadPorts = ports
+	dp.myriadLock.Unlock()
+
+	return devTree, nil
+}
+
+// PostAllocate implements PostAllocator interface. The device node of a
+// Myriad X changes when it re-enumerates, e.g. after its firmware is booted,
+// so the VPUs are found again by their bus/port paths in case they've
+// re-enumerated after the last scan.
+func (dp *devicePlugin) PostAllocate(response *pluginapi.AllocateResponse) error {
+	dp.myriadLock.Lock()
+	ports := dp.myriadPorts
+	dp.myriadLock.Unlock()
+
+	for _, cresp := range response.ContainerResponses {
+		for _, node := range cresp.Devices {
+			portPath, ok := ports[node.HostPath]
+			if !ok {
+				continue
+			}
+			dev, err := dp.readUSBDevice(portPath)
+			if err != nil || !dp.isMyriad(dev) {
+				return errors.Errorf("Myriad X at %s disconnected", portPath)
+			}
+			if dev.node != node.HostPath {
+				klog.V(1).Infof("Myriad X at %s re-enumerated as %s", portPath, dev.node)
+				node.HostPath = dev.node
+				node.ContainerPath = dev.node
+			}
+		}
+	}
+
+	return nil
+}
+
+// CheckHealth implements HealthChecker interface. A Myriad X is healthy when
+// it's connected to its port and its device node exists, and with bootedOnly
+// set when its firmware is booted. A PCIe VPU is healthy while it's bound to
+// a driver providing its device nodes. The devices of the HDDL service are
+// healthy while the service is running.
+func (dp *devicePlugin) CheckHealth(devType, id string, info dpapi.DeviceInfo) (string, string) {
+	if devType == pcieDeviceType && dp.pcie != nil {
+		return dp.pcie.checkHealth(id)
+	}
+	if devType != myriadDeviceType {
+		if !fileExists(hddlSockPath) {
+			return pluginapi.Unhealthy, "HDDL service not running"
+		}
+		return pluginapi.Healthy, "HDDL service running"
+	}
+
+	dev, err := dp.readUSBDevice(id)
+	if err != nil || !dp.isMyriad(dev) {
+		return pluginapi.Unhealthy, "disconnected"
+	}
+	if dp.bootedOnly && dev.product == myriadBootProductID {
+		return pluginapi.Unhealthy, "firmware not booted"
+	}
+	if _, err = os.Stat(dev.node); err != nil {
+		return pluginapi.Unhealthy, "device node " + dev.node + " missing"
+	}
+
+	return pluginapi.Healthy, "connected"
+}
@@ -18,10 +18,14 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/gousb"
+	"github.com/pkg/errors"
 
 	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
 	"k8s.io/klog"
@@ -39,8 +43,17 @@ const (
 	hddlServicePath1 = "/var/tmp/hddl_service_ready.mutex"
 	hddlServicePath2 = "/var/tmp/hddl_service_alive.mutex"
 	ionDevNode       = "/dev/ion"
-	// Frequency of device scans
-	scanFrequency = 5 * time.Second
+	usbSubsystem     = "usb"
+
+	// VPU backends.
+	usbBackend  = "usb"
+	pcieBackend = "pcie"
+
+	// Modes of the USB backend.
+	// All VPUs are shared through the HDDL service.
+	hddlMode = "hddl"
+	// Every VPU is a device of its own.
+	deviceMode = "device"
 )
 
 var (
@@ -52,13 +65,66 @@ type gousbContext interface {
 	OpenDevices(opener func(desc *gousb.DeviceDesc) bool) ([]*gousb.Device, error)
 }
 
+// scanner discovers the VPUs of one backend.
+type scanner interface {
+	// scan returns the VPUs found.
+	scan() (dpapi.DeviceTree, error)
+	// watched returns the uevent subsystem and the directory or the file
+	// whose changes trigger rescans.
+	watched() (subsystem string, path string)
+}
+
+// hddlScanner finds the USB VPUs shared through the HDDL service.
+type hddlScanner struct {
+	dp *devicePlugin
+}
+
+func (s hddlScanner) scan() (dpapi.DeviceTree, error) {
+	return s.dp.scan()
+}
+
+// HDDL service creates its socket when it starts.
+func (s hddlScanner) watched() (string, string) {
+	return usbSubsystem, hddlSockPath
+}
+
+// myriadScanner finds the individual USB VPUs.
+type myriadScanner struct {
+	dp *devicePlugin
+}
+
+func (s myriadScanner) scan() (dpapi.DeviceTree, error) {
+	return s.dp.scanMyriads()
+}
+
+func (s myriadScanner) watched() (string, string) {
+	return usbSubsystem, s.dp.devfsDir
+}
+
 type devicePlugin struct {
 	usbContext   gousbContext
 	vendorID     int
 	productIDs   []int
 	sharedDevNum int
-	scanTicker   *time.Ticker
 	scanDone     chan bool
+
+	// usb enables the USB backend in the given mode.
+	usb      bool
+	mode     string
+	sysfsDir string
+	devfsDir string
+	// pcie is the PCIe backend, nil if disabled.
+	pcie *pcieScanner
+
+	usbPortPathReg *regexp.Regexp
+	// Bus/port path -> last time the Myriad X was found in device mode.
+	lastSeen map[string]time.Time
+	// bootedOnly makes Myriad X VPUs whose firmware isn't booted unhealthy.
+	bootedOnly bool
+
+	myriadLock sync.Mutex
+	// Device node -> bus/port path of the Myriad X VPUs found by the last scan.
+	myriadPorts map[string]string
 }
 
 func newDevicePlugin(usbContext gousbContext, vendorID int, productIDs []int, sharedDevNum int) *devicePlugin {
@@ -71,15 +137,37 @@ func newDevicePlugin(usbContext gousbContext, vendorID int, productIDs []int, sh
 		vendorID:     vendorID,
 		productIDs:   productIDs,
 		sharedDevNum: sharedDevNum,
-		scanTicker:   time.NewTicker(scanFrequency),
 		scanDone:     make(chan bool, 1),
+
+		usb:            true,
+		mode:           hddlMode,
+		sysfsDir:       sysfsUsbDirectory,
+		devfsDir:       devfsUsbDirectory,
+		usbPortPathReg: regexp.MustCompile(usbPortPathRE),
+		lastSeen:       make(map[string]time.Time),
 	}
 }
 
 func (dp *devicePlugin) Scan(notifier dpapi.Notifier) error {
-	defer dp.scanTicker.Stop()
+	scanners := dp.scanners()
+
+	var subsystems, paths []string
+	for _, s := range scanners {
+		subsystem, path := s.watched()
+		subsystems = append(subsystems, subsystem)
+		paths = append(paths, path)
+	}
+
+	watcher, err := dpapi.NewWatcher(subsystems, paths)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
 	for {
-		devTree, err := dp.scan()
+		start := time.Now()
+		devTree, err := scanAll(scanners)
+		dpapi.ObserveScan(start, err)
 		if err != nil {
 			return err
 		}
@@ -89,9 +177,63 @@ func (dp *devicePlugin) Scan(notifier dpapi.Notifier) error {
 		select {
 		case <-dp.scanDone:
 			return nil
-		case <-dp.scanTicker.C:
+		case <-watcher.Triggers():
+		}
+	}
+}
+
+// scanners returns the scanners of the enabled backends.
+func (dp *devicePlugin) scanners() []scanner {
+	scanners := []scanner{}
+	if dp.usb {
+		if dp.mode == deviceMode {
+			scanners = append(scanners, myriadScanner{dp})
+		} else {
+			scanners = append(scanners, hddlScanner{dp})
+		}
+	}
+	if dp.pcie != nil {
+		scanners = append(scanners, dp.pcie)
+	}
+
+	return scanners
+}
+
+// parseBackends parses a comma separated list of backends.
+func parseBackends(backends string) (map[string]bool, error) {
+	enabled := make(map[string]bool)
+	for _, backend := range strings.Split(backends, ",") {
+		backend = strings.TrimSpace(backend)
+		if backend != usbBackend && backend != pcieBackend {
+			return nil, errors.Errorf("Unknown backend %q", backend)
 		}
+		enabled[backend] = true
 	}
+
+	return enabled, nil
+}
+
+// scanAll merges the VPUs found by the given scanners.
+func scanAll(scanners []scanner) (dpapi.DeviceTree, error) {
+	devTree := dpapi.NewDeviceTree()
+	for _, s := range scanners {
+		found, err := s.scan()
+		if err != nil {
+			return nil, err
+		}
+		for devType, devices := range found {
+			for id, info := range devices {
+				devTree.AddDevice(devType, id, info)
+			}
+		}
+	}
+
+	return devTree, nil
+}
+
+// StopScan implements ScanStopper interface.
+func (dp *devicePlugin) StopScan() {
+	dp.scanDone <- true
 }
 
 func fileExists(filename string) bool {
@@ -169,26 +311,70 @@ func (dp *devicePlugin) scan() (dpapi.DeviceTree, error) {
 
 func main() {
 	var sharedDevNum int
+	var mode, backends, pciIDs string
+	var bootedOnly bool
 
 	flag.IntVar(&sharedDevNum, "shared-dev-num", 1, "number of containers sharing the same VPU device")
+	flag.StringVar(&mode, "mode", hddlMode,
+		fmt.Sprintf("'%s' (default) to share all VPUs through the HDDL service as %s/%s, '%s' to expose every Myriad X VPU as %s/%s",
+			hddlMode, namespace, deviceType, deviceMode, namespace, myriadDeviceType))
+	flag.StringVar(&backends, "backends", usbBackend,
+		fmt.Sprintf("comma separated list of VPU backends: '%s' (default) for USB VPUs, '%s' for PCIe VPUs exposed as %s/%s",
+			usbBackend, pcieBackend, namespace, pcieDeviceType))
+	flag.StringVar(&pciIDs, "pcie-ids", defaultPCIIDs, "comma separated list of vendor:device IDs of PCIe VPUs")
+	flag.BoolVar(&bootedOnly, "myriad-booted-only", false,
+		fmt.Sprintf("report Myriad X VPUs whose firmware isn't booted unhealthy in '%s' mode", deviceMode))
 	flag.Parse()
 
+	if mode != hddlMode && mode != deviceMode {
+		klog.Fatalf("Unknown mode %q", mode)
+	}
+	enabled, err := parseBackends(backends)
+	if err != nil {
+		klog.Fatalf("%+v", err)
+	}
+	ids, err := parsePCIIDs(pciIDs)
+	if err != nil {
+		klog.Fatalf("%+v", err)
+	}
+
 	klog.V(1).Info("VPU device plugin started")
 
-	// add lsusb here
-	ctx := gousb.NewContext()
-	defer ctx.Close()
+	plugin := newDevicePlugin(nil, vendorID, productIDs, sharedDevNum)
+	if plugin == nil {
+		klog.Fatal("Cannot create device plugin, please check above error messages.")
+	}
+	plugin.mode = mode
+	plugin.bootedOnly = bootedOnly
+	plugin.usb = enabled[usbBackend]
+	if enabled[pcieBackend] {
+		plugin.pcie = newPCIeScanner(sysfsPciDirectory, devfsDirectory, ids)
+	}
 
-	verbosityLevel, err := strconv.Atoi(flag.CommandLine.Lookup("v").Value.String())
-	if err == nil {
-		// gousb (libusb) Debug levels are a 1:1 match to klog levels, just pass through.
-		ctx.Debug(verbosityLevel)
+	if err := run(plugin); err != nil {
+		klog.Fatalf("%+v", err)
 	}
+}
 
-	plugin := newDevicePlugin(ctx, vendorID, productIDs, sharedDevNum)
-	if plugin == nil {
-		klog.Fatal("Cannot create device plugin, please check above error messages.")
+// run runs the given plugin until it's stopped. It's apart from main() so
+// that the USB context is closed before klog.Fatalf exits on errors.
+func run(plugin *devicePlugin) error {
+	// gousb panics if libusb can't be initialized, e.g. when the USB buses
+	// aren't mounted, so the context is created only for the USB backend.
+	if plugin.usb {
+		// add lsusb here
+		ctx := gousb.NewContext()
+		defer ctx.Close()
+
+		verbosityLevel, err := strconv.Atoi(flag.CommandLine.Lookup("v").Value.String())
+		if err == nil {
+			// gousb (libusb) Debug levels are a 1:1 match to klog levels, just pass through.
+			ctx.Debug(verbosityLevel)
+		}
+		plugin.usbContext = ctx
 	}
+
 	manager := dpapi.NewManager(namespace, plugin)
-	manager.Run()
+
+	return manager.Run(dpapi.SetupSignalHandler())
 }
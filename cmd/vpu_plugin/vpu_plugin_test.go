@@ -16,12 +16,20 @@ package main
 
 import (
 	"flag"
+	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/google/gousb"
 	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+	dptesting "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin/testing"
+	"github.com/pkg/errors"
 	"k8s.io/klog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 func init() {
@@ -115,3 +123,415 @@ func TestScan(t *testing.T) {
 		t.Error("vpu plugin test fail: newDevicePlugin should fail with 0 sharedDevNum")
 	}
 }
+
+func TestScanMyriads(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vpuplugin-myriads")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	sysfs := path.Join(tmpdir, "sysfs")
+	devfs := path.Join(tmpdir, "devfs")
+	// 1-2 and 1-3.1 are Myriad X VPUs, the firmware of 1-2 isn't booted,
+	// 2-1 is another device, usb1 a root hub and 1-2:1.0 an interface.
+	devices := map[string][]string{
+		"1-2":     {"03e7", "2485", "1", "5"},
+		"1-3.1":   {"03e7", "f63b", "1", "7"},
+		"2-1":     {"8086", "2485", "2", "2"},
+		"usb1":    {"1d6b", "0002", "1", "1"},
+		"1-2:1.0": {"03e7", "2485", "1", "5"},
+	}
+	writeDevice := func(portPath string, ids []string) {
+		if err = os.MkdirAll(path.Join(sysfs, portPath), 0755); err != nil {
+			t.Fatalf("failed to create fake device directory: %+v", err)
+		}
+		for i, file := range []string{"idVendor", "idProduct", "busnum", "devnum"} {
+			if err = ioutil.WriteFile(path.Join(sysfs, portPath, file), []byte(ids[i]+"\n"), 0644); err != nil {
+				t.Fatalf("failed to create fake device file: %+v", err)
+			}
+		}
+	}
+	for portPath, ids := range devices {
+		writeDevice(portPath, ids)
+	}
+	for _, node := range []string{"001/005", "001/006"} {
+		if err = os.MkdirAll(path.Join(devfs, node), 0755); err != nil {
+			t.Fatalf("failed to create fake device node: %+v", err)
+		}
+	}
+
+	testPlugin := newDevicePlugin(nil, vendorID, productIDs, 1)
+	testPlugin.mode = deviceMode
+	testPlugin.sysfsDir = sysfs
+	testPlugin.devfsDir = devfs
+
+	node := func(name string) []pluginapi.DeviceSpec {
+		return []pluginapi.DeviceSpec{{HostPath: path.Join(devfs, name), ContainerPath: path.Join(devfs, name), Permissions: "rw"}}
+	}
+	scan := func(expected map[string]dpapi.DeviceInfo) {
+		tree, err := testPlugin.scanMyriads()
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		if len(tree) != 1 || !reflect.DeepEqual(tree[myriadDeviceType], expected) {
+			t.Errorf("expected %+v, but got %+v", expected, tree)
+		}
+	}
+
+	checkHealth := func(expected map[string]string) {
+		for id, health := range expected {
+			if got, reason := testPlugin.CheckHealth(myriadDeviceType, id, dpapi.DeviceInfo{}); got != health {
+				t.Errorf("%s: expected %s, but got %s (%s)", id, health, got, reason)
+			}
+		}
+	}
+
+	// The device node of 1-3.1 is missing.
+	scan(map[string]dpapi.DeviceInfo{
+		"1-2":   dpapi.NewDeviceInfo(pluginapi.Healthy, node("001/005"), nil, nil),
+		"1-3.1": dpapi.NewDeviceInfo(pluginapi.Healthy, node("001/007"), nil, nil),
+	})
+	checkHealth(map[string]string{"1-2": pluginapi.Healthy, "1-3.1": pluginapi.Unhealthy, "1-4": pluginapi.Unhealthy})
+
+	// 1-2 can't be allocated before its firmware is booted with bootedOnly.
+	testPlugin.bootedOnly = true
+	scan(map[string]dpapi.DeviceInfo{
+		"1-2":   dpapi.NewDeviceInfo(pluginapi.Unhealthy, nil, nil, nil),
+		"1-3.1": dpapi.NewDeviceInfo(pluginapi.Healthy, node("001/007"), nil, nil),
+	})
+	checkHealth(map[string]string{"1-2": pluginapi.Unhealthy})
+	testPlugin.bootedOnly = false
+
+	// 1-2 re-enumerates with a new address once its firmware is booted and
+	// 1-3.1 is unplugged.
+	writeDevice("1-2", []string{"03e7", "f63b", "1", "6"})
+	if err = os.RemoveAll(path.Join(sysfs, "1-3.1")); err != nil {
+		t.Fatalf("failed to remove fake device: %+v", err)
+	}
+	scan(map[string]dpapi.DeviceInfo{
+		"1-2":   dpapi.NewDeviceInfo(pluginapi.Healthy, node("001/006"), nil, nil),
+		"1-3.1": dpapi.NewDeviceInfo(pluginapi.Unhealthy, nil, nil, nil),
+	})
+	checkHealth(map[string]string{"1-2": pluginapi.Healthy, "1-3.1": pluginapi.Unhealthy})
+
+	// 1-2 re-enumerates again, e.g. after being reset and booted, and
+	// containers allocated afterwards get its new device node.
+	writeDevice("1-2", []string{"03e7", "f63b", "1", "8"})
+	checkHealth(map[string]string{"1-2": pluginapi.Unhealthy})
+	if err = os.MkdirAll(path.Join(devfs, "001/008"), 0755); err != nil {
+		t.Fatalf("failed to create fake device node: %+v", err)
+	}
+	checkHealth(map[string]string{"1-2": pluginapi.Healthy})
+	scan(map[string]dpapi.DeviceInfo{
+		"1-2":   dpapi.NewDeviceInfo(pluginapi.Healthy, node("001/008"), nil, nil),
+		"1-3.1": dpapi.NewDeviceInfo(pluginapi.Unhealthy, nil, nil, nil),
+	})
+
+	// 1-3.1 is removed once the grace period is over.
+	testPlugin.lastSeen["1-3.1"] = time.Now().Add(-2 * reenumerationGracePeriod)
+	scan(map[string]dpapi.DeviceInfo{
+		"1-2": dpapi.NewDeviceInfo(pluginapi.Healthy, node("001/008"), nil, nil),
+	})
+}
+
+func TestPostAllocateReenumerated(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vpuplugin-reenumerated")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	sysfs := path.Join(tmpdir, "sys/bus/usb/devices")
+	devfs := path.Join(tmpdir, "dev/bus/usb")
+	writeDevice := func(devnum string) {
+		files := make(map[string][]byte)
+		for file, value := range map[string]string{"idVendor": "03e7", "idProduct": "2485", "busnum": "1", "devnum": devnum} {
+			files[path.Join("sys/bus/usb/devices/1-2", file)] = []byte(value + "\n")
+		}
+		if err = createTestFiles(tmpdir, []string{"dev/bus/usb/001/" + devnum}, files, nil); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	writeDevice("005")
+
+	testPlugin := newDevicePlugin(nil, vendorID, productIDs, 1)
+	testPlugin.mode = deviceMode
+	testPlugin.sysfsDir = sysfs
+	testPlugin.devfsDir = devfs
+	if _, err = testPlugin.scanMyriads(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	allocate := func() (*pluginapi.DeviceSpec, error) {
+		// The device node found by the scan.
+		node := pluginapi.DeviceSpec{HostPath: path.Join(devfs, "001/005"), ContainerPath: path.Join(devfs, "001/005"), Permissions: "rw"}
+		response := &pluginapi.AllocateResponse{
+			ContainerResponses: []*pluginapi.ContainerAllocateResponse{
+				{Devices: []*pluginapi.DeviceSpec{&node}},
+			},
+		}
+		err := testPlugin.PostAllocate(response)
+		return response.ContainerResponses[0].Devices[0], err
+	}
+
+	// 1-2 re-enumerates with a new device number, e.g. after its firmware
+	// is booted, before the next scan.
+	writeDevice("007")
+	node, err := allocate()
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	expected := path.Join(devfs, "001/007")
+	if node.HostPath != expected || node.ContainerPath != expected {
+		t.Errorf("expected device node %s, but got %+v", expected, node)
+	}
+
+	if err = os.RemoveAll(path.Join(sysfs, "1-2")); err != nil {
+		t.Fatalf("failed to remove fake device: %+v", err)
+	}
+	if _, err = allocate(); err == nil {
+		t.Error("expected error for disconnected VPU")
+	}
+}
+
+func createTestFiles(prefix string, dirs []string, files map[string][]byte, symlinks map[string]string) error {
+	for _, dir := range dirs {
+		if err := os.MkdirAll(path.Join(prefix, dir), 0755); err != nil {
+			return errors.Wrap(err, "Failed to create fake device directory")
+		}
+	}
+	for filename, body := range files {
+		if err := os.MkdirAll(path.Dir(path.Join(prefix, filename)), 0755); err != nil {
+			return errors.Wrap(err, "Failed to create fake device directory")
+		}
+		if err := ioutil.WriteFile(path.Join(prefix, filename), body, 0644); err != nil {
+			return errors.Wrap(err, "Failed to create fake device file")
+		}
+	}
+	for link, target := range symlinks {
+		if err := os.MkdirAll(path.Join(prefix, target), 0755); err != nil {
+			return errors.Wrap(err, "Failed to create fake symlink target directory")
+		}
+		if err := os.MkdirAll(path.Dir(path.Join(prefix, link)), 0755); err != nil {
+			return errors.Wrap(err, "Failed to create fake symlink directory")
+		}
+		if err := os.Symlink(path.Join(prefix, target), path.Join(prefix, link)); err != nil {
+			return errors.Wrap(err, "Failed to create fake symlink")
+		}
+	}
+	return nil
+}
+
+func TestScanPCIe(t *testing.T) {
+	const vpu = "sys/devices/pci0000:00/0000:00:1c.0/0000:03:00.0"
+	tcases := []struct {
+		name            string
+		dirs            []string
+		files           map[string][]byte
+		symlinks        map[string]string
+		expectedErr     bool
+		expectedDevices map[string][]string
+		expectedHealth  string
+	}{
+		{
+			name:        "No PCI devices",
+			expectedErr: true,
+		},
+		{
+			name: "VPU with device nodes",
+			dirs: []string{"dev/vpu", vpu + "/driver"},
+			files: map[string][]byte{
+				vpu + "/vendor":              []byte("0x8086\n"),
+				vpu + "/device":              []byte("0x6240\n"),
+				vpu + "/uevent":              []byte("DRIVER=mxlk\nPCI_SLOT_NAME=0000:03:00.0\n"),
+				vpu + "/xlink/xlnk0/uevent":  []byte("MAJOR=240\nMINOR=0\nDEVNAME=xlnk0\n"),
+				vpu + "/misc/vpu-ctl/uevent": []byte("MAJOR=10\nMINOR=58\nDEVNAME=vpu/ctl0\n"),
+				vpu + "/0000:04:00.0/uevent": []byte("DEVNAME=other\n"),
+				"dev/xlnk0":                  nil,
+				"dev/vpu/ctl0":               nil,
+				"dev/other":                  nil,
+			},
+			symlinks: map[string]string{
+				"sys/bus/pci/devices/0000:03:00.0": vpu,
+			},
+			expectedDevices: map[string][]string{
+				"0000:03:00.0": {"dev/vpu/ctl0", "dev/xlnk0"},
+			},
+			expectedHealth: pluginapi.Healthy,
+		},
+		{
+			name: "VPU without driver",
+			files: map[string][]byte{
+				vpu + "/vendor":             []byte("0x8086"),
+				vpu + "/device":             []byte("0x6240"),
+				vpu + "/xlink/xlnk0/uevent": []byte("DEVNAME=xlnk0\n"),
+			},
+			symlinks: map[string]string{
+				"sys/bus/pci/devices/0000:03:00.0": vpu,
+			},
+			expectedDevices: map[string][]string{},
+			expectedHealth:  pluginapi.Unhealthy,
+		},
+		{
+			name: "Other PCI device",
+			dirs: []string{"dev", vpu + "/driver"},
+			files: map[string][]byte{
+				vpu + "/vendor":             []byte("0x8086"),
+				vpu + "/device":             []byte("0x1234"),
+				vpu + "/xlink/xlnk0/uevent": []byte("DEVNAME=xlnk0\n"),
+				"dev/xlnk0":                 nil,
+			},
+			symlinks: map[string]string{
+				"sys/bus/pci/devices/0000:03:00.0": vpu,
+			},
+			expectedDevices: map[string][]string{},
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "vpuplugin-pcie")
+			if err != nil {
+				t.Fatalf("unable to create test directory: %+v", err)
+			}
+			defer os.RemoveAll(tmpdir)
+
+			if err = createTestFiles(tmpdir, tc.dirs, tc.files, tc.symlinks); err != nil {
+				t.Fatalf("%+v", err)
+			}
+
+			ids, err := parsePCIIDs(defaultPCIIDs)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			scanner := newPCIeScanner(path.Join(tmpdir, "sys/bus/pci/devices"), path.Join(tmpdir, "dev"), ids)
+			tree, err := scanner.scan()
+			if tc.expectedErr {
+				if err == nil {
+					t.Error("expected error, but got success")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			devices := map[string][]string{}
+			for id := range tree[pcieDeviceType] {
+				for _, node := range scanner.deviceNodes(id) {
+					rel, _ := filepath.Rel(tmpdir, node)
+					devices[id] = append(devices[id], rel)
+				}
+			}
+			if !reflect.DeepEqual(devices, tc.expectedDevices) {
+				t.Errorf("expected %v, but got %v", tc.expectedDevices, devices)
+			}
+
+			if tc.expectedHealth != "" {
+				if health, reason := scanner.checkHealth("0000:03:00.0"); health != tc.expectedHealth {
+					t.Errorf("expected %s, but got %s (%s)", tc.expectedHealth, health, reason)
+				}
+			}
+		})
+	}
+}
+
+func TestBackends(t *testing.T) {
+	for backends, expectedErr := range map[string]bool{"usb": false, "usb,pcie": false, "pcie": false, "usb,pci": true, "": true} {
+		if _, err := parseBackends(backends); (err != nil) != expectedErr {
+			t.Errorf("%q: expected error %v, but got %+v", backends, expectedErr, err)
+		}
+	}
+	for ids, expectedErr := range map[string]bool{"8086:6240": false, "0x8086:0x6240,8086:6241": false, "8086": true, "8086:xyz": true} {
+		if _, err := parsePCIIDs(ids); (err != nil) != expectedErr {
+			t.Errorf("%q: expected error %v, but got %+v", ids, expectedErr, err)
+		}
+	}
+
+	// The PCIe backend runs alone.
+	tmpdir, err := ioutil.TempDir("", "vpuplugin-backends")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	vpu := "sys/devices/pci0000:00/0000:03:00.0"
+	err = createTestFiles(tmpdir, []string{vpu + "/driver"}, map[string][]byte{
+		vpu + "/vendor":             []byte("0x8086"),
+		vpu + "/device":             []byte("0x6240"),
+		vpu + "/xlink/xlnk0/uevent": []byte("DEVNAME=xlnk0\n"),
+		"dev/xlnk0":                 nil,
+	}, map[string]string{"sys/bus/pci/devices/0000:03:00.0": vpu})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	ids, _ := parsePCIIDs(defaultPCIIDs)
+	testPlugin := newDevicePlugin(nil, vendorID, productIDs, 1)
+	testPlugin.usb = false
+	testPlugin.pcie = newPCIeScanner(path.Join(tmpdir, "sys/bus/pci/devices"), path.Join(tmpdir, "dev"), ids)
+
+	fN := fakeNotifier{scanDone: testPlugin.scanDone}
+	if err = testPlugin.Scan(&fN); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(fN.tree) != 1 || len(fN.tree[pcieDeviceType]) != 1 {
+		t.Errorf("expected one PCIe VPU, but got %+v", fN.tree)
+	}
+	if health, reason := testPlugin.CheckHealth(pcieDeviceType, "0000:03:00.0", dpapi.DeviceInfo{}); health != pluginapi.Healthy {
+		t.Errorf("expected healthy VPU, but got %s (%s)", health, reason)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	const vpu = "sys/devices/pci0000:00/0000:00:1c.0/0000:03:00.0"
+
+	tmpdir, err := ioutil.TempDir("", "vpuplugin-conformance")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// 1-2 and 1-3 are Myriad X VPUs, 0000:03:00.0 a PCIe VPU.
+	dirs := []string{"dev/bus/usb/001/005", "dev/bus/usb/001/006", vpu + "/driver"}
+	files := map[string][]byte{
+		vpu + "/vendor":             []byte("0x8086\n"),
+		vpu + "/device":             []byte("0x6240\n"),
+		vpu + "/xlink/xlnk0/uevent": []byte("DEVNAME=xlnk0\n"),
+		"dev/xlnk0":                 nil,
+	}
+	for portPath, devnum := range map[string]string{"1-2": "5", "1-3": "6"} {
+		for file, value := range map[string]string{"idVendor": "03e7", "idProduct": "f63b", "busnum": "1", "devnum": devnum} {
+			files[path.Join("sys/bus/usb/devices", portPath, file)] = []byte(value + "\n")
+		}
+	}
+	symlinks := map[string]string{
+		"sys/bus/pci/devices/0000:03:00.0": vpu,
+	}
+	if err = createTestFiles(tmpdir, dirs, files, symlinks); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	ids, err := parsePCIIDs(defaultPCIIDs)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	plugin := newDevicePlugin(nil, vendorID, productIDs, 1)
+	plugin.mode = deviceMode
+	plugin.sysfsDir = path.Join(tmpdir, "sys/bus/usb/devices")
+	plugin.devfsDir = path.Join(tmpdir, "dev/bus/usb")
+	plugin.pcie = newPCIeScanner(path.Join(tmpdir, "sys/bus/pci/devices"), path.Join(tmpdir, "dev"), ids)
+
+	suite := &dptesting.Conformance{
+		Namespace:   namespace,
+		Plugin:      plugin,
+		DeviceTypes: []string{myriadDeviceType, pcieDeviceType},
+		MakeUnhealthy: func() error {
+			// The device node of 1-2 disappears and the PCIe VPU gets unbound.
+			if err := os.RemoveAll(path.Join(tmpdir, "dev/bus/usb/001/005")); err != nil {
+				return err
+			}
+			return os.RemoveAll(path.Join(tmpdir, vpu, "driver"))
+		},
+	}
+	suite.Run(t)
+}
@@ -9,20 +9,27 @@ require (
 	github.com/onsi/ginkgo v1.11.0
 	github.com/onsi/gomega v1.7.0
 	github.com/pkg/errors v0.8.1
-	golang.org/x/sys v0.0.0-20191022100944-742c48ecaeb7
-	google.golang.org/grpc v1.26.0
+	github.com/prometheus/client_golang v1.0.0
+	golang.org/x/sys v0.0.0-20200930185726-fdedc70b468f
+	google.golang.org/grpc v1.27.0 // replaced
 	gopkg.in/ini.v1 v1.46.0 // indirect
-	k8s.io/api v0.18.2
-	k8s.io/apimachinery v0.18.2
+	k8s.io/api v0.19.16 // replaced
+	k8s.io/apimachinery v0.19.16 // replaced
 	k8s.io/client-go v0.18.2
-	k8s.io/component-base v0.18.2
+	k8s.io/component-base v0.19.16 // replaced
 	k8s.io/klog v1.0.0
-	k8s.io/kubelet v0.17.3
+	k8s.io/kubelet v0.19.16
 	k8s.io/kubernetes v1.18.2
 	k8s.io/utils v0.0.0-20200324210504-a9aa75ae1b89
+	sigs.k8s.io/yaml v1.2.0
 )
 
+// k8s.io/kubelet v0.19 requires the versions of grpc, k8s.io/api,
+// k8s.io/apimachinery and k8s.io/component-base marked replaced above, so
+// minimal version selection keeps them listed there. Only the kubelet API is
+// updated, the versions below are the ones built with.
 replace (
+	google.golang.org/grpc => google.golang.org/grpc v1.26.0
 	k8s.io/api => k8s.io/api v0.18.2
 	k8s.io/apiextensions-apiserver => k8s.io/apiextensions-apiserver v0.18.2
 	k8s.io/apimachinery => k8s.io/apimachinery v0.18.3-beta.0
@@ -40,7 +47,7 @@ replace (
 	k8s.io/kube-proxy => k8s.io/kube-proxy v0.18.2
 	k8s.io/kube-scheduler => k8s.io/kube-scheduler v0.18.2
 	k8s.io/kubectl => k8s.io/kubectl v0.18.2
-	k8s.io/kubelet => k8s.io/kubelet v0.18.2
+	k8s.io/kubelet => k8s.io/kubelet v0.19.16
 	k8s.io/legacy-cloud-providers => k8s.io/legacy-cloud-providers v0.18.2
 	k8s.io/metrics => k8s.io/metrics v0.18.2
 	k8s.io/node-api => k8s.io/node-api v0.17.3
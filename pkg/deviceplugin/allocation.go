@@ -0,0 +1,263 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Names of built-in allocation policies.
+const (
+	NonePolicyName      = "none"
+	PackedPolicyName    = "packed"
+	BalancedPolicyName  = "balanced"
+	NUMALocalPolicyName = "numa"
+)
+
+// AllocationPolicy orders the candidate device IDs from the most preferred
+// to the least preferred one. The devices listed in mustInclude are already
+// picked and are never passed in candidates.
+type AllocationPolicy func(devices map[string]DeviceInfo, candidates, mustInclude []string) []string
+
+// NewAllocationPolicy returns a built-in allocation policy by its name.
+// For "none" it returns nil meaning kubelet is free to pick any devices.
+func NewAllocationPolicy(name string) (AllocationPolicy, error) {
+	switch name {
+	case NonePolicyName:
+		return nil, nil
+	case PackedPolicyName:
+		return PackedPolicy, nil
+	case BalancedPolicyName:
+		return BalancedPolicy, nil
+	case NUMALocalPolicyName:
+		return NUMALocalPolicy, nil
+	}
+
+	return nil, errors.Errorf("unknown allocation policy '%s'", name)
+}
+
+// PreferredAllocation builds a response to kubelet's preferred allocation
+// request using the given policy. The devices map must contain all
+// the devices referenced in the request. The IDs returned by the policy
+// that aren't candidates are ignored, and if it returns too few, the rest
+// are picked in the order of no policy.
+func PreferredAllocation(policy AllocationPolicy, devices map[string]DeviceInfo, rqt *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	response := new(pluginapi.PreferredAllocationResponse)
+
+	for _, crqt := range rqt.ContainerRequests {
+		size := int(crqt.AllocationSize)
+		if size > len(crqt.AvailableDeviceIDs) {
+			return nil, errors.Errorf("requested %d devices, but only %d available", size, len(crqt.AvailableDeviceIDs))
+		}
+		if len(crqt.MustIncludeDeviceIDs) > size {
+			return nil, errors.Errorf("requested %d devices, but %d must be included", size, len(crqt.MustIncludeDeviceIDs))
+		}
+
+		picked := make(map[string]bool)
+		ids := []string{}
+		for _, id := range crqt.MustIncludeDeviceIDs {
+			if _, ok := devices[id]; !ok {
+				return nil, errors.Errorf("unknown device %s", id)
+			}
+			picked[id] = true
+			ids = append(ids, id)
+		}
+
+		candidates := []string{}
+		isCandidate := make(map[string]bool)
+		for _, id := range crqt.AvailableDeviceIDs {
+			if _, ok := devices[id]; !ok {
+				return nil, errors.Errorf("unknown device %s", id)
+			}
+			if !picked[id] {
+				candidates = append(candidates, id)
+				isCandidate[id] = true
+			}
+		}
+		sort.Strings(candidates)
+
+		ordered := candidates
+		if policy != nil {
+			preferred := policy(devices, candidates, ids)
+			ordered = make([]string, 0, len(preferred)+len(candidates))
+			ordered = append(append(ordered, preferred...), candidates...)
+		}
+		for _, id := range ordered {
+			if len(ids) == size {
+				break
+			}
+			if isCandidate[id] && !picked[id] {
+				picked[id] = true
+				ids = append(ids, id)
+			}
+		}
+
+		response.ContainerResponses = append(response.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{
+			DeviceIDs: ids,
+		})
+	}
+
+	return response, nil
+}
+
+// PackedPolicy prefers devices sharing the same physical device with
+// already allocated devices so that the least possible number of
+// physical devices is in use.
+func PackedPolicy(devices map[string]DeviceInfo, candidates, mustInclude []string) []string {
+	groups, keys := groupDevices(devices, candidates, physicalDeviceKey)
+	picked := countGroups(devices, mustInclude, physicalDeviceKey)
+	total := countGroups(devices, allDeviceIDs(devices), physicalDeviceKey)
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		if picked[keys[i]] != picked[keys[j]] {
+			return picked[keys[i]] > picked[keys[j]]
+		}
+		usedI := total[keys[i]] - len(groups[keys[i]])
+		usedJ := total[keys[j]] - len(groups[keys[j]])
+		if usedI != usedJ {
+			return usedI > usedJ
+		}
+		return keys[i] < keys[j]
+	})
+
+	result := make([]string, 0, len(candidates))
+	for _, key := range keys {
+		result = append(result, groups[key]...)
+	}
+
+	return result
+}
+
+// BalancedPolicy spreads allocated devices evenly across physical devices
+// preferring the least loaded ones.
+func BalancedPolicy(devices map[string]DeviceInfo, candidates, mustInclude []string) []string {
+	groups, keys := groupDevices(devices, candidates, physicalDeviceKey)
+	picked := countGroups(devices, mustInclude, physicalDeviceKey)
+
+	result := make([]string, 0, len(candidates))
+	for len(result) < len(candidates) {
+		best := ""
+		for _, key := range keys {
+			if len(groups[key]) == 0 {
+				continue
+			}
+			if best == "" || picked[key] < picked[best] ||
+				(picked[key] == picked[best] && len(groups[key]) > len(groups[best])) {
+				best = key
+			}
+		}
+		result = append(result, groups[best][0])
+		groups[best] = groups[best][1:]
+		picked[best]++
+	}
+
+	return result
+}
+
+// NUMALocalPolicy prefers devices attached to the same NUMA nodes as
+// the devices that must be included, or to the NUMA nodes having
+// the most available devices otherwise.
+func NUMALocalPolicy(devices map[string]DeviceInfo, candidates, mustInclude []string) []string {
+	groups, keys := groupDevices(devices, candidates, numaKey)
+	picked := countGroups(devices, mustInclude, numaKey)
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		if picked[keys[i]] != picked[keys[j]] {
+			return picked[keys[i]] > picked[keys[j]]
+		}
+		if len(groups[keys[i]]) != len(groups[keys[j]]) {
+			return len(groups[keys[i]]) > len(groups[keys[j]])
+		}
+		return keys[i] < keys[j]
+	})
+
+	result := make([]string, 0, len(candidates))
+	for _, key := range keys {
+		result = append(result, groups[key]...)
+	}
+
+	return result
+}
+
+// physicalDeviceKey identifies the physical device behind a device ID
+// by the device nodes it exposes. IDs sharing the same device nodes
+// (e.g. with -shared-dev-num > 1) belong to the same physical device.
+func physicalDeviceKey(id string, info DeviceInfo) string {
+	if len(info.nodes) == 0 {
+		return id
+	}
+
+	paths := make([]string, len(info.nodes))
+	for i, node := range info.nodes {
+		paths[i] = node.HostPath
+	}
+	sort.Strings(paths)
+
+	return strings.Join(paths, ",")
+}
+
+// numaKey identifies the set of NUMA nodes a device is attached to.
+func numaKey(id string, info DeviceInfo) string {
+	if info.topology == nil {
+		return ""
+	}
+
+	nodes := make([]string, len(info.topology.Nodes))
+	for i, node := range info.topology.Nodes {
+		nodes[i] = strconv.FormatInt(node.ID, 10)
+	}
+
+	return strings.Join(nodes, ",")
+}
+
+// groupDevices splits the sorted device IDs into groups by the key function
+// and returns the groups along with their sorted keys.
+func groupDevices(devices map[string]DeviceInfo, ids []string, keyFunc func(string, DeviceInfo) string) (map[string][]string, []string) {
+	groups := make(map[string][]string)
+	keys := []string{}
+	for _, id := range ids {
+		key := keyFunc(id, devices[id])
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], id)
+	}
+	sort.Strings(keys)
+
+	return groups, keys
+}
+
+func countGroups(devices map[string]DeviceInfo, ids []string, keyFunc func(string, DeviceInfo) string) map[string]int {
+	counts := make(map[string]int)
+	for _, id := range ids {
+		counts[keyFunc(id, devices[id])]++
+	}
+
+	return counts
+}
+
+func allDeviceIDs(devices map[string]DeviceInfo) []string {
+	ids := make([]string, 0, len(devices))
+	for id := range devices {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
@@ -0,0 +1,214 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"reflect"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func newTestDeviceInfo(devNode string, numaNodes ...int64) DeviceInfo {
+	info := DeviceInfo{
+		state: pluginapi.Healthy,
+		nodes: []pluginapi.DeviceSpec{
+			{
+				HostPath:      devNode,
+				ContainerPath: devNode,
+				Permissions:   "rw",
+			},
+		},
+	}
+	if len(numaNodes) > 0 {
+		info.topology = &pluginapi.TopologyInfo{}
+		for _, id := range numaNodes {
+			info.topology.Nodes = append(info.topology.Nodes, &pluginapi.NUMANode{ID: id})
+		}
+	}
+
+	return info
+}
+
+func TestNewAllocationPolicy(t *testing.T) {
+	for _, name := range []string{NonePolicyName, PackedPolicyName, BalancedPolicyName, NUMALocalPolicyName} {
+		if _, err := NewAllocationPolicy(name); err != nil {
+			t.Errorf("unexpected error for policy '%s': %+v", name, err)
+		}
+	}
+	if _, err := NewAllocationPolicy("unknown"); err == nil {
+		t.Error("no error for unknown policy")
+	}
+}
+
+func TestPreferredAllocation(t *testing.T) {
+	// Two cards shared by two containers each.
+	sharedDevices := map[string]DeviceInfo{
+		"card0-0": newTestDeviceInfo("/dev/dri/card0", 0),
+		"card0-1": newTestDeviceInfo("/dev/dri/card0", 0),
+		"card1-0": newTestDeviceInfo("/dev/dri/card1", 1),
+		"card1-1": newTestDeviceInfo("/dev/dri/card1", 1),
+	}
+	// Three single cards on two NUMA nodes.
+	numaDevices := map[string]DeviceInfo{
+		"card0": newTestDeviceInfo("/dev/dri/card0", 0),
+		"card1": newTestDeviceInfo("/dev/dri/card1", 1),
+		"card2": newTestDeviceInfo("/dev/dri/card2", 1),
+	}
+
+	tcases := []struct {
+		name        string
+		policy      AllocationPolicy
+		devices     map[string]DeviceInfo
+		available   []string
+		mustInclude []string
+		size        int32
+		expectedIDs []string
+		expectedErr bool
+	}{
+		{
+			name:        "No policy",
+			devices:     sharedDevices,
+			available:   []string{"card1-1", "card0-1", "card0-0"},
+			size:        2,
+			expectedIDs: []string{"card0-0", "card0-1"},
+		},
+		{
+			name: "Policy returning too few devices",
+			policy: func(devices map[string]DeviceInfo, candidates, mustInclude []string) []string {
+				return []string{"card1-1", "card1-1", "card9-0"}
+			},
+			devices:     sharedDevices,
+			available:   []string{"card0-0", "card0-1", "card1-0", "card1-1"},
+			size:        3,
+			expectedIDs: []string{"card1-1", "card0-0", "card0-1"},
+		},
+		{
+			name: "Policy returning nothing",
+			policy: func(devices map[string]DeviceInfo, candidates, mustInclude []string) []string {
+				return nil
+			},
+			devices:     sharedDevices,
+			available:   []string{"card1-1", "card0-1", "card0-0"},
+			mustInclude: []string{"card1-1"},
+			size:        2,
+			expectedIDs: []string{"card1-1", "card0-0"},
+		},
+		{
+			name:        "Balanced policy spreads across cards",
+			policy:      BalancedPolicy,
+			devices:     sharedDevices,
+			available:   []string{"card0-0", "card0-1", "card1-0", "card1-1"},
+			size:        2,
+			expectedIDs: []string{"card0-0", "card1-0"},
+		},
+		{
+			name:        "Balanced policy prefers idle card",
+			policy:      BalancedPolicy,
+			devices:     sharedDevices,
+			available:   []string{"card0-1", "card1-0", "card1-1"},
+			size:        1,
+			expectedIDs: []string{"card1-0"},
+		},
+		{
+			name:        "Balanced policy with must include",
+			policy:      BalancedPolicy,
+			devices:     sharedDevices,
+			available:   []string{"card0-0", "card0-1", "card1-0", "card1-1"},
+			mustInclude: []string{"card1-1"},
+			size:        2,
+			expectedIDs: []string{"card1-1", "card0-0"},
+		},
+		{
+			name:        "Packed policy fills cards",
+			policy:      PackedPolicy,
+			devices:     sharedDevices,
+			available:   []string{"card0-0", "card0-1", "card1-0", "card1-1"},
+			size:        2,
+			expectedIDs: []string{"card0-0", "card0-1"},
+		},
+		{
+			name:        "Packed policy prefers busy card",
+			policy:      PackedPolicy,
+			devices:     sharedDevices,
+			available:   []string{"card0-0", "card0-1", "card1-1"},
+			size:        1,
+			expectedIDs: []string{"card1-1"},
+		},
+		{
+			name:        "NUMA policy keeps allocation on one node",
+			policy:      NUMALocalPolicy,
+			devices:     numaDevices,
+			available:   []string{"card0", "card1", "card2"},
+			size:        2,
+			expectedIDs: []string{"card1", "card2"},
+		},
+		{
+			name:        "NUMA policy follows must include",
+			policy:      NUMALocalPolicy,
+			devices:     numaDevices,
+			available:   []string{"card0", "card1", "card2"},
+			mustInclude: []string{"card2"},
+			size:        2,
+			expectedIDs: []string{"card2", "card1"},
+		},
+		{
+			name:        "Too many devices requested",
+			policy:      BalancedPolicy,
+			devices:     sharedDevices,
+			available:   []string{"card0-0"},
+			size:        2,
+			expectedErr: true,
+		},
+		{
+			name:        "Unknown device",
+			policy:      BalancedPolicy,
+			devices:     sharedDevices,
+			available:   []string{"card5-0"},
+			size:        1,
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tcases {
+		t.Run(tt.name, func(t *testing.T) {
+			rqt := &pluginapi.PreferredAllocationRequest{
+				ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+					{
+						AvailableDeviceIDs:   tt.available,
+						MustIncludeDeviceIDs: tt.mustInclude,
+						AllocationSize:       tt.size,
+					},
+				},
+			}
+			resp, err := PreferredAllocation(tt.policy, tt.devices, rqt)
+			if tt.expectedErr {
+				if err == nil {
+					t.Error("expected error, but got nothing")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if len(resp.ContainerResponses) != 1 {
+				t.Fatalf("expected 1 container response, but got %d", len(resp.ContainerResponses))
+			}
+			if !reflect.DeepEqual(resp.ContainerResponses[0].DeviceIDs, tt.expectedIDs) {
+				t.Errorf("expected %v, but got %v", tt.expectedIDs, resp.ContainerResponses[0].DeviceIDs)
+			}
+		})
+	}
+}
@@ -27,6 +27,13 @@ type DeviceInfo struct {
 	mounts   []pluginapi.Mount
 	envs     map[string]string
 	topology *pluginapi.TopologyInfo
+	// allocateEnvs are given to the containers only in the responses
+	// of Allocate(), so that PostAllocators can consume them. Unlike
+	// envs they're left out of CDI specs.
+	allocateEnvs map[string]string
+	// scannedType is the device type reported by Scanner if the resource
+	// map renamed it.
+	scannedType string
 }
 
 func init() {
@@ -56,6 +63,15 @@ func NewDeviceInfo(state string, nodes []pluginapi.DeviceSpec, mounts []pluginap
 	return deviceInfo
 }
 
+// WithAllocateEnvs returns a copy of the device info with envs given to the
+// containers only in the responses of Allocate(). They're meant for plugins
+// replacing them in PostAllocate() with envs depending on all the devices of
+// a container, so they aren't written to CDI specs.
+func (info DeviceInfo) WithAllocateEnvs(envs map[string]string) DeviceInfo {
+	info.allocateEnvs = envs
+	return info
+}
+
 // DeviceTree contains a tree-like structure of device type -> device ID -> device info.
 type DeviceTree map[string]map[string]DeviceInfo
 
@@ -84,10 +100,20 @@ type Notifier interface {
 type Scanner interface {
 	// Scan scans the host for devices and sends all found devices to
 	// a Notifier instance. It's called only once for every device plugin by
-	// Manager in a goroutine and operates in an infinite loop.
+	// Manager in a goroutine and operates in an infinite loop until it's
+	// stopped with ScanStopper. Scanners not implementing ScanStopper are
+	// ended by their first Notifier.Notify() call after Manager stops, so
+	// they must call it from the goroutine running Scan().
 	Scan(Notifier) error
 }
 
+// ScanStopper is an optional interface implemented by device plugins.
+type ScanStopper interface {
+	// StopScan makes Scan() return as soon as possible. It's called by
+	// Manager when it shuts down.
+	StopScan()
+}
+
 // PostAllocator is an optional interface implemented by device plugins.
 type PostAllocator interface {
 	// PostAllocate modifies responses returned by Allocate() by e.g.
@@ -101,3 +127,37 @@ type ContainerPreStarter interface {
 	// It might include operations like card reset.
 	PreStartContainer(*pluginapi.PreStartContainerRequest) error
 }
+
+// The optional interfaces below get device types as reported by Scanner,
+// before the resource map renames them.
+
+// PreferredAllocator is an optional interface implemented by device plugins.
+type PreferredAllocator interface {
+	// AllocationPolicy returns the policy ordering the devices of the given
+	// type preferred for allocating next. The policy is applied to the devices
+	// last sent to kubelet. Returning nil keeps the devices ordered by their IDs.
+	// Device types merged by the resource map get the policy of the first of
+	// them in alphabetical order.
+	AllocationPolicy(devType string, rqt *pluginapi.PreferredAllocationRequest) AllocationPolicy
+}
+
+// DevicePluginOptionsProvider is an optional interface implemented by device plugins.
+type DevicePluginOptionsProvider interface {
+	// GetDevicePluginOptions returns the options reported to kubelet for
+	// the given device type, e.g. to require PreStartContainer() only for
+	// some device types. Options needing optional interfaces the plugin
+	// doesn't implement are ignored. Returning nil enables all the options
+	// supported by the plugin. Device types merged by the resource map get
+	// the options enabled for any of them.
+	GetDevicePluginOptions(devType string) *pluginapi.DevicePluginOptions
+}
+
+// HealthChecker is an optional interface implemented by device plugins.
+type HealthChecker interface {
+	// CheckHealth returns the health state of the given device, either
+	// pluginapi.Healthy or pluginapi.Unhealthy, and the reason of the state.
+	// It's called by Manager periodically and whenever the device gets
+	// updated by Scanner, so it should be cheap. A device reported unhealthy
+	// by Scanner stays unhealthy regardless of the result.
+	CheckHealth(devType, id string, info DeviceInfo) (health string, reason string)
+}
@@ -0,0 +1,313 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// auditStdout is the audit log path writing to the standard output.
+	auditStdout = "-"
+	// redactedValue replaces redacted environment variable values.
+	redactedValue = "REDACTED"
+
+	auditAllocate          = "Allocate"
+	auditPreStartContainer = "PreStartContainer"
+)
+
+// Audit log settings shared by all device plugins built with this package.
+var (
+	auditLogPath       string
+	auditLogMaxSize    int
+	auditLogMaxBackups int
+	auditLogRedactEnvs string
+)
+
+var (
+	// auditor is the audit log of the process, nil if disabled.
+	auditor     *auditLog
+	auditorErr  error
+	auditorOnce sync.Once
+)
+
+func init() {
+	flag.StringVar(&auditLogPath, "audit-log", "",
+		"file to log every Allocate() and PreStartContainer() call to as JSON lines, '"+auditStdout+"' for the standard output (disabled if empty)")
+	flag.IntVar(&auditLogMaxSize, "audit-log-max-size", 100,
+		"size in megabytes the audit log file is rotated at (no rotation if 0)")
+	flag.IntVar(&auditLogMaxBackups, "audit-log-max-backups", 3,
+		"number of rotated audit log files to keep")
+	flag.StringVar(&auditLogRedactEnvs, "audit-log-redact-envs", "",
+		"regular expression matching the names of environment variables whose values aren't written to the audit log")
+}
+
+// auditContainer describes the devices requested for one container and
+// the response returned to kubelet.
+type auditContainer struct {
+	DeviceIDs   []string                `json:"deviceIDs"`
+	Devices     []*pluginapi.DeviceSpec `json:"devices,omitempty"`
+	Mounts      []*pluginapi.Mount      `json:"mounts,omitempty"`
+	Envs        map[string]string       `json:"envs,omitempty"`
+	Annotations map[string]string       `json:"annotations,omitempty"`
+	// Containers the devices are allocated to as known by Ledger when
+	// PreStartContainer() is called. Not set for Allocate() as kubelet
+	// records allocations only after Allocate() returns.
+	Pods []Allocation `json:"pods,omitempty"`
+}
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time       time.Time        `json:"time"`
+	Call       string           `json:"call"`
+	Resource   string           `json:"resource"`
+	Containers []auditContainer `json:"containers"`
+	Duration   float64          `json:"durationSeconds"`
+	Error      string           `json:"error,omitempty"`
+}
+
+// auditLog writes auditRecords to a file rotated by size or to stdout.
+type auditLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	redactEnvs *regexp.Regexp
+	ledger     *Ledger
+
+	out   io.Writer
+	file  *os.File
+	size  int64
+	mutex sync.Mutex
+}
+
+// openAuditLog opens the audit log configured with the command line options
+// once per process. The given Ledger, if any, provides the pod info.
+func openAuditLog(ledger *Ledger) error {
+	auditorOnce.Do(func() {
+		if auditLogPath == "" {
+			return
+		}
+		auditor, auditorErr = newAuditLog(auditLogPath, int64(auditLogMaxSize)<<20, auditLogMaxBackups, auditLogRedactEnvs)
+		if auditor != nil {
+			auditor.ledger = ledger
+		}
+	})
+
+	return auditorErr
+}
+
+func newAuditLog(path string, maxSize int64, maxBackups int, redactEnvs string) (*auditLog, error) {
+	a := &auditLog{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if redactEnvs != "" {
+		var err error
+		if a.redactEnvs, err = regexp.Compile(redactEnvs); err != nil {
+			return nil, errors.Wrapf(err, "Invalid audit log redaction regexp %q", redactEnvs)
+		}
+	}
+
+	if path == auditStdout {
+		a.out = os.Stdout
+		return a, nil
+	}
+
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to open audit log %s", a.path)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrapf(err, "Failed to stat audit log %s", a.path)
+	}
+
+	a.file = file
+	a.out = file
+	a.size = info.Size()
+	return nil
+}
+
+// rotate renames the audit log file to <path>.1, shifting the older
+// backups, and opens a new file. Without backups the file is truncated
+// instead. The old file is closed only after the new one is opened: if
+// opening fails, the records go to <path>.1 until it's full again and
+// the rotation is retried.
+func (a *auditLog) rotate() error {
+	if a.maxBackups < 1 {
+		if err := a.file.Truncate(0); err != nil {
+			return errors.Wrapf(err, "Failed to truncate audit log %s", a.path)
+		}
+		a.size = 0
+		return nil
+	}
+
+	for i := a.maxBackups - 1; i > 0; i-- {
+		backup := fmt.Sprintf("%s.%d", a.path, i)
+		if err := os.Rename(backup, fmt.Sprintf("%s.%d", a.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Failed to rotate audit log %s", backup)
+		}
+	}
+	// The file is missing if opening it failed in the last rotation.
+	if err := os.Rename(a.path, a.path+".1"); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Failed to rotate audit log %s", a.path)
+	}
+
+	old := a.file
+	if err := a.open(); err != nil {
+		a.size = 0
+		return err
+	}
+
+	return errors.Wrapf(old.Close(), "Failed to close audit log %s", a.path+".1")
+}
+
+func (a *auditLog) write(record *auditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode audit record")
+	}
+	data = append(data, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// The record is written even if the rotation fails.
+	var rotateErr error
+	if a.file != nil && a.maxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.maxSize {
+		rotateErr = a.rotate()
+	}
+
+	n, err := a.out.Write(data)
+	a.size += int64(n)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write audit log %s", a.path)
+	}
+
+	return rotateErr
+}
+
+func (a *auditLog) redact(envs map[string]string) map[string]string {
+	if a.redactEnvs == nil || len(envs) == 0 {
+		return envs
+	}
+
+	redacted := make(map[string]string, len(envs))
+	for name, value := range envs {
+		if a.redactEnvs.MatchString(name) {
+			value = redactedValue
+		}
+		redacted[name] = value
+	}
+
+	return redacted
+}
+
+func (a *auditLog) pods(resourceName string, ids []string) []Allocation {
+	if a.ledger == nil {
+		return nil
+	}
+
+	var pods []Allocation
+	for _, id := range ids {
+		pods = append(pods, a.ledger.Lookup(resourceName, id)...)
+	}
+
+	return pods
+}
+
+// allocate records an Allocate() call started at the given time.
+func (a *auditLog) allocate(resourceName string, start time.Time, rqt *pluginapi.AllocateRequest, resp *pluginapi.AllocateResponse, err error) {
+	if a == nil {
+		return
+	}
+
+	record := newAuditRecord(auditAllocate, resourceName, start, err)
+	for i, crqt := range rqt.ContainerRequests {
+		container := auditContainer{
+			DeviceIDs: crqt.DevicesIDs,
+		}
+		// The response is nil on errors.
+		if resp != nil && i < len(resp.ContainerResponses) {
+			cresp := resp.ContainerResponses[i]
+			container.Devices = cresp.Devices
+			container.Mounts = cresp.Mounts
+			container.Envs = a.redact(cresp.Envs)
+			container.Annotations = cresp.Annotations
+		}
+		record.Containers = append(record.Containers, container)
+	}
+
+	a.log(record)
+}
+
+// preStartContainer records a PreStartContainer() call started at the given time.
+func (a *auditLog) preStartContainer(resourceName string, start time.Time, rqt *pluginapi.PreStartContainerRequest, err error) {
+	if a == nil {
+		return
+	}
+
+	record := newAuditRecord(auditPreStartContainer, resourceName, start, err)
+	record.Containers = []auditContainer{{
+		DeviceIDs: rqt.DevicesIDs,
+		Pods:      a.pods(resourceName, rqt.DevicesIDs),
+	}}
+
+	a.log(record)
+}
+
+func (a *auditLog) log(record *auditRecord) {
+	// Failing calls because of the audit log would make things only worse.
+	if err := a.write(record); err != nil {
+		klog.Errorf("Audit log failure: %+v", err)
+	}
+}
+
+func newAuditRecord(call, resourceName string, start time.Time, err error) *auditRecord {
+	record := &auditRecord{
+		Time:     start.UTC(),
+		Call:     call,
+		Resource: resourceName,
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	return record
+}
@@ -0,0 +1,213 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func readAuditRecords(t *testing.T, file string) []auditRecord {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("unable to read audit log: %+v", err)
+	}
+
+	records := []auditRecord{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record auditRecord
+		if err = json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid audit record %q: %+v", line, err)
+		}
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "auditlog")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	file := path.Join(tmpdir, "audit.log")
+	audit, err := newAuditLog(file, 0, 0, "^SECRET")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	audit.ledger = NewLedger("")
+	audit.ledger.allocations["intel.com/testtype"] = map[string][]Allocation{
+		"dev1": {{Namespace: "default", Pod: "pod1", Container: "ctr1"}},
+	}
+
+	srv := &server{
+		devType:   "testtype",
+		namespace: "intel.com",
+		devices: map[string]DeviceInfo{
+			"dev1": {
+				state: pluginapi.Healthy,
+				nodes: []pluginapi.DeviceSpec{{HostPath: "/dev/dev1", ContainerPath: "/dev/dev1", Permissions: "rw"}},
+				envs:  map[string]string{"SECRET_KEY": "value", "DEVICE": "dev1"},
+			},
+		},
+		preStartContainer: func(*pluginapi.PreStartContainerRequest) error {
+			return errors.New("fake error")
+		},
+		audit: audit,
+	}
+
+	for _, id := range []string{"dev1", "dev2"} {
+		srv.Allocate(nil, &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{id}}},
+		})
+	}
+	srv.PreStartContainer(nil, &pluginapi.PreStartContainerRequest{DevicesIDs: []string{"dev1"}})
+
+	records := readAuditRecords(t, file)
+	if len(records) != 3 {
+		t.Fatalf("expected 3 audit records, but got %d", len(records))
+	}
+
+	allocated := records[0]
+	if allocated.Call != auditAllocate || allocated.Resource != "intel.com/testtype" || allocated.Error != "" {
+		t.Errorf("unexpected audit record %+v", allocated)
+	}
+	expected := auditContainer{
+		DeviceIDs: []string{"dev1"},
+		Devices:   []*pluginapi.DeviceSpec{{HostPath: "/dev/dev1", ContainerPath: "/dev/dev1", Permissions: "rw"}},
+		Envs:      map[string]string{"SECRET_KEY": redactedValue, "DEVICE": "dev1"},
+	}
+	if len(allocated.Containers) != 1 || !reflect.DeepEqual(allocated.Containers[0], expected) {
+		t.Errorf("expected audited container %+v, but got %+v", expected, allocated.Containers)
+	}
+
+	if failed := records[1]; failed.Error == "" || len(failed.Containers) != 1 || failed.Containers[0].Devices != nil {
+		t.Errorf("expected audited failure, but got %+v", failed)
+	}
+	preStarted := records[2]
+	if preStarted.Call != auditPreStartContainer || preStarted.Error != "fake error" {
+		t.Errorf("unexpected audit record %+v", preStarted)
+	}
+	pods := []Allocation{{Namespace: "default", Pod: "pod1", Container: "ctr1"}}
+	if len(preStarted.Containers) != 1 || !reflect.DeepEqual(preStarted.Containers[0].Pods, pods) {
+		t.Errorf("expected pods %+v, but got %+v", pods, preStarted.Containers)
+	}
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "auditlog")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	file := path.Join(tmpdir, "audit.log")
+	// Every record gets its own file.
+	audit, err := newAuditLog(file, 1, 2, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	for _, resource := range []string{"res1", "res2", "res3", "res4"} {
+		audit.log(&auditRecord{Resource: resource})
+	}
+
+	for file, resource := range map[string]string{file: "res4", file + ".1": "res3", file + ".2": "res2"} {
+		records := readAuditRecords(t, file)
+		if len(records) != 1 || records[0].Resource != resource {
+			t.Errorf("expected %s in %s, but got %+v", resource, file, records)
+		}
+	}
+	if _, err = os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Error("too many audit log backups kept")
+	}
+}
+
+func TestAuditLogRotateWithoutBackups(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "auditlog")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	file := path.Join(tmpdir, "audit.log")
+	audit, err := newAuditLog(file, 1, 0, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	for _, resource := range []string{"res1", "res2"} {
+		audit.log(&auditRecord{Resource: resource})
+	}
+
+	if records := readAuditRecords(t, file); len(records) != 1 || records[0].Resource != "res2" {
+		t.Errorf("expected res2 in %s, but got %+v", file, records)
+	}
+	if _, err = os.Stat(file + ".1"); !os.IsNotExist(err) {
+		t.Error("audit log backup kept without backups")
+	}
+}
+
+func TestAuditLogRotateFailure(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "auditlog")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	file := path.Join(tmpdir, "audit.log")
+	audit, err := newAuditLog(file, 1, 2, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err = audit.write(&auditRecord{Resource: "res1"}); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	// The new file can't be opened in a missing directory.
+	audit.path = path.Join(tmpdir, "missing", "audit.log")
+	if err = audit.write(&auditRecord{Resource: "res2"}); err == nil {
+		t.Error("expected rotation error, but got nothing")
+	}
+
+	// The old file is kept open and gets the records.
+	if records := readAuditRecords(t, file); len(records) != 2 || records[1].Resource != "res2" {
+		t.Errorf("expected res1 and res2 in %s, but got %+v", file, records)
+	}
+}
+
+func TestNewAuditLog(t *testing.T) {
+	if _, err := newAuditLog(auditStdout, 0, 0, "invalid["); err == nil {
+		t.Error("expected error for invalid regexp, but got success")
+	}
+	if _, err := newAuditLog("/nonexistent/audit.log", 0, 0, ""); err == nil {
+		t.Error("expected error for invalid path, but got success")
+	}
+
+	var audit *auditLog
+	// Disabled audit log is a no-op.
+	audit.allocate("intel.com/testtype", time.Now(), &pluginapi.AllocateRequest{}, nil, nil)
+}
@@ -0,0 +1,209 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// Version of the Container Device Interface specification the generated specs conform to.
+	cdiVersion = "0.5.0"
+	// Prefix of container annotations requesting CDI devices from container runtimes.
+	cdiAnnotationPrefix = "cdi.k8s.io/"
+	// Maximum length of the name part of an annotation key.
+	maxAnnotationNameLen = 63
+)
+
+var (
+	// cdiSpecDir is shared by all device plugins built with this package.
+	cdiSpecDir string
+
+	// Characters not allowed in CDI class names and annotation names.
+	cdiInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+)
+
+func init() {
+	flag.StringVar(&cdiSpecDir, "cdi-spec-dir", "",
+		"directory to write Container Device Interface specs to, e.g. '/var/run/cdi' (disabled if empty)")
+}
+
+// cdiSpec is a Container Device Interface spec for one device type.
+type cdiSpec struct {
+	Version string      `json:"cdiVersion"`
+	Kind    string      `json:"kind"`
+	Devices []cdiDevice `json:"devices"`
+}
+
+type cdiDevice struct {
+	Name           string            `json:"name"`
+	ContainerEdits cdiContainerEdits `json:"containerEdits"`
+}
+
+type cdiContainerEdits struct {
+	Env         []string        `json:"env,omitempty"`
+	DeviceNodes []cdiDeviceNode `json:"deviceNodes,omitempty"`
+	Mounts      []cdiMount      `json:"mounts,omitempty"`
+}
+
+type cdiDeviceNode struct {
+	Path        string `json:"path"`
+	HostPath    string `json:"hostPath,omitempty"`
+	Permissions string `json:"permissions,omitempty"`
+}
+
+type cdiMount struct {
+	HostPath      string   `json:"hostPath"`
+	ContainerPath string   `json:"containerPath"`
+	Options       []string `json:"options,omitempty"`
+}
+
+// cdiKind returns the CDI kind ("vendor/class") of the given device type.
+func cdiKind(namespace, devType string) string {
+	return namespace + "/" + cdiInvalidChars.ReplaceAllString(devType, "_")
+}
+
+// cdiDeviceName returns the fully qualified CDI name of the given device.
+func cdiDeviceName(namespace, devType, id string) string {
+	return cdiKind(namespace, devType) + "=" + id
+}
+
+func cdiSpecPath(dir, namespace, devType string) string {
+	return filepath.Join(dir, strings.Replace(cdiKind(namespace, devType), "/", "-", 1)+".json")
+}
+
+func newCDISpec(namespace, devType string, devices map[string]DeviceInfo) *cdiSpec {
+	spec := &cdiSpec{
+		Version: cdiVersion,
+		Kind:    cdiKind(namespace, devType),
+		Devices: []cdiDevice{},
+	}
+
+	ids := make([]string, 0, len(devices))
+	for id := range devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		dev := devices[id]
+		edits := cdiContainerEdits{}
+		for _, node := range dev.nodes {
+			edits.DeviceNodes = append(edits.DeviceNodes, cdiDeviceNode{
+				Path:        node.ContainerPath,
+				HostPath:    node.HostPath,
+				Permissions: node.Permissions,
+			})
+		}
+		for _, mount := range dev.mounts {
+			options := []string{"rbind"}
+			if mount.ReadOnly {
+				options = append(options, "ro")
+			}
+			edits.Mounts = append(edits.Mounts, cdiMount{
+				HostPath:      mount.HostPath,
+				ContainerPath: mount.ContainerPath,
+				Options:       options,
+			})
+		}
+		for key, value := range dev.envs {
+			edits.Env = append(edits.Env, key+"="+value)
+		}
+		sort.Strings(edits.Env)
+
+		spec.Devices = append(spec.Devices, cdiDevice{
+			Name:           id,
+			ContainerEdits: edits,
+		})
+	}
+
+	return spec
+}
+
+// writeCDISpec writes the CDI spec of the given device type to the given
+// directory replacing the previous version of the spec atomically.
+func writeCDISpec(dir, namespace, devType string, devices map[string]DeviceInfo) error {
+	data, err := json.MarshalIndent(newCDISpec(namespace, devType, devices), "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal CDI spec")
+	}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "Failed to create %s", dir)
+	}
+
+	specPath := cdiSpecPath(dir, namespace, devType)
+	tmpFile, err := ioutil.TempFile(dir, ".tmp-"+filepath.Base(specPath))
+	if err != nil {
+		return errors.Wrap(err, "Failed to create temporary CDI spec")
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write %s", tmpFile.Name())
+	}
+	if err = os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return errors.Wrapf(err, "Failed to change mode of %s", tmpFile.Name())
+	}
+
+	return errors.Wrapf(os.Rename(tmpFile.Name(), specPath), "Failed to write %s", specPath)
+}
+
+// removeCDISpec removes the CDI spec of the given device type.
+func removeCDISpec(dir, namespace, devType string) error {
+	specPath := cdiSpecPath(dir, namespace, devType)
+	if err := os.Remove(specPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Failed to remove %s", specPath)
+	}
+
+	return nil
+}
+
+// addCDIAnnotation adds the annotation requesting the given CDI devices
+// from container runtime to the container response.
+func addCDIAnnotation(cresp *pluginapi.ContainerAllocateResponse, namespace, devType string, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		names = append(names, cdiDeviceName(namespace, devType, id))
+	}
+
+	key := cdiInvalidChars.ReplaceAllString(namespace+"_"+devType, "_")
+	if len(key) > maxAnnotationNameLen {
+		key = key[:maxAnnotationNameLen]
+	}
+
+	if cresp.Annotations == nil {
+		cresp.Annotations = make(map[string]string)
+	}
+	cresp.Annotations[cdiAnnotationPrefix+key] = strings.Join(names, ",")
+}
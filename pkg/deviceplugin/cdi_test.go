@@ -0,0 +1,177 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func readCDISpec(t *testing.T, path string) *cdiSpec {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read CDI spec: %+v", err)
+	}
+
+	spec := &cdiSpec{}
+	if err = json.Unmarshal(data, spec); err != nil {
+		t.Fatalf("failed to parse CDI spec: %+v", err)
+	}
+
+	return spec
+}
+
+func TestWriteCDISpec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cdi")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	devices := map[string]DeviceInfo{
+		"card1": {
+			state: pluginapi.Healthy,
+			nodes: []pluginapi.DeviceSpec{
+				{HostPath: "/dev/dri/card1", ContainerPath: "/dev/dri/card1", Permissions: "rw"},
+			},
+			mounts: []pluginapi.Mount{
+				{HostPath: "/sys/foo", ContainerPath: "/sys/bar", ReadOnly: true},
+			},
+			envs:         map[string]string{"B": "2", "A": "1"},
+			allocateEnvs: map[string]string{"C": "3"},
+		},
+		"card0": {
+			state: pluginapi.Healthy,
+		},
+	}
+
+	if err = writeCDISpec(dir, "gpu.intel.com", "i915.shared", devices); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	specPath := filepath.Join(dir, "gpu.intel.com-i915_shared.json")
+	expected := &cdiSpec{
+		Version: cdiVersion,
+		Kind:    "gpu.intel.com/i915_shared",
+		Devices: []cdiDevice{
+			{
+				Name: "card0",
+			},
+			{
+				Name: "card1",
+				ContainerEdits: cdiContainerEdits{
+					Env: []string{"A=1", "B=2"},
+					DeviceNodes: []cdiDeviceNode{
+						{Path: "/dev/dri/card1", HostPath: "/dev/dri/card1", Permissions: "rw"},
+					},
+					Mounts: []cdiMount{
+						{HostPath: "/sys/foo", ContainerPath: "/sys/bar", Options: []string{"rbind", "ro"}},
+					},
+				},
+			},
+		},
+	}
+	if spec := readCDISpec(t, specPath); !reflect.DeepEqual(spec, expected) {
+		t.Errorf("expected %+v, but got %+v", expected, spec)
+	}
+
+	if err = writeCDISpec(dir, "gpu.intel.com", "i915.shared", map[string]DeviceInfo{}); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if spec := readCDISpec(t, specPath); len(spec.Devices) != 0 {
+		t.Errorf("expected updated spec with no devices, but got %d", len(spec.Devices))
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected only the spec in %s, but got %d files", dir, len(files))
+	}
+
+	if err = removeCDISpec(dir, "gpu.intel.com", "i915.shared"); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if _, err = os.Stat(specPath); !os.IsNotExist(err) {
+		t.Error("CDI spec hasn't been removed")
+	}
+	if err = removeCDISpec(dir, "gpu.intel.com", "i915.shared"); err != nil {
+		t.Errorf("unexpected error when removing missing spec: %+v", err)
+	}
+}
+
+func TestAddCDIAnnotation(t *testing.T) {
+	cresp := &pluginapi.ContainerAllocateResponse{}
+
+	addCDIAnnotation(cresp, "gpu.intel.com", "i915", nil)
+	if cresp.Annotations != nil {
+		t.Error("unexpected annotations for no devices")
+	}
+
+	addCDIAnnotation(cresp, "gpu.intel.com", "i915", []string{"card0", "card1"})
+	expected := map[string]string{
+		"cdi.k8s.io/gpu_intel_com_i915": "gpu.intel.com/i915=card0,gpu.intel.com/i915=card1",
+	}
+	if !reflect.DeepEqual(cresp.Annotations, expected) {
+		t.Errorf("expected %v, but got %v", expected, cresp.Annotations)
+	}
+
+	cresp = &pluginapi.ContainerAllocateResponse{}
+	addCDIAnnotation(cresp, "fpga.intel.com", "af-695.d84.aVKNtusxV3qMNmj5-qCB9thCTcSko8QT-J5DNoP5BAs", []string{"port0"})
+	for key := range cresp.Annotations {
+		if len(key) > len(cdiAnnotationPrefix)+maxAnnotationNameLen {
+			t.Errorf("too long annotation key %s", key)
+		}
+	}
+}
+
+func TestManagerCDISpecs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cdi")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cdiSpecDir = dir
+	defer func() { cdiSpecDir = "" }()
+
+	mgr := NewManager("testnamespace", &devicePluginStub{})
+	mgr.createServer = func(string, func(*pluginapi.AllocateResponse) error, func(*pluginapi.PreStartContainerRequest) error,
+		func(*pluginapi.PreferredAllocationRequest) AllocationPolicy, *pluginapi.DevicePluginOptions) devicePluginServer {
+		return &serverStub{}
+	}
+
+	tree := NewDeviceTree()
+	tree.AddDevice("testdevice", "dev1", DeviceInfo{state: pluginapi.Healthy})
+	mgr.handleUpdate(updateInfo{Added: tree})
+
+	specPath := filepath.Join(dir, "testnamespace-testdevice.json")
+	if spec := readCDISpec(t, specPath); len(spec.Devices) != 1 {
+		t.Errorf("expected 1 device in CDI spec, but got %d", len(spec.Devices))
+	}
+
+	tree.AddDevice("testdevice", "dev2", DeviceInfo{state: pluginapi.Healthy})
+	mgr.handleUpdate(updateInfo{Updated: tree})
+	if spec := readCDISpec(t, specPath); len(spec.Devices) != 2 {
+		t.Errorf("expected 2 devices in CDI spec, but got %d", len(spec.Devices))
+	}
+
+	mgr.handleUpdate(updateInfo{Removed: tree})
+	if _, err = os.Stat(specPath); !os.IsNotExist(err) {
+		t.Error("CDI spec hasn't been removed")
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+// ConfigValidator is an optional interface implemented by plugin configurations.
+type ConfigValidator interface {
+	// Validate checks the configuration is consistent and usable.
+	Validate() error
+}
+
+// LoadConfig reads the YAML configuration file at the given path into config,
+// which is a pointer to a struct with JSON field tags. Unknown fields are
+// rejected. If config implements ConfigValidator, it's validated as well.
+func LoadConfig(path string, config interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read configuration %s", path)
+	}
+
+	return parseConfig(path, data, config)
+}
+
+func parseConfig(path string, data []byte, config interface{}) error {
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return errors.Wrapf(err, "Failed to parse configuration %s", path)
+	}
+
+	if validator, ok := config.(ConfigValidator); ok {
+		if err := validator.Validate(); err != nil {
+			return errors.Wrapf(err, "Invalid configuration %s", path)
+		}
+	}
+
+	return nil
+}
+
+// ConfigWatcher keeps a plugin configuration loaded from a YAML file up to
+// date. It's suitable for files mounted from ConfigMaps.
+type ConfigWatcher struct {
+	path      string
+	newConfig func() interface{}
+	fsWatcher *fsnotify.Watcher
+	changesCh chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	// Last loaded file contents and the valid configuration.
+	data   []byte
+	config interface{}
+	mutex  sync.Mutex
+}
+
+// NewConfigWatcher loads the configuration file at the given path and starts
+// watching it for changes. The newConfig function returns a pointer to a new
+// configuration struct filled in with default values, the file is loaded on
+// top of them.
+func NewConfigWatcher(path string, newConfig func() interface{}) (*ConfigWatcher, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read configuration %s", path)
+	}
+
+	config := newConfig()
+	if err = parseConfig(path, data, config); err != nil {
+		return nil, err
+	}
+
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create file system watcher")
+	}
+
+	// ConfigMap volumes are updated by swapping a symlink, so the whole
+	// directory is watched rather than the file itself.
+	if err = fsWatcher.Add(filepath.Dir(path)); err != nil {
+		fsWatcher.Close()
+		return nil, errors.Wrapf(err, "Failed to add %s to watcher", filepath.Dir(path))
+	}
+
+	w := &ConfigWatcher{
+		path:      path,
+		newConfig: newConfig,
+		fsWatcher: fsWatcher,
+		changesCh: make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		data:      data,
+		config:    config,
+	}
+
+	w.wg.Add(1)
+	go w.run()
+
+	return w, nil
+}
+
+// Config returns the last valid configuration.
+func (w *ConfigWatcher) Config() interface{} {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.config
+}
+
+// Changes returns a channel receiving a value whenever a new valid
+// configuration is loaded. Changes happening before the previous one is
+// consumed are coalesced into one.
+func (w *ConfigWatcher) Changes() <-chan struct{} {
+	return w.changesCh
+}
+
+// Close stops watching.
+func (w *ConfigWatcher) Close() error {
+	var err error
+
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = errors.WithStack(w.fsWatcher.Close())
+		w.wg.Wait()
+	})
+
+	return err
+}
+
+func (w *ConfigWatcher) run() {
+	defer w.wg.Done()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case _, ok := <-w.fsWatcher.Events:
+			if ok {
+				w.reload()
+			}
+		case err, ok := <-w.fsWatcher.Errors:
+			if ok {
+				klog.Warningf("Configuration watcher error: %+v", err)
+			}
+		}
+	}
+}
+
+// reload loads the configuration file if its contents changed. Invalid
+// configurations are rejected and the last valid one is kept.
+func (w *ConfigWatcher) reload() {
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		// The file may be missing for a moment while it's being replaced.
+		klog.V(4).Infof("Can't read configuration %s: %v", w.path, err)
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if bytes.Equal(data, w.data) {
+		return
+	}
+	w.data = data
+
+	config := w.newConfig()
+	if err = parseConfig(w.path, data, config); err != nil {
+		klog.Errorf("Rejected new configuration, keeping the previous one: %+v", err)
+		configReloadsCounter.WithLabelValues(configReloadFailure).Inc()
+		return
+	}
+
+	klog.V(1).Infof("Loaded new configuration from %s", w.path)
+	configReloadsCounter.WithLabelValues(configReloadSuccess).Inc()
+	w.config = config
+
+	select {
+	case w.changesCh <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type testConfig struct {
+	Devices int    `json:"devices"`
+	Mode    string `json:"mode"`
+}
+
+func (c *testConfig) Validate() error {
+	if c.Devices < 1 {
+		return errors.Errorf("devices must be greater than zero, got %d", c.Devices)
+	}
+
+	return nil
+}
+
+func newTestConfig() interface{} {
+	return &testConfig{Devices: 1, Mode: "default"}
+}
+
+// writeFileAtomic replaces the file like kubelet replaces ConfigMap volumes.
+func writeFileAtomic(t *testing.T, file, content string) {
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		t.Fatalf("unable to write %s: %+v", tmp, err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		t.Fatalf("unable to rename %s: %+v", tmp, err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	tcases := []struct {
+		name        string
+		content     string
+		expected    testConfig
+		expectedErr bool
+	}{
+		{
+			name:     "Defaults",
+			content:  "",
+			expected: testConfig{Devices: 1, Mode: "default"},
+		},
+		{
+			name:     "Valid config",
+			content:  "devices: 2\nmode: fast\n",
+			expected: testConfig{Devices: 2, Mode: "fast"},
+		},
+		{
+			name:        "Unknown field",
+			content:     "devicez: 2\n",
+			expectedErr: true,
+		},
+		{
+			name:        "Wrong type",
+			content:     "devices: many\n",
+			expectedErr: true,
+		},
+		{
+			name:        "Invalid value",
+			content:     "devices: 0\n",
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tcases {
+		t.Run(tt.name, func(t *testing.T) {
+			file := path.Join(tmpdir, "config.yaml")
+			writeFileAtomic(t, file, tt.content)
+
+			config := newTestConfig().(*testConfig)
+			err := LoadConfig(file, config)
+			if tt.expectedErr {
+				if err == nil {
+					t.Error("expected error, but got nothing")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if *config != tt.expected {
+				t.Errorf("expected %+v, but got %+v", tt.expected, *config)
+			}
+		})
+	}
+
+	if err = LoadConfig(path.Join(tmpdir, "nonexistent.yaml"), newTestConfig()); err == nil {
+		t.Error("expected error for missing file, but got nothing")
+	}
+}
+
+func waitForChange(w *ConfigWatcher) bool {
+	select {
+	case <-w.Changes():
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestConfigWatcher(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	file := path.Join(tmpdir, "config.yaml")
+	writeFileAtomic(t, file, "devices: 0\n")
+	if _, err = NewConfigWatcher(file, newTestConfig); err == nil {
+		t.Error("expected error for invalid initial configuration, but got nothing")
+	}
+
+	writeFileAtomic(t, file, "devices: 2\n")
+	w, err := NewConfigWatcher(file, newTestConfig)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer w.Close()
+
+	if config := w.Config().(*testConfig); config.Devices != 2 {
+		t.Errorf("expected 2 devices, but got %d", config.Devices)
+	}
+
+	writeFileAtomic(t, file, "devices: 3\n")
+	if !waitForChange(w) {
+		t.Fatal("no change after valid update")
+	}
+	if config := w.Config().(*testConfig); config.Devices != 3 {
+		t.Errorf("expected 3 devices, but got %d", config.Devices)
+	}
+
+	writeFileAtomic(t, file, "devices: -1\n")
+	if waitForChange(w) {
+		t.Error("change after invalid update")
+	}
+	if config := w.Config().(*testConfig); config.Devices != 3 {
+		t.Errorf("expected previous configuration to be kept, but got %d devices", config.Devices)
+	}
+
+	if err = w.Close(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
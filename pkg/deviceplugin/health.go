@@ -0,0 +1,99 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"time"
+
+	"k8s.io/klog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Default period of health checks done by Manager.
+const defaultHealthCheckPeriod = 10 * time.Second
+
+// HealthTransition describes a change of device health.
+type HealthTransition struct {
+	DeviceType string
+	DeviceID   string
+	From       string
+	To         string
+	Reason     string
+}
+
+// recordHealthTransition makes the transition visible in logs and metrics.
+func recordHealthTransition(t HealthTransition) {
+	klog.Infof("Device %s/%s changed its health from %s to %s: %s", t.DeviceType, t.DeviceID, t.From, t.To, t.Reason)
+	healthTransitionsCounter.WithLabelValues(t.DeviceType, t.To).Inc()
+}
+
+// applyHealth checks health of the given scanned devices with HealthChecker
+// and returns a copy of the devices with their health states updated. Devices
+// are unhealthy if either Scanner or HealthChecker says so. The returned bool
+// tells if any of the states differs from the states known to Manager.
+func (m *Manager) applyHealth(devType string, devices map[string]DeviceInfo) (map[string]DeviceInfo, bool) {
+	checker, ok := m.devicePlugin.(HealthChecker)
+	if !ok {
+		return devices, false
+	}
+
+	changed := false
+	checked := make(map[string]DeviceInfo, len(devices))
+	for id, info := range devices {
+		health, reason := checker.CheckHealth(info.scannedDeviceType(devType), id, info)
+		if health != pluginapi.Healthy && health != pluginapi.Unhealthy {
+			klog.Warningf("Unknown health state '%s' of %s/%s, considering it unhealthy", health, devType, id)
+			health = pluginapi.Unhealthy
+		}
+		if health == pluginapi.Healthy && info.state != pluginapi.Healthy {
+			health, reason = pluginapi.Unhealthy, "reported unhealthy by scan"
+		}
+
+		prev := info.state
+		if known, ok := m.devices[devType][id]; ok {
+			prev = known.state
+		}
+		if health != prev {
+			recordHealthTransition(HealthTransition{
+				DeviceType: devType,
+				DeviceID:   id,
+				From:       prev,
+				To:         health,
+				Reason:     reason,
+			})
+			changed = true
+		}
+
+		info.state = health
+		checked[id] = info
+	}
+
+	return checked, changed
+}
+
+// checkHealth re-checks health of all known devices and pushes the device
+// types with changed health states to their gRPC servers.
+func (m *Manager) checkHealth() {
+	for devType, devices := range m.scanned {
+		checked, changed := m.applyHealth(devType, devices)
+		if !changed {
+			continue
+		}
+
+		m.devices[devType] = checked
+		m.status.setResource(m.resourceName(devType), m.servers[devType], checked)
+		m.servers[devType].Update(checked)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+type healthCheckerStub struct {
+	devicePluginStub
+	health map[string]string
+	// Device ID -> device type last checked.
+	checkedTypes map[string]string
+}
+
+func (dp *healthCheckerStub) CheckHealth(devType, id string, info DeviceInfo) (string, string) {
+	if dp.checkedTypes != nil {
+		dp.checkedTypes[id] = devType
+	}
+	health, ok := dp.health[id]
+	if !ok {
+		return info.state, "not checked"
+	}
+	return health, "checked by stub"
+}
+
+func TestCheckHealth(t *testing.T) {
+	tcases := []struct {
+		name              string
+		scanned           map[string]string
+		initial           map[string]string
+		checked           map[string]string
+		expectedHealth    map[string]string
+		expectedUpdate    bool
+		expectedUnhealthy float64
+	}{
+		{
+			name:           "No changes",
+			scanned:        map[string]string{"dev1": pluginapi.Healthy},
+			checked:        map[string]string{"dev1": pluginapi.Healthy},
+			expectedHealth: map[string]string{"dev1": pluginapi.Healthy},
+		},
+		{
+			name:              "Device becomes unhealthy",
+			scanned:           map[string]string{"dev1": pluginapi.Healthy, "dev2": pluginapi.Healthy},
+			checked:           map[string]string{"dev1": pluginapi.Unhealthy},
+			expectedHealth:    map[string]string{"dev1": pluginapi.Unhealthy, "dev2": pluginapi.Healthy},
+			expectedUpdate:    true,
+			expectedUnhealthy: 1,
+		},
+		{
+			name:              "Device recovers",
+			scanned:           map[string]string{"dev1": pluginapi.Healthy},
+			initial:           map[string]string{"dev1": pluginapi.Unhealthy},
+			checked:           map[string]string{"dev1": pluginapi.Healthy},
+			expectedHealth:    map[string]string{"dev1": pluginapi.Healthy},
+			expectedUpdate:    true,
+			expectedUnhealthy: 1,
+		},
+		{
+			name:           "Scanned unhealthy device stays unhealthy",
+			scanned:        map[string]string{"dev1": pluginapi.Unhealthy, "dev2": pluginapi.Healthy},
+			checked:        map[string]string{"dev1": pluginapi.Healthy, "dev2": pluginapi.Healthy},
+			expectedHealth: map[string]string{"dev1": pluginapi.Unhealthy, "dev2": pluginapi.Healthy},
+		},
+		{
+			name:              "Unknown state",
+			scanned:           map[string]string{"dev1": pluginapi.Healthy},
+			checked:           map[string]string{"dev1": "Broken"},
+			expectedHealth:    map[string]string{"dev1": pluginapi.Unhealthy},
+			expectedUpdate:    true,
+			expectedUnhealthy: 1,
+		},
+	}
+
+	for _, tt := range tcases {
+		t.Run(tt.name, func(t *testing.T) {
+			devType := "health-" + tt.name
+			checker := &healthCheckerStub{health: tt.initial}
+			srv := &serverStub{}
+			mgr := NewManager("testnamespace", checker)
+			mgr.createServer = func(string, func(*pluginapi.AllocateResponse) error, func(*pluginapi.PreStartContainerRequest) error,
+				func(*pluginapi.PreferredAllocationRequest) AllocationPolicy, *pluginapi.DevicePluginOptions) devicePluginServer {
+				return srv
+			}
+
+			tree := NewDeviceTree()
+			for id, health := range tt.scanned {
+				tree.AddDevice(devType, id, DeviceInfo{state: health})
+			}
+			mgr.handleUpdate(updateInfo{Added: tree})
+			srv.devices = nil
+
+			checker.health = tt.checked
+			mgr.checkHealth()
+
+			if !tt.expectedUpdate {
+				if srv.devices != nil {
+					t.Error("unexpected update of the server")
+				}
+				return
+			}
+			if srv.devices == nil {
+				t.Fatal("the server hasn't been updated")
+			}
+			for id, health := range tt.expectedHealth {
+				if srv.devices[id].state != health {
+					t.Errorf("expected %s to be %s, but got %s", id, health, srv.devices[id].state)
+				}
+			}
+			if tree[devType]["dev1"].state != tt.scanned["dev1"] {
+				t.Error("scanned devices have been modified")
+			}
+			unhealthy := testutil.ToFloat64(healthTransitionsCounter.WithLabelValues(devType, pluginapi.Unhealthy))
+			if unhealthy != tt.expectedUnhealthy {
+				t.Errorf("expected %v transitions to unhealthy state, but got %v", tt.expectedUnhealthy, unhealthy)
+			}
+		})
+	}
+}
+
+func TestApplyHealthOnUpdate(t *testing.T) {
+	checker := &healthCheckerStub{health: map[string]string{"dev1": pluginapi.Unhealthy}}
+	srv := &serverStub{}
+	mgr := NewManager("testnamespace", checker)
+	mgr.servers["testdevice"] = srv
+
+	tree := NewDeviceTree()
+	tree.AddDevice("testdevice", "dev1", DeviceInfo{state: pluginapi.Healthy})
+	mgr.handleUpdate(updateInfo{Updated: tree})
+
+	if srv.devices["dev1"].state != pluginapi.Unhealthy {
+		t.Errorf("expected checked health state to be pushed to the server, but got %s", srv.devices["dev1"].state)
+	}
+}
+
+func TestCheckHealthRenamed(t *testing.T) {
+	checker := &healthCheckerStub{checkedTypes: make(map[string]string)}
+	mgr := NewManager("testnamespace", checker)
+	mgr.createServer = func(string, func(*pluginapi.AllocateResponse) error, func(*pluginapi.PreStartContainerRequest) error,
+		func(*pluginapi.PreferredAllocationRequest) AllocationPolicy, *pluginapi.DevicePluginOptions) devicePluginServer {
+		return &serverStub{}
+	}
+
+	tree := NewDeviceTree()
+	tree.AddDevice("myriadx", "1-2", DeviceInfo{state: pluginapi.Healthy})
+	tree.AddDevice("hddl", "hddl-0", DeviceInfo{state: pluginapi.Healthy})
+	rm := &resourceMap{Rename: map[string]string{"myriadx": "vpu"}}
+	mgr.handleUpdate(updateInfo{Added: rm.apply(tree)})
+	mgr.checkHealth()
+
+	expected := map[string]string{"1-2": "myriadx", "hddl-0": "hddl"}
+	if !reflect.DeepEqual(checker.checkedTypes, expected) {
+		t.Errorf("expected devices checked as %v, but got %v", expected, checker.checkedTypes)
+	}
+}
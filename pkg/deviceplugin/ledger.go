@@ -0,0 +1,200 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"k8s.io/klog"
+	podresourcesapi "k8s.io/kubernetes/pkg/kubelet/apis/podresources/v1alpha1"
+)
+
+const (
+	// PodResourcesSocket is the default path to the kubelet pod-resources socket.
+	PodResourcesSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+
+	// Path of the debug endpoint listing the allocations.
+	ledgerPath = "/debug/allocations"
+
+	ledgerUpdatePeriod  = 10 * time.Second
+	ledgerUpdateTimeout = 10 * time.Second
+)
+
+// Allocation describes a container a device is allocated to.
+type Allocation struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+}
+
+// Ledger keeps track of devices allocated to containers by querying
+// the kubelet pod-resources API.
+type Ledger struct {
+	socket string
+	// resource name -> device ID -> allocations
+	allocations map[string]map[string][]Allocation
+	// Resource map of the Manager the Ledger is set to.
+	resourceMap *resourceMap
+	mutex       sync.RWMutex
+}
+
+// NewLedger creates a Ledger querying the pod-resources API at the given
+// socket. The Ledger is empty until it's updated.
+func NewLedger(socket string) *Ledger {
+	return &Ledger{
+		socket:      socket,
+		allocations: make(map[string]map[string][]Allocation),
+	}
+}
+
+// Update fetches the current allocations from kubelet.
+func (l *Ledger) Update(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, ledgerUpdateTimeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, l.socket, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+	if err != nil {
+		return errors.Wrapf(err, "Cannot connect to pod-resources service at %s", l.socket)
+	}
+	defer conn.Close()
+
+	resp, err := podresourcesapi.NewPodResourcesListerClient(conn).List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	if err != nil {
+		return errors.Wrap(err, "Cannot list pod resources")
+	}
+
+	allocations := make(map[string]map[string][]Allocation)
+	for _, pod := range resp.GetPodResources() {
+		for _, container := range pod.GetContainers() {
+			for _, devices := range container.GetDevices() {
+				resourceName := devices.GetResourceName()
+				if _, ok := allocations[resourceName]; !ok {
+					allocations[resourceName] = make(map[string][]Allocation)
+				}
+				for _, id := range devices.GetDeviceIds() {
+					allocations[resourceName][id] = append(allocations[resourceName][id], Allocation{
+						Namespace: pod.GetNamespace(),
+						Pod:       pod.GetName(),
+						Container: container.GetName(),
+					})
+				}
+			}
+		}
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.allocations = allocations
+
+	return nil
+}
+
+// Run updates the Ledger periodically until the given context is cancelled.
+func (l *Ledger) Run(ctx context.Context) {
+	ticker := time.NewTicker(ledgerUpdatePeriod)
+	defer ticker.Stop()
+
+	for {
+		if err := l.Update(ctx); err != nil {
+			klog.Warningf("Failed to update allocation ledger: %+v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Lookup returns the containers the given device of the given resource,
+// e.g. "gpu.intel.com/i915", is allocated to. A device may be allocated to
+// more than one container when it's reused by init containers.
+func (l *Ledger) Lookup(resourceName, id string) []Allocation {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return append([]Allocation(nil), l.allocations[resourceName][id]...)
+}
+
+// Allocations returns the allocated devices of all the resources in the given
+// namespace, e.g. "gpu.intel.com", by resource name and device ID.
+func (l *Ledger) Allocations(namespace string) map[string]map[string][]Allocation {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	allocations := make(map[string]map[string][]Allocation)
+	for resourceName, devices := range l.allocations {
+		if !strings.HasPrefix(resourceName, namespace+"/") {
+			continue
+		}
+		allocations[resourceName] = make(map[string][]Allocation)
+		for id, allocs := range devices {
+			allocations[resourceName][id] = append([]Allocation(nil), allocs...)
+		}
+	}
+
+	return allocations
+}
+
+// InUse tells if the given device of the given resource is allocated to
+// any container.
+func (l *Ledger) InUse(resourceName, id string) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return len(l.allocations[resourceName][id]) > 0
+}
+
+// DeviceInUse tells if the given device of the given namespace and device
+// type, as reported by Scanner, is allocated to any container. The device
+// type is renamed with the resource map of the Manager the Ledger is set to.
+func (l *Ledger) DeviceInUse(namespace, devType, id string) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return len(l.allocations[namespace+"/"+l.resourceMap.rename(devType)][id]) > 0
+}
+
+// setResourceMap sets the resource map of the resources served by Manager.
+func (l *Ledger) setResourceMap(rm *resourceMap) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.resourceMap = rm
+}
+
+// ServeHTTP implements http.Handler interface. It lists all the allocations
+// known to the Ledger in JSON.
+func (l *Ledger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(l.allocations); err != nil {
+		klog.Warningf("Failed to send allocations: %+v", err)
+	}
+}
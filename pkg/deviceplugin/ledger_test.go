@@ -0,0 +1,156 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc"
+	podresourcesapi "k8s.io/kubernetes/pkg/kubelet/apis/podresources/v1alpha1"
+)
+
+// podResourcesServerStub is a fake kubelet pod-resources service.
+type podResourcesServerStub struct {
+	resp *podresourcesapi.ListPodResourcesResponse
+}
+
+func (s *podResourcesServerStub) List(context.Context, *podresourcesapi.ListPodResourcesRequest) (*podresourcesapi.ListPodResourcesResponse, error) {
+	return s.resp, nil
+}
+
+func startPodResourcesServer(t *testing.T, socket string, stub *podResourcesServerStub) *grpc.Server {
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unable to listen to %s: %+v", socket, err)
+	}
+
+	srv := grpc.NewServer()
+	podresourcesapi.RegisterPodResourcesListerServer(srv, stub)
+	go srv.Serve(lis)
+
+	return srv
+}
+
+func TestLedger(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	socket := path.Join(tmpdir, "kubelet.sock")
+	stub := &podResourcesServerStub{
+		resp: &podresourcesapi.ListPodResourcesResponse{
+			PodResources: []*podresourcesapi.PodResources{
+				{
+					Name:      "pod1",
+					Namespace: "default",
+					Containers: []*podresourcesapi.ContainerResources{
+						{
+							Name: "init",
+							Devices: []*podresourcesapi.ContainerDevices{
+								{ResourceName: "gpu.intel.com/i915", DeviceIds: []string{"card0-0"}},
+							},
+						},
+						{
+							Name: "app",
+							Devices: []*podresourcesapi.ContainerDevices{
+								{ResourceName: "gpu.intel.com/i915", DeviceIds: []string{"card0-0", "card1-0"}},
+								{ResourceName: "qat.intel.com/generic", DeviceIds: []string{"dev0"}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	srv := startPodResourcesServer(t, socket, stub)
+	defer srv.Stop()
+
+	ledger := NewLedger(socket)
+	if ledger.InUse("gpu.intel.com/i915", "card1-0") {
+		t.Error("empty ledger reports device in use")
+	}
+
+	if err = ledger.Update(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	expected := []Allocation{
+		{Namespace: "default", Pod: "pod1", Container: "init"},
+		{Namespace: "default", Pod: "pod1", Container: "app"},
+	}
+	if allocations := ledger.Lookup("gpu.intel.com/i915", "card0-0"); !reflect.DeepEqual(allocations, expected) {
+		t.Errorf("expected %v, but got %v", expected, allocations)
+	}
+	if !ledger.InUse("qat.intel.com/generic", "dev0") {
+		t.Error("allocated device is not in use")
+	}
+	if ledger.InUse("gpu.intel.com/i915", "card2-0") {
+		t.Error("unallocated device is in use")
+	}
+	if gpus := ledger.Allocations("gpu.intel.com"); len(gpus) != 1 || !reflect.DeepEqual(gpus["gpu.intel.com/i915"]["card0-0"], expected) {
+		t.Errorf("unexpected GPU allocations %v", gpus)
+	}
+	if !ledger.DeviceInUse("gpu.intel.com", "i915", "card1-0") {
+		t.Error("allocated device is not in use")
+	}
+
+	// Devices are looked up with the names the resource map gives them.
+	ledger.setResourceMap(&resourceMap{Rename: map[string]string{"igpu": "i915", "i915": "gpu"}})
+	if !ledger.DeviceInUse("gpu.intel.com", "igpu", "card1-0") {
+		t.Error("allocated device of renamed device type is not in use")
+	}
+	if ledger.DeviceInUse("gpu.intel.com", "i915", "card1-0") {
+		t.Error("device of device type renamed to another name is in use")
+	}
+
+	rec := httptest.NewRecorder()
+	ledger.ServeHTTP(rec, httptest.NewRequest("GET", ledgerPath, nil))
+	dump := make(map[string]map[string][]Allocation)
+	if err = json.Unmarshal(rec.Body.Bytes(), &dump); err != nil {
+		t.Fatalf("failed to parse allocations: %+v", err)
+	}
+	if len(dump["gpu.intel.com/i915"]) != 2 || len(dump["qat.intel.com/generic"]) != 1 {
+		t.Errorf("unexpected allocations dump: %s", rec.Body.String())
+	}
+
+	// Pod is gone.
+	stub.resp = &podresourcesapi.ListPodResourcesResponse{}
+	if err = ledger.Update(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if ledger.InUse("qat.intel.com/generic", "dev0") {
+		t.Error("released device is still in use")
+	}
+}
+
+func TestLedgerUpdateFailure(t *testing.T) {
+	ledger := NewLedger("/nonexistent/kubelet.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ledger.Update(ctx); err == nil {
+		t.Error("expected error, but got nothing")
+	}
+}
@@ -15,13 +15,28 @@
 package deviceplugin
 
 import (
-	"os"
+	"context"
+	"flag"
+	"net/http"
 	"reflect"
+	"runtime"
+	"time"
 
+	"github.com/pkg/errors"
 	"k8s.io/klog"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
+// scanHysteresis is shared by all device plugins built with this package.
+// It counts scans rather than time, so with event-driven scans the time it
+// takes to confirm a change depends on how often rescans are triggered.
+var scanHysteresis int
+
+func init() {
+	flag.IntVar(&scanHysteresis, "scan-hysteresis", 1,
+		"number of consecutive scans a device must be found (missing, changed) in before it's added (removed, updated)")
+}
+
 // updateInfo contains info for added, updated and deleted devices.
 type updateInfo struct {
 	Added   DeviceTree
@@ -29,42 +44,203 @@ type updateInfo struct {
 	Removed DeviceTree
 }
 
+// pendingChange is a change of a device seen in consecutive scans, but not
+// yet reported to Manager.
+type pendingChange struct {
+	found bool
+	info  DeviceInfo
+	count int
+}
+
 // notifier implements Notifier interface.
 type notifier struct {
+	// Devices reported to Manager.
 	deviceTree DeviceTree
-	updatesCh  chan<- updateInfo
+	// Device type -> device ID -> change not reported yet.
+	pending map[string]map[string]*pendingChange
+	// Number of consecutive scans a change must be seen in before it's reported.
+	hysteresis int
+	// Rules applied to the scanned devices, nil if none.
+	resourceMap *resourceMap
+	// Status of Manager, nil if not tracked.
+	status    *status
+	updatesCh chan<- updateInfo
+	done      <-chan struct{}
+	// Set if Scanner can't be stopped otherwise. Notify() then ends
+	// the scan goroutine once Manager is done.
+	endScan bool
 }
 
-func newNotifier(updatesCh chan<- updateInfo) *notifier {
+func newNotifier(updatesCh chan<- updateInfo, done <-chan struct{}, hysteresis int) *notifier {
+	if hysteresis < 1 {
+		hysteresis = 1
+	}
+
 	return &notifier{
-		updatesCh: updatesCh,
+		deviceTree: NewDeviceTree(),
+		pending:    make(map[string]map[string]*pendingChange),
+		hysteresis: hysteresis,
+		updatesCh:  updatesCh,
+		done:       done,
 	}
 }
 
 func (n *notifier) Notify(newDeviceTree DeviceTree) {
+	select {
+	case <-n.done:
+		if n.endScan {
+			klog.V(4).Info("Device plugin shut down, ending scan")
+			runtime.Goexit()
+		}
+		return
+	default:
+	}
+
+	if n.status != nil {
+		n.status.scanned()
+	}
+
+	if n.resourceMap != nil {
+		newDeviceTree = n.resourceMap.apply(newDeviceTree)
+	}
+
 	added := NewDeviceTree()
 	updated := NewDeviceTree()
+	removed := NewDeviceTree()
 
-	for devType, new := range newDeviceTree {
-		if old, ok := n.deviceTree[devType]; ok {
-			if !reflect.DeepEqual(old, new) {
-				updated[devType] = new
-			}
+	devTypes := make(map[string]bool)
+	for devType := range n.deviceTree {
+		devTypes[devType] = true
+	}
+	for devType := range newDeviceTree {
+		devTypes[devType] = true
+	}
+	for devType := range n.pending {
+		devTypes[devType] = true
+	}
+
+	for devType := range devTypes {
+		old, known := n.deviceTree[devType]
+		devices, changed := n.debounce(devType, old, newDeviceTree[devType])
+		switch {
+		case !changed:
+			continue
+		case len(devices) == 0:
+			removed[devType] = old
 			delete(n.deviceTree, devType)
-		} else {
-			added[devType] = new
+		case !known:
+			added[devType] = devices
+			n.deviceTree[devType] = devices
+		default:
+			updated[devType] = devices
+			n.deviceTree[devType] = devices
 		}
 	}
 
-	if len(added) > 0 || len(updated) > 0 || len(n.deviceTree) > 0 {
-		n.updatesCh <- updateInfo{
+	if len(added) > 0 || len(updated) > 0 || len(removed) > 0 {
+		deviceTypeUpdatesCounter.WithLabelValues("added").Add(float64(len(added)))
+		deviceTypeUpdatesCounter.WithLabelValues("updated").Add(float64(len(updated)))
+		deviceTypeUpdatesCounter.WithLabelValues("removed").Add(float64(len(removed)))
+
+		// Don't block the scanner if nobody listens to the updates anymore.
+		select {
+		case n.updatesCh <- updateInfo{
 			Added:   added,
 			Updated: updated,
-			Removed: n.deviceTree,
+			Removed: removed,
+		}:
+		case <-n.done:
+		}
+	}
+}
+
+// debounce compares the reported devices of the given type with the found
+// devices device by device. It returns a new map of devices containing the
+// changes seen in enough consecutive scans and tells if there are any.
+func (n *notifier) debounce(devType string, reported, found map[string]DeviceInfo) (map[string]DeviceInfo, bool) {
+	devices := make(map[string]DeviceInfo, len(reported))
+	for id, info := range reported {
+		devices[id] = info
+	}
+
+	changed := false
+	for _, id := range deviceIDs(reported, found) {
+		old, isReported := reported[id]
+		info, isFound := found[id]
+		if isReported == isFound && (!isFound || reflect.DeepEqual(old, info)) {
+			delete(n.pending[devType], id)
+			continue
+		}
+
+		if !n.confirm(devType, id, isFound, info) {
+			continue
+		}
+
+		changed = true
+		switch {
+		case !isFound:
+			klog.V(4).Infof("Device %s/%s removed", devType, id)
+			delete(devices, id)
+		case !isReported:
+			klog.V(4).Infof("Device %s/%s added", devType, id)
+			devices[id] = info
+		default:
+			klog.V(4).Infof("Device %s/%s updated", devType, id)
+			devices[id] = info
+		}
+	}
+
+	// Forget the changes of the devices neither reported nor found anymore.
+	for id := range n.pending[devType] {
+		_, isReported := reported[id]
+		_, isFound := found[id]
+		if !isReported && !isFound {
+			delete(n.pending[devType], id)
+		}
+	}
+	if len(n.pending[devType]) == 0 {
+		delete(n.pending, devType)
+	}
+
+	return devices, changed
+}
+
+// confirm counts the scans the given change of the device has been seen in
+// and tells if it's been seen in enough of them.
+func (n *notifier) confirm(devType, id string, found bool, info DeviceInfo) bool {
+	if n.pending[devType] == nil {
+		n.pending[devType] = make(map[string]*pendingChange)
+	}
+
+	change, ok := n.pending[devType][id]
+	if !ok || change.found != found || !reflect.DeepEqual(change.info, info) {
+		change = &pendingChange{found: found, info: info}
+		n.pending[devType][id] = change
+	}
+	change.count++
+
+	if change.count < n.hysteresis {
+		klog.V(4).Infof("Change of device %s/%s seen %d time(s), waiting for %d", devType, id, change.count, n.hysteresis)
+		return false
+	}
+
+	delete(n.pending[devType], id)
+	return true
+}
+
+func deviceIDs(deviceMaps ...map[string]DeviceInfo) []string {
+	seen := make(map[string]bool)
+	ids := []string{}
+	for _, devices := range deviceMaps {
+		for id := range devices {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
 		}
 	}
 
-	n.deviceTree = newDeviceTree
+	return ids
 }
 
 // Manager manages life cycle of device plugins and handles the scan results
@@ -73,66 +249,452 @@ type Manager struct {
 	devicePlugin Scanner
 	namespace    string
 	servers      map[string]devicePluginServer
-	createServer func(string, func(*pluginapi.AllocateResponse) error, func(*pluginapi.PreStartContainerRequest) error) devicePluginServer
+	// Devices sent to the servers.
+	devices DeviceTree
+	// Devices as reported by Scanner, before health checks.
+	scanned DeviceTree
+	ledger  *Ledger
+	// Renames device types and drops devices found by Scanner.
+	resourceMap *resourceMap
+	// kubelet's directory for device plugin sockets.
+	devicePluginPath string
+	// kubelet's directory watched for plugin sockets.
+	pluginsRegistryPath string
+	// Failed components being restarted.
+	status *status
+	// Delays between restarts after transient failures.
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	scanBackoff    *backoff
+	serverBackoffs map[string]*backoff
+	// Failed servers and the ones due to be restarted.
+	serveErrCh chan serveError
+	restartCh  chan serveError
+	// Closed when Run() returns.
+	done <-chan struct{}
+	// Period of health checks done if devicePlugin is HealthChecker.
+	healthCheckPeriod time.Duration
+	createServer      func(string, func(*pluginapi.AllocateResponse) error, func(*pluginapi.PreStartContainerRequest) error,
+		func(*pluginapi.PreferredAllocationRequest) AllocationPolicy, *pluginapi.DevicePluginOptions) devicePluginServer
 }
 
 // NewManager creates a new instance of Manager
 func NewManager(namespace string, devicePlugin Scanner) *Manager {
 	return &Manager{
-		devicePlugin: devicePlugin,
-		namespace:    namespace,
-		servers:      make(map[string]devicePluginServer),
-		createServer: newServer,
+		devicePlugin:        devicePlugin,
+		namespace:           namespace,
+		servers:             make(map[string]devicePluginServer),
+		devices:             NewDeviceTree(),
+		scanned:             NewDeviceTree(),
+		createServer:        newServer,
+		healthCheckPeriod:   defaultHealthCheckPeriod,
+		devicePluginPath:    pluginapi.DevicePluginPath,
+		pluginsRegistryPath: PluginsRegistryPath,
+		status:              newStatus(),
+		initialBackoff:      defaultInitialBackoff,
+		maxBackoff:          defaultMaxBackoff,
+	}
+}
+
+// SetLedger makes Manager keep the given Ledger up to date while running
+// and expose its allocations at /debug/allocations of the metrics server.
+func (m *Manager) SetLedger(ledger *Ledger) {
+	m.ledger = ledger
+}
+
+// SetHealthCheckPeriod sets the period of the health checks done if the
+// device plugin implements HealthChecker.
+func (m *Manager) SetHealthCheckPeriod(period time.Duration) {
+	m.healthCheckPeriod = period
+}
+
+// SetDevicePluginPath makes Manager serve device plugins and register them
+// with kubelet in the given directory instead of the default one.
+func (m *Manager) SetDevicePluginPath(devicePluginPath string) {
+	m.devicePluginPath = devicePluginPath
+}
+
+// SetPluginsRegistryPath makes Manager serve device plugins in the given
+// directory instead of the default one when they're registered by kubelet's
+// plugin watcher.
+func (m *Manager) SetPluginsRegistryPath(pluginsRegistryPath string) {
+	m.pluginsRegistryPath = pluginsRegistryPath
+}
+
+// resourceName returns the extended resource name of the given device type.
+func (m *Manager) resourceName(devType string) string {
+	return m.namespace + "/" + devType
+}
+
+// pluginDir returns the directory the device plugins are served in.
+func (m *Manager) pluginDir() string {
+	if registrationMode == pluginWatcherRegistration {
+		return m.pluginsRegistryPath
+	}
+
+	return m.devicePluginPath
+}
+
+// serveError is the error a server failed with.
+type serveError struct {
+	devType string
+	srv     devicePluginServer
+	err     error
+	ranFor  time.Duration
+}
+
+// setup validates and loads the settings shared by all device plugins.
+// The settings don't change while the plugin runs, so all the errors
+// are fatal.
+func (m *Manager) setup() (*resourceMap, error) {
+	if err := validateRegistrationMode(registrationMode); err != nil {
+		return nil, Fatal(err)
+	}
+
+	resources, err := loadResourceMap(resourceMapFile)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	if err = openAuditLog(m.ledger); err != nil {
+		return nil, Fatal(err)
+	}
+
+	if m.ledger != nil {
+		m.ledger.setResourceMap(resources)
+	}
+
+	return resources, nil
+}
+
+// startHTTP starts the ledger and the metrics server, if enabled.
+func (m *Manager) startHTTP(ctx context.Context) (func(), error) {
+	mux := http.NewServeMux()
+	m.status.register(mux)
+	if m.ledger != nil {
+		go m.ledger.Run(ctx)
+		mux.Handle(ledgerPath, m.ledger)
+	}
+
+	stopProbes := func() {}
+	if probeAddress != "" {
+		probeMux := http.NewServeMux()
+		m.status.register(probeMux)
+		var err error
+		if stopProbes, err = startHTTPServer(probeAddress, probeMux); err != nil {
+			return nil, Fatal(err)
+		}
 	}
+
+	if metricsAddress == "" {
+		return stopProbes, nil
+	}
+
+	stopMetrics, err := startMetricsServer(metricsAddress, mux)
+	if err != nil {
+		stopProbes()
+		return nil, Fatal(err)
+	}
+
+	return func() {
+		stopMetrics()
+		stopProbes()
+	}, nil
 }
 
-// Run prepares and launches event loop for updates from Scanner
-func (m *Manager) Run() {
+// Run prepares and launches event loop for updates from Scanner.
+// It returns when the given context is cancelled, Scanner finishes or
+// Scanner or any of the gRPC servers fails with a fatal error. Scanner
+// and the gRPC servers failing with other errors are restarted. Before
+// returning Run stops Scanner, if Scanner implements ScanStopper, and all
+// the gRPC servers. Other Scanners end in their next Notify() call.
+func (m *Manager) Run(ctx context.Context) error {
+	resources, err := m.setup()
+	if err != nil {
+		return err
+	}
+
+	scanCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stopHTTP, err := m.startHTTP(scanCtx)
+	if err != nil {
+		return err
+	}
+	defer stopHTTP()
+
 	updatesCh := make(chan updateInfo)
+	scanErrCh := make(chan error, 1)
+	m.serveErrCh = make(chan serveError)
+	m.restartCh = make(chan serveError)
+	m.done = scanCtx.Done()
+	m.scanBackoff = newBackoff(m.initialBackoff, m.maxBackoff)
+	m.serverBackoffs = make(map[string]*backoff)
+
+	stopper, canStop := m.devicePlugin.(ScanStopper)
+	m.resourceMap = resources
+	n := newNotifier(updatesCh, scanCtx.Done(), scanHysteresis)
+	n.resourceMap = resources
+	n.status = m.status
+	n.endScan = !canStop
+	scanStart := m.startScan(n, scanErrCh)
+
+	// Receiving from nil channel blocks forever, i.e. no health checks
+	// for plugins not implementing HealthChecker.
+	var healthCheckCh <-chan time.Time
+	if _, ok := m.devicePlugin.(HealthChecker); ok {
+		ticker := time.NewTicker(m.healthCheckPeriod)
+		defer ticker.Stop()
+		healthCheckCh = ticker.C
+	}
+
+	// Set while waiting to restart failed Scanner.
+	var scanRestartCh <-chan time.Time
+	scanning := true
+loop:
+	for {
+		select {
+		case update := <-updatesCh:
+			m.handleUpdate(update)
+		case <-healthCheckCh:
+			m.checkHealth()
+		case scanErr := <-scanErrCh:
+			scanning = false
+			if scanErr == nil || IsFatal(scanErr) {
+				err = errors.Wrap(scanErr, "device scan failed")
+				break loop
+			}
+			scanRestartCh = time.After(m.scanFailed(scanErr, time.Since(scanStart)))
+		case <-scanRestartCh:
+			scanRestartCh = nil
+			scanning = true
+			restartsCounter.WithLabelValues(componentScan).Inc()
+			scanStart = m.startScan(n, scanErrCh)
+		case se := <-m.serveErrCh:
+			if IsFatal(se.err) {
+				err = errors.Wrapf(se.err, "failed to serve %s/%s", m.namespace, se.devType)
+				break loop
+			}
+			m.serverFailed(se)
+		case se := <-m.restartCh:
+			m.restartServer(se)
+		case <-ctx.Done():
+			klog.V(1).Info("Shutting down device plugin")
+			break loop
+		}
+	}
+
+	cancel()
+	if canStop && scanning {
+		stopper.StopScan()
+		if scanErr := <-scanErrCh; scanErr != nil {
+			klog.Warningf("Device scan failed while stopping: %+v", scanErr)
+		}
+	}
+	m.stopServers()
+
+	return err
+}
+
+// startScan runs Scanner in a goroutine and returns the time it started.
+func (m *Manager) startScan(n *notifier, scanErrCh chan<- error) time.Time {
+	go func() {
+		scanErrCh <- m.devicePlugin.Scan(n)
+	}()
+
+	return time.Now()
+}
+
+// scanFailed records the transient failure of Scanner that ran for the
+// given time and returns the delay before restarting it.
+func (m *Manager) scanFailed(err error, ranFor time.Duration) time.Duration {
+	m.status.setFailure(componentScan, err)
+	delay := m.scanBackoff.next(ranFor)
+	klog.Errorf("Device scan failed, restarting in %v: %+v", delay, err)
+
+	return delay
+}
 
+// serve runs the given server in a goroutine and reports its failure.
+func (m *Manager) serve(devType string, srv devicePluginServer) {
 	go func() {
-		err := m.devicePlugin.Scan(newNotifier(updatesCh))
-		if err != nil {
-			klog.Errorf("Device scan failed: %+v", err)
-			os.Exit(1)
+		start := time.Now()
+		err := srv.Serve(m.namespace, m.pluginDir())
+		if err == nil {
+			return
+		}
+
+		select {
+		case m.serveErrCh <- serveError{devType: devType, srv: srv, err: err, ranFor: time.Since(start)}:
+		case <-m.done:
 		}
-		close(updatesCh)
 	}()
+}
+
+// serverFailed records the transient failure of a server and schedules
+// its restart.
+func (m *Manager) serverFailed(se serveError) {
+	if m.servers[se.devType] != se.srv {
+		// The device type is gone or served by a new server already.
+		return
+	}
+
+	component := componentServer + "/" + se.devType
+	m.status.setFailure(component, se.err)
 
-	for update := range updatesCh {
-		m.handleUpdate(update)
+	b, ok := m.serverBackoffs[se.devType]
+	if !ok {
+		b = newBackoff(m.initialBackoff, m.maxBackoff)
+		m.serverBackoffs[se.devType] = b
 	}
+	delay := b.next(se.ranFor)
+	klog.Errorf("Failed to serve %s/%s, restarting in %v: %+v", m.namespace, se.devType, delay, se.err)
+
+	time.AfterFunc(delay, func() {
+		select {
+		case m.restartCh <- se:
+		case <-m.done:
+		}
+	})
 }
 
-func (m *Manager) handleUpdate(update updateInfo) {
-	klog.V(4).Info("Received dev updates:", update)
-	for devType, devices := range update.Added {
-		var postAllocate func(*pluginapi.AllocateResponse) error
-		var preStartContainer func(*pluginapi.PreStartContainerRequest) error
+// restartServer replaces a failed server with a new one.
+func (m *Manager) restartServer(se serveError) {
+	if m.servers[se.devType] != se.srv {
+		return
+	}
+
+	if err := se.srv.Stop(); err != nil {
+		klog.V(4).Infof("Failed to stop failed server for %s: %+v", se.devType, err)
+	}
 
-		if postAllocator, ok := m.devicePlugin.(PostAllocator); ok {
-			postAllocate = postAllocator.PostAllocate
+	srv := m.newServer(se.devType)
+	m.servers[se.devType] = srv
+	m.serve(se.devType, srv)
+	m.status.setResource(m.resourceName(se.devType), srv, m.devices[se.devType])
+	srv.Update(m.devices[se.devType])
+	restartsCounter.WithLabelValues(componentServer).Inc()
+	m.status.clearFailure(componentServer + "/" + se.devType)
+}
+
+func (m *Manager) stopServers() {
+	for devType, srv := range m.servers {
+		if err := srv.Stop(); err != nil {
+			klog.Warningf("Failed to stop server for %s: %+v", devType, err)
 		}
+		deleteDevicesMetric(devType)
+		m.status.removeResource(m.resourceName(devType))
+		delete(m.servers, devType)
+		delete(m.devices, devType)
+		delete(m.scanned, devType)
+	}
+	serversGauge.Set(0)
+}
 
-		if containerPreStarter, ok := m.devicePlugin.(ContainerPreStarter); ok {
-			preStartContainer = containerPreStarter.PreStartContainer
+// newServer creates a server for the given device type with the optional
+// interfaces implemented by devicePlugin.
+func (m *Manager) newServer(devType string) devicePluginServer {
+	var postAllocate func(*pluginapi.AllocateResponse) error
+	var preStartContainer func(*pluginapi.PreStartContainerRequest) error
+	var allocationPolicy func(*pluginapi.PreferredAllocationRequest) AllocationPolicy
+	var options *pluginapi.DevicePluginOptions
+
+	if postAllocator, ok := m.devicePlugin.(PostAllocator); ok {
+		postAllocate = postAllocator.PostAllocate
+	}
+
+	if containerPreStarter, ok := m.devicePlugin.(ContainerPreStarter); ok {
+		preStartContainer = containerPreStarter.PreStartContainer
+	}
+
+	// The plugin knows the device types as reported by Scanner.
+	scannedTypes := m.resourceMap.scannedTypes(devType)
+
+	if preferredAllocator, ok := m.devicePlugin.(PreferredAllocator); ok {
+		allocationPolicy = func(rqt *pluginapi.PreferredAllocationRequest) AllocationPolicy {
+			return preferredAllocator.AllocationPolicy(scannedTypes[0], rqt)
 		}
+	}
 
-		m.servers[devType] = m.createServer(devType, postAllocate, preStartContainer)
-		go func(dt string) {
-			err := m.servers[dt].Serve(m.namespace)
-			if err != nil {
-				klog.Errorf("Failed to serve %s/%s: %+v", m.namespace, dt, err)
-				os.Exit(1)
-			}
-		}(devType)
-		m.servers[devType].Update(devices)
+	if optionsProvider, ok := m.devicePlugin.(DevicePluginOptionsProvider); ok {
+		options = mergedOptions(optionsProvider, scannedTypes)
+	}
+
+	return m.createServer(devType, postAllocate, preStartContainer, allocationPolicy, options)
+}
+
+// mergedOptions returns the options enabled for any of the given device types,
+// nil if the provider enables all the options for any of them.
+func mergedOptions(provider DevicePluginOptionsProvider, devTypes []string) *pluginapi.DevicePluginOptions {
+	var merged *pluginapi.DevicePluginOptions
+	for i, devType := range devTypes {
+		options := provider.GetDevicePluginOptions(devType)
+		if options == nil {
+			return nil
+		}
+		if i == 0 {
+			merged = options
+			continue
+		}
+		merged.PreStartRequired = merged.PreStartRequired || options.PreStartRequired
+		merged.GetPreferredAllocationAvailable = merged.GetPreferredAllocationAvailable || options.GetPreferredAllocationAvailable
+	}
+
+	return merged
+}
+
+func (m *Manager) handleUpdate(update updateInfo) {
+	klog.V(4).Info("Received dev updates:", update)
+	for devType, devices := range update.Added {
+		srv := m.newServer(devType)
+		m.servers[devType] = srv
+		m.serve(devType, srv)
+		m.scanned[devType] = devices
+		devices, _ = m.applyHealth(devType, devices)
+		m.devices[devType] = devices
+		m.updateCDISpec(devType, devices)
+		m.status.setResource(m.resourceName(devType), srv, devices)
+		srv.Update(devices)
 	}
 	for devType, devices := range update.Updated {
+		m.scanned[devType] = devices
+		devices, _ = m.applyHealth(devType, devices)
+		m.devices[devType] = devices
+		m.updateCDISpec(devType, devices)
+		m.status.setResource(m.resourceName(devType), m.servers[devType], devices)
 		m.servers[devType].Update(devices)
 	}
 	for devType := range update.Removed {
 		m.servers[devType].Stop()
+		deleteDevicesMetric(devType)
 		delete(m.servers, devType)
+		delete(m.devices, devType)
+		delete(m.scanned, devType)
+		delete(m.serverBackoffs, devType)
+		m.status.clearFailure(componentServer + "/" + devType)
+		m.status.removeResource(m.resourceName(devType))
+		m.removeCDISpec(devType)
+	}
+	serversGauge.Set(float64(len(m.servers)))
+}
+
+// updateCDISpec keeps the CDI spec of the given device type in sync with
+// the devices if CDI spec generation is enabled. The specs are kept when
+// Manager stops as they may still be needed for restarting containers.
+func (m *Manager) updateCDISpec(devType string, devices map[string]DeviceInfo) {
+	if cdiSpecDir == "" {
+		return
+	}
+	if err := writeCDISpec(cdiSpecDir, m.namespace, devType, devices); err != nil {
+		klog.Warningf("Failed to update CDI spec for %s/%s: %+v", m.namespace, devType, err)
+	}
+}
+
+func (m *Manager) removeCDISpec(devType string) {
+	if cdiSpecDir == "" {
+		return
+	}
+	if err := removeCDISpec(cdiSpecDir, m.namespace, devType); err != nil {
+		klog.Warningf("Failed to remove CDI spec for %s/%s: %+v", m.namespace, devType, err)
 	}
 }
@@ -15,8 +15,13 @@
 package deviceplugin
 
 import (
+	"context"
 	"flag"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
@@ -109,8 +114,10 @@ func TestNotify(t *testing.T) {
 
 	for _, tcase := range tcases {
 		ch := make(chan updateInfo, 1)
-		n := newNotifier(ch)
-		n.deviceTree = tcase.oldmap
+		n := newNotifier(ch, nil, 1)
+		if tcase.oldmap != nil {
+			n.deviceTree = tcase.oldmap
+		}
 
 		n.Notify(tcase.newmap)
 
@@ -132,18 +139,189 @@ func TestNotify(t *testing.T) {
 	}
 }
 
-type serverStub struct{}
+func TestNotifyHysteresis(t *testing.T) {
+	healthy := DeviceInfo{state: pluginapi.Healthy}
+	unhealthy := DeviceInfo{state: pluginapi.Unhealthy}
 
-func (*serverStub) Serve(string) error {
-	return nil
+	type scan struct {
+		devices         map[string]DeviceInfo
+		expectedAdded   bool
+		expectedUpdated bool
+		expectedRemoved bool
+		// Expected devices in the update, if any.
+		expectedDevices map[string]DeviceInfo
+	}
+
+	tcases := []struct {
+		name       string
+		hysteresis int
+		scans      []scan
+	}{
+		{
+			name:       "No hysteresis",
+			hysteresis: 1,
+			scans: []scan{
+				{
+					devices:         map[string]DeviceInfo{"dev1": healthy},
+					expectedAdded:   true,
+					expectedDevices: map[string]DeviceInfo{"dev1": healthy},
+				},
+				{
+					devices:         map[string]DeviceInfo{"dev1": unhealthy},
+					expectedUpdated: true,
+					expectedDevices: map[string]DeviceInfo{"dev1": unhealthy},
+				},
+				{
+					expectedRemoved: true,
+				},
+			},
+		},
+		{
+			name:       "Device added after being found N times",
+			hysteresis: 3,
+			scans: []scan{
+				{devices: map[string]DeviceInfo{"dev1": healthy}},
+				{devices: map[string]DeviceInfo{"dev1": healthy}},
+				{
+					devices:         map[string]DeviceInfo{"dev1": healthy},
+					expectedAdded:   true,
+					expectedDevices: map[string]DeviceInfo{"dev1": healthy},
+				},
+				{devices: map[string]DeviceInfo{"dev1": healthy}},
+			},
+		},
+		{
+			name:       "Flapping device is never added",
+			hysteresis: 2,
+			scans: []scan{
+				{devices: map[string]DeviceInfo{"dev1": healthy}},
+				{},
+				{devices: map[string]DeviceInfo{"dev1": healthy}},
+				{},
+			},
+		},
+		{
+			name:       "Device removed after being missing N times",
+			hysteresis: 2,
+			scans: []scan{
+				{devices: map[string]DeviceInfo{"dev1": healthy, "dev2": healthy}},
+				{
+					devices:         map[string]DeviceInfo{"dev1": healthy, "dev2": healthy},
+					expectedAdded:   true,
+					expectedDevices: map[string]DeviceInfo{"dev1": healthy, "dev2": healthy},
+				},
+				{devices: map[string]DeviceInfo{"dev1": healthy}},
+				{
+					devices:         map[string]DeviceInfo{"dev1": healthy},
+					expectedUpdated: true,
+					expectedDevices: map[string]DeviceInfo{"dev1": healthy},
+				},
+				{},
+				{expectedRemoved: true},
+			},
+		},
+		{
+			name:       "Device marked unhealthy after being unhealthy N times",
+			hysteresis: 2,
+			scans: []scan{
+				{devices: map[string]DeviceInfo{"dev1": healthy}},
+				{
+					devices:         map[string]DeviceInfo{"dev1": healthy},
+					expectedAdded:   true,
+					expectedDevices: map[string]DeviceInfo{"dev1": healthy},
+				},
+				{devices: map[string]DeviceInfo{"dev1": unhealthy}},
+				{devices: map[string]DeviceInfo{"dev1": healthy}},
+				{devices: map[string]DeviceInfo{"dev1": unhealthy}},
+				{
+					devices:         map[string]DeviceInfo{"dev1": unhealthy},
+					expectedUpdated: true,
+					expectedDevices: map[string]DeviceInfo{"dev1": unhealthy},
+				},
+			},
+		},
+		{
+			name:       "Only changed devices are debounced",
+			hysteresis: 2,
+			scans: []scan{
+				{devices: map[string]DeviceInfo{"dev1": healthy}},
+				{
+					devices:         map[string]DeviceInfo{"dev1": healthy, "dev2": healthy},
+					expectedAdded:   true,
+					expectedDevices: map[string]DeviceInfo{"dev1": healthy},
+				},
+				{
+					devices:         map[string]DeviceInfo{"dev1": unhealthy, "dev2": healthy},
+					expectedUpdated: true,
+					expectedDevices: map[string]DeviceInfo{"dev1": healthy, "dev2": healthy},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tcases {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := make(chan updateInfo, 1)
+			n := newNotifier(ch, nil, tt.hysteresis)
+
+			for i, s := range tt.scans {
+				tree := NewDeviceTree()
+				for id, info := range s.devices {
+					tree.AddDevice("testdevice", id, info)
+				}
+				n.Notify(tree)
+
+				var update updateInfo
+				select {
+				case update = <-ch:
+				default:
+				}
+
+				if _, ok := update.Added["testdevice"]; ok != s.expectedAdded {
+					t.Errorf("scan %d: expected added %v, but got %v", i, s.expectedAdded, ok)
+				}
+				if _, ok := update.Updated["testdevice"]; ok != s.expectedUpdated {
+					t.Errorf("scan %d: expected updated %v, but got %v", i, s.expectedUpdated, ok)
+				}
+				if _, ok := update.Removed["testdevice"]; ok != s.expectedRemoved {
+					t.Errorf("scan %d: expected removed %v, but got %v", i, s.expectedRemoved, ok)
+				}
+
+				devices := update.Added["testdevice"]
+				if devices == nil {
+					devices = update.Updated["testdevice"]
+				}
+				if s.expectedDevices != nil && !reflect.DeepEqual(devices, s.expectedDevices) {
+					t.Errorf("scan %d: expected devices %v, but got %v", i, s.expectedDevices, devices)
+				}
+			}
+		})
+	}
+}
+
+type serverStub struct {
+	serveErr error
+	stopped  bool
+	devices  map[string]DeviceInfo
 }
 
-func (*serverStub) Update(map[string]DeviceInfo) {}
+func (s *serverStub) Serve(string, string) error {
+	return s.serveErr
+}
+
+func (s *serverStub) Update(devices map[string]DeviceInfo) {
+	s.devices = devices
+}
 
-func (*serverStub) Stop() error {
+func (s *serverStub) Stop() error {
+	s.stopped = true
 	return nil
 }
 
+func (s *serverStub) Status() serverStatus {
+	return serverStatus{state: serving, registered: true}
+}
+
 type devicePluginStub struct{}
 
 func (*devicePluginStub) Scan(n Notifier) error {
@@ -164,6 +342,10 @@ func (*devicePluginStub) PreStartContainer(*pluginapi.PreStartContainerRequest)
 	return nil
 }
 
+func (*devicePluginStub) AllocationPolicy(string, *pluginapi.PreferredAllocationRequest) AllocationPolicy {
+	return PackedPolicy
+}
+
 func TestHandleUpdate(t *testing.T) {
 	tcases := []struct {
 		name            string
@@ -265,7 +447,11 @@ func TestHandleUpdate(t *testing.T) {
 		mgr := Manager{
 			devicePlugin: &devicePluginStub{},
 			servers:      tt.servers,
-			createServer: func(string, func(*pluginapi.AllocateResponse) error, func(*pluginapi.PreStartContainerRequest) error) devicePluginServer {
+			devices:      NewDeviceTree(),
+			scanned:      NewDeviceTree(),
+			status:       newStatus(),
+			createServer: func(string, func(*pluginapi.AllocateResponse) error, func(*pluginapi.PreStartContainerRequest) error,
+				func(*pluginapi.PreferredAllocationRequest) AllocationPolicy, *pluginapi.DevicePluginOptions) devicePluginServer {
 				return &serverStub{}
 			},
 		}
@@ -277,10 +463,189 @@ func TestHandleUpdate(t *testing.T) {
 	}
 }
 
+// optionsProviderStub requires PreStartContainer() for "region" devices only.
+type optionsProviderStub struct {
+	devicePluginStub
+}
+
+func (*optionsProviderStub) GetDevicePluginOptions(devType string) *pluginapi.DevicePluginOptions {
+	return &pluginapi.DevicePluginOptions{
+		PreStartRequired: devType == "region",
+	}
+}
+
+func TestNewServerOptions(t *testing.T) {
+	options := make(map[string]*pluginapi.DevicePluginOptions)
+	mgr := Manager{
+		devicePlugin: &optionsProviderStub{},
+		createServer: func(devType string, _ func(*pluginapi.AllocateResponse) error, _ func(*pluginapi.PreStartContainerRequest) error,
+			_ func(*pluginapi.PreferredAllocationRequest) AllocationPolicy, o *pluginapi.DevicePluginOptions) devicePluginServer {
+			options[devType] = o
+			return &serverStub{}
+		},
+	}
+	for _, devType := range []string{"region", "af"} {
+		mgr.newServer(devType)
+	}
+
+	if options["region"] == nil || !options["region"].PreStartRequired {
+		t.Errorf("expected PreStartRequired for region, but got %+v", options["region"])
+	}
+	if options["af"] == nil || options["af"].PreStartRequired {
+		t.Errorf("expected no PreStartRequired for af, but got %+v", options["af"])
+	}
+
+	// The options are asked for the device types as reported by Scanner.
+	mgr.resourceMap = &resourceMap{Rename: map[string]string{"region": "fpga", "af": "merged", "region2": "merged"}}
+	for _, devType := range []string{"fpga", "merged"} {
+		mgr.newServer(devType)
+	}
+	for devType, expected := range map[string]bool{"fpga": true, "merged": false} {
+		if options[devType] == nil || options[devType].PreStartRequired != expected {
+			t.Errorf("expected PreStartRequired %v for %s, but got %+v", expected, devType, options[devType])
+		}
+	}
+}
+
 func TestRun(t *testing.T) {
 	mgr := NewManager("testnamespace", &devicePluginStub{})
-	mgr.createServer = func(string, func(*pluginapi.AllocateResponse) error, func(*pluginapi.PreStartContainerRequest) error) devicePluginServer {
+	mgr.createServer = func(string, func(*pluginapi.AllocateResponse) error, func(*pluginapi.PreStartContainerRequest) error,
+		func(*pluginapi.PreferredAllocationRequest) AllocationPolicy, *pluginapi.DevicePluginOptions) devicePluginServer {
+		return &serverStub{}
+	}
+	if err := mgr.Run(context.Background()); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
+
+func TestRunInvalidSettings(t *testing.T) {
+	registrationMode = "unknown"
+	defer func() { registrationMode = kubeletRegistration }()
+
+	mgr := NewManager("testnamespace", &devicePluginStub{})
+	if err := mgr.Run(context.Background()); !IsFatal(err) {
+		t.Errorf("expected fatal error, but got %+v", err)
+	}
+}
+
+// stoppableDevicePluginStub scans until it's stopped.
+type stoppableDevicePluginStub struct {
+	scanErr  error
+	scanDone chan bool
+}
+
+func (dp *stoppableDevicePluginStub) Scan(n Notifier) error {
+	tree := NewDeviceTree()
+	tree.AddDevice("testdevice", "dev1", DeviceInfo{
+		state: pluginapi.Healthy,
+	})
+	n.Notify(tree)
+
+	if dp.scanErr != nil {
+		return dp.scanErr
+	}
+
+	<-dp.scanDone
+	return nil
+}
+
+func (dp *stoppableDevicePluginStub) StopScan() {
+	dp.scanDone <- true
+}
+
+func TestRunStop(t *testing.T) {
+	tcases := []struct {
+		name        string
+		scanErr     error
+		serveErr    error
+		expectedErr bool
+	}{
+		{
+			name: "Cancelled",
+		},
+		{
+			name:        "Scan fails",
+			scanErr:     Fatal(errors.New("fake scan error")),
+			expectedErr: true,
+		},
+		{
+			name:        "Serve fails",
+			serveErr:    errors.Wrap(Fatal(errors.New("fake serve error")), "wrapped"),
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tcases {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &serverStub{serveErr: tt.serveErr}
+			mgr := NewManager("testnamespace", &stoppableDevicePluginStub{
+				scanErr:  tt.scanErr,
+				scanDone: make(chan bool, 1),
+			})
+			mgr.createServer = func(string, func(*pluginapi.AllocateResponse) error, func(*pluginapi.PreStartContainerRequest) error,
+				func(*pluginapi.PreferredAllocationRequest) AllocationPolicy, *pluginapi.DevicePluginOptions) devicePluginServer {
+				return srv
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if !tt.expectedErr {
+				time.AfterFunc(100*time.Millisecond, cancel)
+			} else {
+				defer cancel()
+			}
+
+			err := mgr.Run(ctx)
+			if tt.expectedErr && err == nil {
+				t.Error("expected error, but got nothing")
+			}
+			if !tt.expectedErr && err != nil {
+				t.Errorf("unexpected error: %+v", err)
+			}
+			if !srv.stopped {
+				t.Error("server hasn't been stopped")
+			}
+			if len(mgr.servers) != 0 {
+				t.Errorf("expected no servers, but got %d", len(mgr.servers))
+			}
+		})
+	}
+}
+
+// endlessDevicePluginStub scans forever without implementing ScanStopper.
+type endlessDevicePluginStub struct {
+	scanEnded chan bool
+}
+
+func (dp *endlessDevicePluginStub) Scan(n Notifier) error {
+	defer close(dp.scanEnded)
+
+	for {
+		tree := NewDeviceTree()
+		tree.AddDevice("testdevice", "dev1", DeviceInfo{
+			state: pluginapi.Healthy,
+		})
+		n.Notify(tree)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunEndsScan(t *testing.T) {
+	dp := &endlessDevicePluginStub{scanEnded: make(chan bool)}
+	mgr := NewManager("testnamespace", dp)
+	mgr.createServer = func(string, func(*pluginapi.AllocateResponse) error, func(*pluginapi.PreStartContainerRequest) error,
+		func(*pluginapi.PreferredAllocationRequest) AllocationPolicy, *pluginapi.DevicePluginOptions) devicePluginServer {
 		return &serverStub{}
 	}
-	mgr.Run()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if err := mgr.Run(ctx); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	select {
+	case <-dp.scanEnded:
+	case <-time.After(time.Second):
+		t.Error("scan goroutine still running")
+	}
 }
@@ -0,0 +1,210 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"flag"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	metricsNamespace = "device_plugin"
+	metricsPath      = "/metrics"
+)
+
+var (
+	// metricsAddress is shared by all device plugins built with this package.
+	metricsAddress string
+
+	metricsRegistry = prometheus.NewRegistry()
+
+	devicesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "devices",
+		Help:      "Number of devices per device type and health state.",
+	}, []string{"device_type", "health"})
+
+	allocationsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "allocations_total",
+		Help:      "Number of Allocate() calls per device type and result.",
+	}, []string{"device_type", "result"})
+
+	registrationsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registrations_total",
+		Help:      "Number of successful registrations with kubelet per device type.",
+	}, []string{"device_type"})
+
+	serversGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "servers",
+		Help:      "Number of running device plugin gRPC servers.",
+	})
+
+	deviceTypeUpdatesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "device_type_updates_total",
+		Help:      "Number of device type changes detected by scans per kind of change.",
+	}, []string{"kind"})
+
+	scanDurationHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "scan_duration_seconds",
+		Help:      "Duration of device scans.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+
+	healthTransitionsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "health_transitions_total",
+		Help:      "Number of device health changes per device type and new health state.",
+	}, []string{"device_type", "health"})
+
+	configReloadsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reloads_total",
+		Help:      "Number of configuration reloads per result.",
+	}, []string{"result"})
+
+	scanErrorsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "scan_errors_total",
+		Help:      "Number of failed device scans.",
+	})
+
+	restartsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "restarts_total",
+		Help:      "Number of restarts after transient failures per component.",
+	}, []string{"component"})
+)
+
+// Results of Allocate() calls.
+const (
+	allocationSuccess = "success"
+	allocationFailure = "failure"
+)
+
+// Components restarted after failures.
+const (
+	componentScan   = "scan"
+	componentServer = "server"
+)
+
+// Results of configuration reloads.
+const (
+	configReloadSuccess = "success"
+	configReloadFailure = "failure"
+)
+
+func init() {
+	flag.StringVar(&metricsAddress, "metrics-address", "",
+		"address to expose Prometheus metrics at, e.g. ':9090' (disabled if empty)")
+
+	metricsRegistry.MustRegister(
+		devicesGauge,
+		allocationsCounter,
+		registrationsCounter,
+		serversGauge,
+		deviceTypeUpdatesCounter,
+		scanDurationHistogram,
+		scanErrorsCounter,
+		healthTransitionsCounter,
+		configReloadsCounter,
+		restartsCounter,
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector(),
+	)
+}
+
+// ObserveScan records duration and result of a device scan started at
+// the given time. It's meant to be called by Scanner implementations.
+func ObserveScan(start time.Time, err error) {
+	scanDurationHistogram.Observe(time.Since(start).Seconds())
+	if err != nil {
+		scanErrorsCounter.Inc()
+	}
+}
+
+// RegisterCollector registers a plugin specific collector whose metrics are
+// exposed together with the metrics of the framework.
+func RegisterCollector(collector prometheus.Collector) error {
+	return errors.Wrap(metricsRegistry.Register(collector), "Failed to register collector")
+}
+
+// setDevicesMetric updates the number of devices of the given device type.
+func setDevicesMetric(devType string, devices map[string]DeviceInfo) {
+	counts := map[string]int{
+		pluginapi.Healthy:   0,
+		pluginapi.Unhealthy: 0,
+	}
+	for _, dev := range devices {
+		counts[dev.state]++
+	}
+	for health, count := range counts {
+		devicesGauge.WithLabelValues(devType, health).Set(float64(count))
+	}
+}
+
+// deleteDevicesMetric removes the device counters of the given device type.
+func deleteDevicesMetric(devType string) {
+	devicesGauge.DeleteLabelValues(devType, pluginapi.Healthy)
+	devicesGauge.DeleteLabelValues(devType, pluginapi.Unhealthy)
+}
+
+// startMetricsServer starts serving metrics and the handlers registered
+// with the given mux at the given address. It returns a function shutting
+// the server down.
+func startMetricsServer(address string, mux *http.ServeMux) (func(), error) {
+	mux.Handle(metricsPath, promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	return startHTTPServer(address, mux)
+}
+
+// startHTTPServer starts serving the handlers registered with the given mux
+// at the given address. It returns a function shutting the server down.
+func startHTTPServer(address string, mux *http.ServeMux) (func(), error) {
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to listen to %s", address)
+	}
+
+	httpServer := &http.Server{Handler: mux}
+
+	go func() {
+		klog.V(1).Infof("Serving HTTP at %s", lis.Addr())
+		if err := httpServer.Serve(lis); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("HTTP server at %s failed: %+v", lis.Addr(), err)
+		}
+	}()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			klog.Warningf("Failed to shut down HTTP server at %s: %+v", lis.Addr(), err)
+		}
+	}, nil
+}
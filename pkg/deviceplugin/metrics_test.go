@@ -0,0 +1,103 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestDevicesMetric(t *testing.T) {
+	setDevicesMetric("metricstest", map[string]DeviceInfo{
+		"dev1": {state: pluginapi.Healthy},
+		"dev2": {state: pluginapi.Healthy},
+		"dev3": {state: pluginapi.Unhealthy},
+	})
+
+	if value := testutil.ToFloat64(devicesGauge.WithLabelValues("metricstest", pluginapi.Healthy)); value != 2 {
+		t.Errorf("expected 2 healthy devices, but got %v", value)
+	}
+	if value := testutil.ToFloat64(devicesGauge.WithLabelValues("metricstest", pluginapi.Unhealthy)); value != 1 {
+		t.Errorf("expected 1 unhealthy device, but got %v", value)
+	}
+
+	deleteDevicesMetric("metricstest")
+	if value := testutil.ToFloat64(devicesGauge.WithLabelValues("metricstest", pluginapi.Healthy)); value != 0 {
+		t.Errorf("expected deleted metric, but got %v", value)
+	}
+}
+
+func TestAllocationsMetric(t *testing.T) {
+	srv := &server{
+		devType: "metricstest",
+		devices: map[string]DeviceInfo{
+			"dev1": {state: pluginapi.Healthy},
+		},
+	}
+
+	for _, id := range []string{"dev1", "dev2"} {
+		srv.Allocate(nil, &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+				{DevicesIDs: []string{id}},
+			},
+		})
+	}
+
+	if value := testutil.ToFloat64(allocationsCounter.WithLabelValues("metricstest", allocationSuccess)); value != 1 {
+		t.Errorf("expected 1 successful allocation, but got %v", value)
+	}
+	if value := testutil.ToFloat64(allocationsCounter.WithLabelValues("metricstest", allocationFailure)); value != 1 {
+		t.Errorf("expected 1 failed allocation, but got %v", value)
+	}
+}
+
+func TestObserveScan(t *testing.T) {
+	before := testutil.ToFloat64(scanErrorsCounter)
+	ObserveScan(time.Now(), nil)
+	ObserveScan(time.Now(), errors.New("fake scan error"))
+	if value := testutil.ToFloat64(scanErrorsCounter); value != before+1 {
+		t.Errorf("expected %v scan errors, but got %v", before+1, value)
+	}
+}
+
+func TestRegisterCollector(t *testing.T) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "metricstest_value", Help: "Test value."})
+	if err := RegisterCollector(gauge); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer metricsRegistry.Unregister(gauge)
+
+	if err := RegisterCollector(gauge); err == nil {
+		t.Error("expected error for duplicate collector, but got success")
+	}
+}
+
+func TestStartMetricsServer(t *testing.T) {
+	stop, err := startMetricsServer("127.0.0.1:0", http.NewServeMux())
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	stop()
+
+	if _, err = startMetricsServer("invalid address", http.NewServeMux()); err == nil {
+		t.Error("expected error, but got nothing")
+	}
+}
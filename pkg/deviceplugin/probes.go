@@ -0,0 +1,312 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// Paths of the liveness and readiness probes.
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+
+	probeOK       = "ok"
+	probeDegraded = "degraded"
+	probeFailed   = "failed"
+)
+
+// Probe settings shared by all device plugins built with this package.
+var (
+	probeAddress             string
+	livenessFailureThreshold time.Duration
+	readinessMinDevices      int
+	readinessMaxScanAge      time.Duration
+)
+
+func init() {
+	flag.StringVar(&probeAddress, "probe-address", "",
+		"address to serve the "+healthzPath+" and "+readyzPath+" probes at, e.g. ':8080' (disabled if empty, the metrics server serves them too)")
+	flag.DurationVar(&livenessFailureThreshold, "liveness-failure-threshold", 5*time.Minute,
+		"time the scan or a gRPC server may keep failing before "+healthzPath+" fails")
+	flag.IntVar(&readinessMinDevices, "readiness-min-devices", 0,
+		"number of healthy devices every resource needs before "+readyzPath+" succeeds (a plugin without resources is ready if 0)")
+	flag.DurationVar(&readinessMaxScanAge, "readiness-max-scan-age", 0,
+		"maximum age of the last successful scan for "+readyzPath+" to succeed (no limit if 0)")
+}
+
+// probeCriteria defines when the probes fail.
+type probeCriteria struct {
+	// Time a component may fail before the liveness probe fails.
+	failureThreshold time.Duration
+	// Number of healthy devices required per resource for readiness.
+	minDevices int
+	// Maximum age of the last successful scan for readiness, 0 if unlimited.
+	maxScanAge time.Duration
+}
+
+func defaultProbeCriteria() probeCriteria {
+	return probeCriteria{
+		failureThreshold: livenessFailureThreshold,
+		minDevices:       readinessMinDevices,
+		maxScanAge:       readinessMaxScanAge,
+	}
+}
+
+// serverStatus is the state of a gRPC server reported by devicePluginServer.
+type serverStatus struct {
+	state             serverState
+	registered        bool
+	registrationError string
+}
+
+// failure is a component of Manager being restarted.
+type failure struct {
+	Error string    `json:"error"`
+	Since time.Time `json:"since"`
+}
+
+// resource is a served resource tracked by status.
+type resource struct {
+	srv     devicePluginServer
+	devices int
+	healthy int
+}
+
+// resourceReport is the state of a resource in statusReport.
+type resourceReport struct {
+	State             string `json:"state"`
+	Registered        bool   `json:"registered"`
+	RegistrationError string `json:"registrationError,omitempty"`
+	Devices           int    `json:"devices"`
+	HealthyDevices    int    `json:"healthyDevices"`
+}
+
+// statusReport is the JSON report of the probes.
+type statusReport struct {
+	Status    string                    `json:"status"`
+	Reasons   []string                  `json:"reasons,omitempty"`
+	LastScan  *time.Time                `json:"lastScan,omitempty"`
+	Failures  map[string]failure        `json:"failures,omitempty"`
+	Resources map[string]resourceReport `json:"resources"`
+}
+
+// status tracks the failed components of Manager being restarted and
+// the served resources.
+type status struct {
+	criteria probeCriteria
+	// Component -> failure.
+	failures map[string]failure
+	// Resource name -> resource.
+	resources map[string]*resource
+	lastScan  time.Time
+	mutex     sync.RWMutex
+}
+
+func newStatus() *status {
+	return &status{
+		criteria:  defaultProbeCriteria(),
+		failures:  make(map[string]failure),
+		resources: make(map[string]*resource),
+	}
+}
+
+func (s *status) setFailure(component string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	since := time.Now()
+	if f, failed := s.failures[component]; failed {
+		since = f.Since
+	}
+	s.failures[component] = failure{Error: err.Error(), Since: since}
+}
+
+func (s *status) clearFailure(component string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, failed := s.failures[component]; failed {
+		klog.V(1).Infof("Component %s recovered", component)
+		delete(s.failures, component)
+	}
+}
+
+// scanned records a successful scan.
+func (s *status) scanned() {
+	s.clearFailure(componentScan)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastScan = time.Now()
+}
+
+// setResource records the server and the devices of a resource.
+func (s *status) setResource(resourceName string, srv devicePluginServer, devices map[string]DeviceInfo) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r := &resource{srv: srv, devices: len(devices)}
+	for _, dev := range devices {
+		if dev.state == pluginapi.Healthy {
+			r.healthy++
+		}
+	}
+	s.resources[resourceName] = r
+}
+
+func (s *status) removeResource(resourceName string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.resources, resourceName)
+}
+
+// report returns the current status. The reasons for failing the probes
+// are left to the probes.
+func (s *status) report() statusReport {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	report := statusReport{
+		Status:    probeOK,
+		Resources: make(map[string]resourceReport, len(s.resources)),
+	}
+	if !s.lastScan.IsZero() {
+		lastScan := s.lastScan
+		report.LastScan = &lastScan
+	}
+	if len(s.failures) > 0 {
+		report.Status = probeDegraded
+		report.Failures = make(map[string]failure, len(s.failures))
+		for component, f := range s.failures {
+			report.Failures[component] = f
+		}
+	}
+	for name, r := range s.resources {
+		srvStatus := r.srv.Status()
+		report.Resources[name] = resourceReport{
+			State:             srvStatus.state.String(),
+			Registered:        srvStatus.registered,
+			RegistrationError: srvStatus.registrationError,
+			Devices:           r.devices,
+			HealthyDevices:    r.healthy,
+		}
+	}
+
+	return report
+}
+
+// liveness returns the reasons the liveness probe fails for.
+func (s *status) liveness(report *statusReport, now time.Time) []string {
+	reasons := []string{}
+	for _, component := range sortedKeys(report.Failures) {
+		f := report.Failures[component]
+		if now.Sub(f.Since) >= s.criteria.failureThreshold {
+			reasons = append(reasons, fmt.Sprintf("%s failing since %s: %s", component, f.Since.Format(time.RFC3339), f.Error))
+		}
+	}
+
+	return reasons
+}
+
+// readiness returns the reasons the readiness probe fails for.
+func (s *status) readiness(report *statusReport, now time.Time) []string {
+	reasons := []string{}
+	switch {
+	case report.LastScan == nil:
+		reasons = append(reasons, "no successful scan yet")
+	case s.criteria.maxScanAge > 0 && now.Sub(*report.LastScan) > s.criteria.maxScanAge:
+		reasons = append(reasons, fmt.Sprintf("last successful scan at %s", report.LastScan.Format(time.RFC3339)))
+	}
+	if len(report.Resources) == 0 && s.criteria.minDevices > 0 {
+		reasons = append(reasons, "no resources")
+	}
+
+	names := make([]string, 0, len(report.Resources))
+	for name := range report.Resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		reasons = append(reasons, s.resourceReasons(name, report.Resources[name])...)
+	}
+
+	return reasons
+}
+
+func (s *status) resourceReasons(name string, r resourceReport) []string {
+	reasons := []string{}
+	if r.State != serving.String() {
+		reasons = append(reasons, fmt.Sprintf("%s is %s", name, r.State))
+	}
+	if !r.Registered {
+		reason := fmt.Sprintf("%s is not registered with kubelet", name)
+		if r.RegistrationError != "" {
+			reason += ": " + r.RegistrationError
+		}
+		reasons = append(reasons, reason)
+	}
+	if r.HealthyDevices < s.criteria.minDevices {
+		reasons = append(reasons, fmt.Sprintf("%s has %d healthy devices, %d required", name, r.HealthyDevices, s.criteria.minDevices))
+	}
+
+	return reasons
+}
+
+// probe returns a handler reporting the status in JSON. The status code is
+// 503 Service Unavailable if the given check finds any reasons to fail.
+func (s *status) probe(check func(*statusReport, time.Time) []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := s.report()
+		if reasons := check(&report, time.Now()); len(reasons) > 0 {
+			report.Status = probeFailed
+			report.Reasons = reasons
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status == probeFailed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			klog.Warningf("Failed to encode status: %+v", err)
+		}
+	})
+}
+
+// register adds the probes to the given mux.
+func (s *status) register(mux *http.ServeMux) {
+	mux.Handle(healthzPath, s.probe(s.liveness))
+	mux.Handle(readyzPath, s.probe(s.readiness))
+}
+
+func sortedKeys(failures map[string]failure) []string {
+	keys := make([]string, 0, len(failures))
+	for key := range failures {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
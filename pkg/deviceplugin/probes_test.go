@@ -0,0 +1,182 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// statusServerStub is a serverStub with the given status.
+type statusServerStub struct {
+	serverStub
+	status serverStatus
+}
+
+func (s *statusServerStub) Status() serverStatus {
+	return s.status
+}
+
+func TestProbes(t *testing.T) {
+	healthy := map[string]DeviceInfo{
+		"dev1": {state: pluginapi.Healthy},
+		"dev2": {state: pluginapi.Unhealthy},
+	}
+	registered := &statusServerStub{status: serverStatus{state: serving, registered: true}}
+
+	tcases := []struct {
+		name             string
+		criteria         probeCriteria
+		setup            func(s *status)
+		expectedHealthz  []string
+		expectedReadyz   []string
+		expectedResource *resourceReport
+	}{
+		{
+			name:           "no scan",
+			criteria:       probeCriteria{minDevices: 1},
+			setup:          func(s *status) {},
+			expectedReadyz: []string{"no successful scan yet", "no resources"},
+		},
+		{
+			name:     "ready",
+			criteria: probeCriteria{minDevices: 1, maxScanAge: time.Minute},
+			setup: func(s *status) {
+				s.scanned()
+				s.setResource("intel.com/dev", registered, healthy)
+			},
+			expectedResource: &resourceReport{State: "serving", Registered: true, Devices: 2, HealthyDevices: 1},
+		},
+		{
+			name:  "no devices on the node",
+			setup: func(s *status) { s.scanned() },
+		},
+		{
+			name:     "old scan",
+			criteria: probeCriteria{maxScanAge: time.Minute},
+			setup: func(s *status) {
+				s.lastScan = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			},
+			expectedReadyz: []string{"last successful scan at 2020-01-01T00:00:00Z"},
+		},
+		{
+			name:     "not enough healthy devices",
+			criteria: probeCriteria{minDevices: 2},
+			setup: func(s *status) {
+				s.scanned()
+				s.setResource("intel.com/dev", registered, healthy)
+			},
+			expectedReadyz: []string{"intel.com/dev has 1 healthy devices, 2 required"},
+		},
+		{
+			name: "not registered",
+			setup: func(s *status) {
+				s.scanned()
+				s.setResource("intel.com/dev", &statusServerStub{
+					status: serverStatus{state: uninitialized, registrationError: "fake error"},
+				}, healthy)
+			},
+			expectedReadyz: []string{
+				"intel.com/dev is uninitialized",
+				"intel.com/dev is not registered with kubelet: fake error",
+			},
+			expectedResource: &resourceReport{State: "uninitialized", RegistrationError: "fake error", Devices: 2, HealthyDevices: 1},
+		},
+		{
+			name:     "failing below threshold",
+			criteria: probeCriteria{failureThreshold: time.Hour},
+			setup: func(s *status) {
+				s.scanned()
+				s.setFailure(componentScan, errors.New("fake scan error"))
+			},
+		},
+		{
+			name: "failing above threshold",
+			setup: func(s *status) {
+				s.setFailure(componentServer+"/dev", errors.New("fake serve error"))
+				s.failures[componentServer+"/dev"] = failure{
+					Error: "fake serve error",
+					Since: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+				}
+				s.scanned()
+			},
+			expectedHealthz: []string{"server/dev failing since 2020-01-01T00:00:00Z: fake serve error"},
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newStatus()
+			s.criteria = tc.criteria
+			tc.setup(s)
+
+			mux := http.NewServeMux()
+			s.register(mux)
+			for path, expected := range map[string][]string{healthzPath: tc.expectedHealthz, readyzPath: tc.expectedReadyz} {
+				rec := httptest.NewRecorder()
+				mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+				var report statusReport
+				if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+					t.Fatalf("invalid report at %s: %+v", path, err)
+				}
+				expectedCode := http.StatusOK
+				if len(expected) > 0 {
+					expectedCode = http.StatusServiceUnavailable
+				}
+				if rec.Code != expectedCode {
+					t.Errorf("%s: expected status code %d, but got %d", path, expectedCode, rec.Code)
+				}
+				if !reflect.DeepEqual(report.Reasons, expected) {
+					t.Errorf("%s: expected reasons %q, but got %q", path, expected, report.Reasons)
+				}
+				if r, ok := report.Resources["intel.com/dev"]; tc.expectedResource != nil && (!ok || r != *tc.expectedResource) {
+					t.Errorf("%s: expected resource %+v, but got %+v", path, *tc.expectedResource, r)
+				}
+			}
+		})
+	}
+}
+
+func TestStatusFailures(t *testing.T) {
+	s := newStatus()
+
+	s.setFailure(componentScan, errors.New("first error"))
+	since := s.failures[componentScan].Since
+	s.setFailure(componentScan, errors.New("second error"))
+	if f := s.failures[componentScan]; f.Since != since || f.Error != "second error" {
+		t.Errorf("expected the failure to be updated keeping its start time, but got %+v", f)
+	}
+	if report := s.report(); report.Status != probeDegraded {
+		t.Errorf("expected degraded status, but got %s", report.Status)
+	}
+
+	s.scanned()
+	if report := s.report(); report.Status != probeOK || report.LastScan == nil {
+		t.Errorf("expected healthy status after scan, but got %+v", report)
+	}
+
+	s.setResource("intel.com/dev", &serverStub{}, nil)
+	s.removeResource("intel.com/dev")
+	if report := s.report(); len(report.Resources) != 0 {
+		t.Errorf("expected no resources, but got %+v", report.Resources)
+	}
+}
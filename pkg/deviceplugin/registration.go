@@ -0,0 +1,92 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"flag"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+const (
+	// PluginsRegistryPath is kubelet's directory watched for plugin sockets.
+	PluginsRegistryPath = "/var/lib/kubelet/plugins_registry"
+
+	// Device plugins call kubelet's Register API.
+	kubeletRegistration = "kubelet"
+	// kubelet's plugin watcher finds the device plugin sockets in
+	// PluginsRegistryPath and asks the plugins for their info.
+	pluginWatcherRegistration = "plugin-watcher"
+)
+
+// registrationMode is shared by all device plugins built with this package.
+var registrationMode string
+
+func init() {
+	flag.StringVar(&registrationMode, "registration-mode", kubeletRegistration,
+		"how device plugins register with kubelet: '"+kubeletRegistration+"' (default) calls kubelet's Register API, '"+
+			pluginWatcherRegistration+"' serves the plugin sockets in kubelet's plugin watcher directory "+PluginsRegistryPath)
+}
+
+func validateRegistrationMode(mode string) error {
+	switch mode {
+	case kubeletRegistration, pluginWatcherRegistration:
+		return nil
+	}
+
+	return errors.Errorf("Unknown registration mode %q", mode)
+}
+
+// registrationServer implements registerapi.RegistrationServer interface
+// queried by kubelet's plugin watcher.
+type registrationServer struct {
+	devType      string
+	resourceName string
+	// Records the registration status, if set.
+	setRegistered func(registered bool, err error)
+}
+
+func (rs *registrationServer) GetInfo(ctx context.Context, rqt *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
+	// The endpoint is left empty, so kubelet connects to the device plugin
+	// at the socket it has found.
+	return &registerapi.PluginInfo{
+		Type:              registerapi.DevicePlugin,
+		Name:              rs.resourceName,
+		SupportedVersions: []string{pluginapi.Version},
+	}, nil
+}
+
+func (rs *registrationServer) NotifyRegistrationStatus(ctx context.Context, status *registerapi.RegistrationStatus) (*registerapi.RegistrationStatusResponse, error) {
+	if rs.setRegistered != nil {
+		var err error
+		if !status.PluginRegistered {
+			err = errors.New(status.Error)
+		}
+		rs.setRegistered(status.PluginRegistered, err)
+	}
+
+	if !status.PluginRegistered {
+		klog.Errorf("Device plugin for %s not registered: %s", rs.devType, status.Error)
+		return &registerapi.RegistrationStatusResponse{}, nil
+	}
+
+	registrationsCounter.WithLabelValues(rs.devType).Inc()
+	klog.V(1).Infof("Device plugin for %s registered", rs.devType)
+	return &registerapi.RegistrationStatusResponse{}, nil
+}
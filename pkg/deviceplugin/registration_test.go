@@ -0,0 +1,129 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+func TestValidateRegistrationMode(t *testing.T) {
+	tcases := []struct {
+		mode        string
+		expectedErr bool
+	}{
+		{mode: kubeletRegistration},
+		{mode: pluginWatcherRegistration},
+		{mode: "", expectedErr: true},
+		{mode: "unknown", expectedErr: true},
+	}
+	for _, tc := range tcases {
+		err := validateRegistrationMode(tc.mode)
+		if tc.expectedErr && err == nil {
+			t.Errorf("mode %q: expected error, but got success", tc.mode)
+		}
+		if !tc.expectedErr && err != nil {
+			t.Errorf("mode %q: unexpected error: %+v", tc.mode, err)
+		}
+	}
+}
+
+func TestPluginWatcherRegistration(t *testing.T) {
+	registrationMode = pluginWatcherRegistration
+	defer func() { registrationMode = kubeletRegistration }()
+
+	dir, err := ioutil.TempDir("", "dpregistry")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := newServer("testtype", nil, nil, nil, nil)
+	errCh := make(chan error, 1)
+	go func() {
+		// No kubelet to call, the plugin watcher calls the plugin.
+		errCh <- srv.Serve("intel.com", dir)
+	}()
+
+	pluginSocket := path.Join(dir, "intel.com-testtype.sock")
+	if err = waitForServer(pluginSocket, 10*time.Second); err != nil {
+		t.Fatalf("server not started: %+v", err)
+	}
+
+	conn, err := grpc.Dial(pluginSocket, grpc.WithInsecure(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+	if err != nil {
+		t.Fatalf("failed to get connection: %+v", err)
+	}
+	defer conn.Close()
+
+	registration := registerapi.NewRegistrationClient(conn)
+	info, err := registration.GetInfo(context.Background(), &registerapi.InfoRequest{})
+	if err != nil {
+		t.Fatalf("unexpected GetInfo error: %+v", err)
+	}
+	expected := &registerapi.PluginInfo{
+		Type:              registerapi.DevicePlugin,
+		Name:              "intel.com/testtype",
+		SupportedVersions: []string{pluginapi.Version},
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Errorf("expected plugin info %+v, but got %+v", expected, info)
+	}
+
+	before := testutil.ToFloat64(registrationsCounter.WithLabelValues("testtype"))
+	for _, registered := range []bool{false, true} {
+		_, err = registration.NotifyRegistrationStatus(context.Background(), &registerapi.RegistrationStatus{
+			PluginRegistered: registered,
+		})
+		if err != nil {
+			t.Errorf("unexpected NotifyRegistrationStatus error: %+v", err)
+		}
+	}
+	if value := testutil.ToFloat64(registrationsCounter.WithLabelValues("testtype")); value != before+1 {
+		t.Errorf("expected %v registrations, but got %v", before+1, value)
+	}
+	if status := srv.Status(); status.state != serving || !status.registered {
+		t.Errorf("expected registered server, but got %+v", status)
+	}
+
+	// kubelet talks to the device plugin over the same socket.
+	if _, err = pluginapi.NewDevicePluginClient(conn).GetDevicePluginOptions(context.Background(), &pluginapi.Empty{}); err != nil {
+		t.Errorf("unexpected GetDevicePluginOptions error: %+v", err)
+	}
+
+	if err = srv.Stop(); err != nil {
+		t.Errorf("unexpected Stop error: %+v", err)
+	}
+	if err = <-errCh; err != nil {
+		t.Errorf("unexpected Serve error: %+v", err)
+	}
+	if _, err = os.Stat(pluginSocket); !os.IsNotExist(err) {
+		t.Errorf("socket %s not removed", pluginSocket)
+	}
+}
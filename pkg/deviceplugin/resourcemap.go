@@ -0,0 +1,258 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"flag"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog"
+
+	"github.com/intel/intel-device-plugins-for-kubernetes/pkg/topology"
+)
+
+// resourceMapFile is shared by all device plugins built with this package.
+var resourceMapFile string
+
+// pciAddressRegex matches PCI addresses in sysfs paths.
+var pciAddressRegex = regexp.MustCompile(`^[0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`)
+
+// findSysFsDevice is replaced in unit tests.
+var findSysFsDevice = topology.FindSysFsDevice
+
+func init() {
+	flag.StringVar(&resourceMapFile, "resource-map", "",
+		"YAML file with rules to rename device types and to drop devices (no rules if empty)")
+}
+
+// resourceMap renames device types and drops devices found by Scanner before
+// they're served to kubelet.
+type resourceMap struct {
+	// Device type -> new device type. Several device types renamed to
+	// the same name are merged.
+	Rename map[string]string `json:"rename,omitempty"`
+	// Devices matching any of the rules are dropped.
+	Drop []dropRule `json:"drop,omitempty"`
+}
+
+// dropRule matches devices by exactly one of ID, IDRegex or PCIAddress,
+// optionally limited to one device type as reported by Scanner.
+type dropRule struct {
+	DeviceType string `json:"deviceType,omitempty"`
+	ID         string `json:"id,omitempty"`
+	IDRegex    string `json:"idRegex,omitempty"`
+	PCIAddress string `json:"pciAddress,omitempty"`
+
+	idRegex *regexp.Regexp
+}
+
+// loadResourceMap loads resourceMap from the given YAML file. No file
+// means no resourceMap.
+func loadResourceMap(path string) (*resourceMap, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	rm := &resourceMap{}
+	if err := LoadConfig(path, rm); err != nil {
+		return nil, err
+	}
+
+	return rm, nil
+}
+
+// Validate implements ConfigValidator interface.
+func (rm *resourceMap) Validate() error {
+	for from, to := range rm.Rename {
+		if errs := deviceTypeErrors(to); len(errs) > 0 {
+			return errors.Errorf("Invalid resource name %q for device type %s: %s", to, from, strings.Join(errs, ", "))
+		}
+	}
+
+	for i := range rm.Drop {
+		if err := rm.Drop[i].init(); err != nil {
+			return errors.WithMessagef(err, "Invalid drop rule %d", i)
+		}
+	}
+
+	return nil
+}
+
+// deviceTypeErrors checks the given device type can be used as the name of
+// extended resources, i.e. as the part after the namespace.
+func deviceTypeErrors(devType string) []string {
+	if strings.Contains(devType, "/") {
+		return []string{"must not contain '/'"}
+	}
+
+	return validation.IsQualifiedName(devType)
+}
+
+func (rule *dropRule) init() error {
+	set := 0
+	for _, field := range []string{rule.ID, rule.IDRegex, rule.PCIAddress} {
+		if field != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("Exactly one of id, idRegex and pciAddress must be set")
+	}
+
+	if rule.IDRegex != "" {
+		var err error
+		if rule.idRegex, err = regexp.Compile(rule.IDRegex); err != nil {
+			return errors.Wrapf(err, "Invalid idRegex %q", rule.IDRegex)
+		}
+	}
+
+	if rule.PCIAddress != "" && !pciAddressRegex.MatchString(rule.PCIAddress) {
+		return errors.Errorf("Invalid pciAddress %q, expected e.g. 0000:00:02.0", rule.PCIAddress)
+	}
+
+	return nil
+}
+
+func (rule *dropRule) matches(devType, id string, info DeviceInfo) bool {
+	if rule.DeviceType != "" && rule.DeviceType != devType {
+		return false
+	}
+
+	switch {
+	case rule.ID != "":
+		return rule.ID == id
+	case rule.idRegex != nil:
+		return rule.idRegex.MatchString(id)
+	default:
+		return id == rule.PCIAddress || hasPCIAddress(info, rule.PCIAddress)
+	}
+}
+
+// hasPCIAddress checks if any of the device nodes belongs to the PCI device
+// with the given address.
+func hasPCIAddress(info DeviceInfo, address string) bool {
+	for _, node := range info.nodes {
+		sysfsPath, err := findSysFsDevice(node.HostPath)
+		if err != nil {
+			klog.V(4).Infof("Unable to find PCI address of %s: %+v", node.HostPath, err)
+			continue
+		}
+
+		for _, elem := range strings.Split(sysfsPath, string(filepath.Separator)) {
+			if elem == address {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (rm *resourceMap) dropped(devType, id string, info DeviceInfo) bool {
+	for i := range rm.Drop {
+		if rm.Drop[i].matches(devType, id, info) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apply returns a new device tree with the device types renamed and the
+// matching devices dropped. Device types with names invalid for extended
+// resources are dropped as well.
+func (rm *resourceMap) apply(tree DeviceTree) DeviceTree {
+	// Sorted, so the same device wins on every scan if merged device
+	// types have devices with the same ID.
+	devTypes := make([]string, 0, len(tree))
+	for devType := range tree {
+		devTypes = append(devTypes, devType)
+	}
+	sort.Strings(devTypes)
+
+	result := NewDeviceTree()
+	for _, devType := range devTypes {
+		newType := rm.rename(devType)
+		if errs := deviceTypeErrors(newType); len(errs) > 0 {
+			klog.Errorf("Dropping device type %s, invalid resource name: %s", newType, strings.Join(errs, ", "))
+			continue
+		}
+
+		for id, info := range tree[devType] {
+			if rm.dropped(devType, id, info) {
+				klog.V(4).Infof("Dropping device %s of type %s", id, devType)
+				continue
+			}
+			if _, exists := result[newType][id]; exists {
+				klog.Warningf("Dropping device %s of type %s, merged type %s has a device with the same ID", id, devType, newType)
+				continue
+			}
+			if newType != devType {
+				info.scannedType = devType
+			}
+			result.AddDevice(newType, id, info)
+		}
+	}
+
+	return result
+}
+
+// rename returns the name the given device type is served with.
+func (rm *resourceMap) rename(devType string) string {
+	if rm == nil {
+		return devType
+	}
+	if to, ok := rm.Rename[devType]; ok {
+		return to
+	}
+
+	return devType
+}
+
+// scannedTypes returns the device types, as reported by Scanner, renamed to
+// the given name, sorted, or the name itself if no device type is.
+func (rm *resourceMap) scannedTypes(devType string) []string {
+	if rm == nil {
+		return []string{devType}
+	}
+
+	devTypes := []string{}
+	for from, to := range rm.Rename {
+		if to == devType && from != devType {
+			devTypes = append(devTypes, from)
+		}
+	}
+	sort.Strings(devTypes)
+	if len(devTypes) == 0 {
+		return []string{devType}
+	}
+
+	return devTypes
+}
+
+// scannedDeviceType returns the device type of the device as reported by
+// Scanner given the type it's served with.
+func (info DeviceInfo) scannedDeviceType(devType string) string {
+	if info.scannedType != "" {
+		return info.scannedType
+	}
+
+	return devType
+}
@@ -0,0 +1,230 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/intel/intel-device-plugins-for-kubernetes/pkg/topology"
+)
+
+func TestLoadResourceMap(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "resourcemap")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	tcases := []struct {
+		name        string
+		data        string
+		expectedErr bool
+	}{
+		{
+			name: "rename and drop",
+			data: "rename:\n  i915: gpu\ndrop:\n- id: card1\n- deviceType: i915\n  idRegex: ^card[2-9]$\n- pciAddress: 0000:00:02.0\n",
+		},
+		{
+			name:        "too long resource name",
+			data:        "rename:\n  i915: " + strings.Repeat("a", 64) + "\n",
+			expectedErr: true,
+		},
+		{
+			name:        "invalid resource name",
+			data:        "rename:\n  i915: gpu/i915\n",
+			expectedErr: true,
+		},
+		{
+			name:        "drop rule without match",
+			data:        "drop:\n- deviceType: i915\n",
+			expectedErr: true,
+		},
+		{
+			name:        "drop rule with two matches",
+			data:        "drop:\n- id: card0\n  idRegex: card.*\n",
+			expectedErr: true,
+		},
+		{
+			name:        "invalid regex",
+			data:        "drop:\n- idRegex: card[\n",
+			expectedErr: true,
+		},
+		{
+			name:        "invalid PCI address",
+			data:        "drop:\n- pciAddress: 00:02.0\n",
+			expectedErr: true,
+		},
+		{
+			name:        "unknown field",
+			data:        "merge:\n  gpu: [i915]\n",
+			expectedErr: true,
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			file := path.Join(tmpdir, "resources.yaml")
+			if err := ioutil.WriteFile(file, []byte(tc.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			rm, err := loadResourceMap(file)
+			if tc.expectedErr && err == nil {
+				t.Error("expected error, but got success")
+			}
+			if !tc.expectedErr && (err != nil || rm == nil) {
+				t.Errorf("unexpected error: %+v", err)
+			}
+		})
+	}
+
+	if rm, err := loadResourceMap(""); rm != nil || err != nil {
+		t.Errorf("expected no resource map, but got %+v, %+v", rm, err)
+	}
+}
+
+func TestResourceMapApply(t *testing.T) {
+	findSysFsDevice = func(dev string) (string, error) {
+		switch dev {
+		case "/dev/dri/card0":
+			return "/sys/devices/pci0000:00/0000:00:02.0/drm/card0", nil
+		case "/dev/dri/card1":
+			return "/sys/devices/pci0000:00/0000:00:03.0/drm/card1", nil
+		}
+		return "", errors.Errorf("no device %s", dev)
+	}
+	defer func() { findSysFsDevice = topology.FindSysFsDevice }()
+
+	card := func(name string) DeviceInfo {
+		return DeviceInfo{
+			state: pluginapi.Healthy,
+			nodes: []pluginapi.DeviceSpec{{HostPath: "/dev/dri/" + name}},
+		}
+	}
+	tree := NewDeviceTree()
+	tree.AddDevice("i915", "card0-0", card("card0"))
+	tree.AddDevice("i915", "card1-0", card("card1"))
+	tree.AddDevice("cy1_dc0", "0000:02:00.1", DeviceInfo{state: pluginapi.Healthy})
+	tree.AddDevice("cy2_dc0", "0000:02:00.2", DeviceInfo{state: pluginapi.Healthy})
+	tree.AddDevice("cy2_dc0", "0000:02:00.3", DeviceInfo{state: pluginapi.Healthy})
+	tree.AddDevice("dup", "0000:02:00.2", DeviceInfo{state: pluginapi.Unhealthy})
+	tree.AddDevice(strings.Repeat("a", 64), "dev0", DeviceInfo{state: pluginapi.Healthy})
+
+	tcases := []struct {
+		name     string
+		rm       *resourceMap
+		expected map[string][]string
+	}{
+		{
+			name: "no rules",
+			rm:   &resourceMap{},
+			expected: map[string][]string{
+				"i915":    {"card0-0", "card1-0"},
+				"cy1_dc0": {"0000:02:00.1"},
+				"cy2_dc0": {"0000:02:00.2", "0000:02:00.3"},
+				"dup":     {"0000:02:00.2"},
+			},
+		},
+		{
+			name: "rename and merge",
+			rm: &resourceMap{
+				Rename: map[string]string{
+					"i915":    "gpu",
+					"cy1_dc0": "qat",
+					"cy2_dc0": "qat",
+					"dup":     "qat",
+				},
+			},
+			expected: map[string][]string{
+				"gpu": {"card0-0", "card1-0"},
+				"qat": {"0000:02:00.1", "0000:02:00.2", "0000:02:00.3"},
+			},
+		},
+		{
+			name: "drop",
+			rm: &resourceMap{
+				Drop: []dropRule{
+					{PCIAddress: "0000:00:03.0"},
+					{PCIAddress: "0000:02:00.1"},
+					{DeviceType: "cy2_dc0", IDRegex: `\.3$`},
+					{DeviceType: "dup", ID: "0000:02:00.2"},
+				},
+			},
+			expected: map[string][]string{
+				"i915":    {"card0-0"},
+				"cy2_dc0": {"0000:02:00.2"},
+			},
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.rm.Validate(); err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			result := make(map[string][]string)
+			for devType, devices := range tc.rm.apply(tree) {
+				result[devType] = deviceIDs(devices)
+				sort.Strings(result[devType])
+			}
+			if !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("expected %v, but got %v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestResourceMapScannedTypes(t *testing.T) {
+	rm := &resourceMap{
+		Rename: map[string]string{
+			"cy1_dc0": "qat",
+			"cy2_dc0": "qat",
+			"i915":    "gpu",
+		},
+	}
+
+	tree := NewDeviceTree()
+	tree.AddDevice("cy1_dc0", "0000:02:00.1", DeviceInfo{state: pluginapi.Healthy})
+	tree.AddDevice("dc", "0000:03:00.1", DeviceInfo{state: pluginapi.Healthy})
+	result := rm.apply(tree)
+	if devType := result["qat"]["0000:02:00.1"].scannedDeviceType("qat"); devType != "cy1_dc0" {
+		t.Errorf("expected renamed device of type cy1_dc0, but got %s", devType)
+	}
+	if devType := result["dc"]["0000:03:00.1"].scannedDeviceType("dc"); devType != "dc" {
+		t.Errorf("expected device of type dc, but got %s", devType)
+	}
+
+	for devType, expected := range map[string][]string{
+		"qat":  {"cy1_dc0", "cy2_dc0"},
+		"gpu":  {"i915"},
+		"dc":   {"dc"},
+		"i915": {"i915"},
+	} {
+		if devTypes := rm.scannedTypes(devType); !reflect.DeepEqual(devTypes, expected) {
+			t.Errorf("%s: expected %v, but got %v", devType, expected, devTypes)
+		}
+	}
+	if devTypes := (*resourceMap)(nil).scannedTypes("qat"); !reflect.DeepEqual(devTypes, []string{"qat"}) {
+		t.Errorf("expected qat without resource map, but got %v", devTypes)
+	}
+}
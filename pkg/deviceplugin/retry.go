@@ -0,0 +1,97 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"time"
+)
+
+const (
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = time.Minute
+)
+
+// fatalError marks errors Manager doesn't recover from.
+type fatalError struct {
+	error
+}
+
+func (e fatalError) Cause() error {
+	return e.error
+}
+
+// Fatal marks the given error as fatal. When Scan() or serving a device
+// type fails with a fatal error, Manager stops and Run() returns the error.
+// All the other errors are considered transient: the failed Scan() or
+// gRPC server is restarted with exponential backoff.
+func Fatal(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return fatalError{err}
+}
+
+// IsFatal checks if the given error, or any error it wraps, is marked
+// as fatal with Fatal().
+func IsFatal(err error) bool {
+	type causer interface {
+		Cause() error
+	}
+
+	for err != nil {
+		if _, ok := err.(fatalError); ok {
+			return true
+		}
+		cause, ok := err.(causer)
+		if !ok {
+			return false
+		}
+		err = cause.Cause()
+	}
+
+	return false
+}
+
+// backoff computes exponentially growing delays between restarts.
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+func newBackoff(initial, max time.Duration) *backoff {
+	return &backoff{
+		initial: initial,
+		max:     max,
+	}
+}
+
+// next returns the delay before the next restart of something that failed
+// after running for the given time. The delay is reset if it ran for at
+// least the maximum delay.
+func (b *backoff) next(ranFor time.Duration) time.Duration {
+	switch {
+	case b.current == 0 || ranFor >= b.max:
+		b.current = b.initial
+	case b.current < b.max:
+		b.current *= 2
+	}
+	if b.current > b.max {
+		b.current = b.max
+	}
+
+	return b.current
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestIsFatal(t *testing.T) {
+	tcases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{
+			name: "no error",
+		},
+		{
+			name: "transient error",
+			err:  errors.New("transient"),
+		},
+		{
+			name:     "fatal error",
+			err:      Fatal(errors.New("fatal")),
+			expected: true,
+		},
+		{
+			name:     "wrapped fatal error",
+			err:      errors.Wrap(errors.WithMessage(Fatal(errors.New("fatal")), "message"), "wrapped"),
+			expected: true,
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if IsFatal(tc.err) != tc.expected {
+				t.Errorf("expected IsFatal() to be %v", tc.expected)
+			}
+		})
+	}
+
+	if Fatal(nil) != nil {
+		t.Error("expected no error")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(time.Second, 5*time.Second)
+	for i, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if delay := b.next(0); delay != expected {
+			t.Errorf("restart %d: expected delay %v, but got %v", i, expected, delay)
+		}
+	}
+
+	if delay := b.next(5 * time.Second); delay != time.Second {
+		t.Errorf("expected delay reset to 1s after long run, but got %v", delay)
+	}
+}
+
+// flakyScannerStub fails the given number of scans before scanning until
+// it's stopped.
+type flakyScannerStub struct {
+	failures int32
+	scans    int32
+	scanDone chan bool
+}
+
+func (dp *flakyScannerStub) Scan(n Notifier) error {
+	tree := NewDeviceTree()
+	tree.AddDevice("testdevice", "dev1", DeviceInfo{
+		state: pluginapi.Healthy,
+	})
+	n.Notify(tree)
+
+	if atomic.AddInt32(&dp.scans, 1) <= dp.failures {
+		return errors.New("fake transient scan error")
+	}
+
+	<-dp.scanDone
+	return nil
+}
+
+func (dp *flakyScannerStub) StopScan() {
+	dp.scanDone <- true
+}
+
+func TestRunRestarts(t *testing.T) {
+	dp := &flakyScannerStub{
+		failures: 3,
+		scanDone: make(chan bool, 1),
+	}
+	mgr := NewManager("testnamespace", dp)
+	mgr.initialBackoff = time.Millisecond
+	mgr.maxBackoff = 10 * time.Millisecond
+
+	// The first server fails.
+	var servers int32
+	mgr.createServer = func(string, func(*pluginapi.AllocateResponse) error, func(*pluginapi.PreStartContainerRequest) error,
+		func(*pluginapi.PreferredAllocationRequest) AllocationPolicy, *pluginapi.DevicePluginOptions) devicePluginServer {
+		if atomic.AddInt32(&servers, 1) == 1 {
+			return &serverStub{serveErr: errors.New("fake transient serve error")}
+		}
+		return &serverStub{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- mgr.Run(ctx)
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt32(&dp.scans) <= dp.failures || atomic.LoadInt32(&servers) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("scanner or server not restarted: %d scans, %d servers", atomic.LoadInt32(&dp.scans), atomic.LoadInt32(&servers))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if report := mgr.status.report(); report.Status != probeOK {
+		t.Errorf("expected healthy status after restarts, but got %+v", report)
+	}
+}
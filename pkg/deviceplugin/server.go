@@ -29,6 +29,7 @@ import (
 
 	"k8s.io/klog"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
 )
 
 type serverState int
@@ -40,48 +41,106 @@ const (
 	terminating
 )
 
+func (state serverState) String() string {
+	switch state {
+	case uninitialized:
+		return "uninitialized"
+	case serving:
+		return "serving"
+	case terminating:
+		return "terminating"
+	}
+
+	return "unknown"
+}
+
 // devicePluginServer maintains a gRPC server satisfying
 // pluginapi.PluginInterfaceServer interfaces.
 // This internal unexposed interface simplifies unit testing.
 type devicePluginServer interface {
-	Serve(namespace string) error
+	Serve(namespace, pluginDir string) error
 	Stop() error
 	Update(devices map[string]DeviceInfo)
+	Status() serverStatus
 }
 
 // server implements devicePluginServer and pluginapi.PluginInterfaceServer interfaces.
 type server struct {
-	devType           string
-	grpcServer        *grpc.Server
-	updatesCh         chan map[string]DeviceInfo
+	devType    string
+	namespace  string
+	socket     string
+	grpcServer *grpc.Server
+	updatesCh  chan map[string]DeviceInfo
+	// Closed by Stop().
+	stopCh            chan struct{}
 	devices           map[string]DeviceInfo
 	postAllocate      func(*pluginapi.AllocateResponse) error
 	preStartContainer func(*pluginapi.PreStartContainerRequest) error
-	state             serverState
+	allocationPolicy  func(*pluginapi.PreferredAllocationRequest) AllocationPolicy
+	// Options requested by the plugin, nil for all supported options.
+	options *pluginapi.DevicePluginOptions
+	// Audit log of the calls, nil if disabled.
+	audit *auditLog
+	state serverState
+	// Registration status with kubelet.
+	registered        bool
+	registrationError string
 	stateMutex        sync.Mutex
+	// Guards devices read by the gRPC calls.
+	devicesMutex sync.Mutex
 }
 
 // newServer creates a new server satisfying the devicePluginServer interface.
 func newServer(devType string,
 	postAllocate func(*pluginapi.AllocateResponse) error,
-	preStartContainer func(*pluginapi.PreStartContainerRequest) error) devicePluginServer {
+	preStartContainer func(*pluginapi.PreStartContainerRequest) error,
+	allocationPolicy func(*pluginapi.PreferredAllocationRequest) AllocationPolicy,
+	options *pluginapi.DevicePluginOptions) devicePluginServer {
+	if options != nil && options.PreStartRequired && preStartContainer == nil {
+		klog.Warningf("Ignoring PreStartRequired option for %s, PreStartContainer() is not implemented", devType)
+	}
+	if options != nil && options.GetPreferredAllocationAvailable && allocationPolicy == nil {
+		klog.Warningf("Ignoring GetPreferredAllocationAvailable option for %s, AllocationPolicy() is not implemented", devType)
+	}
+
 	return &server{
 		devType:           devType,
 		updatesCh:         make(chan map[string]DeviceInfo, 1), // TODO: is 1 needed?
+		stopCh:            make(chan struct{}),
 		devices:           make(map[string]DeviceInfo),
 		postAllocate:      postAllocate,
 		preStartContainer: preStartContainer,
+		allocationPolicy:  allocationPolicy,
+		options:           options,
+		audit:             auditor,
 		state:             uninitialized,
 	}
 }
 
 func (srv *server) GetDevicePluginOptions(ctx context.Context, empty *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	return &pluginapi.DevicePluginOptions{PreStartRequired: srv.preStartContainer != nil}, nil
+	return srv.getDevicePluginOptions(), nil
+}
+
+func (srv *server) getDevicePluginOptions() *pluginapi.DevicePluginOptions {
+	options := &pluginapi.DevicePluginOptions{
+		PreStartRequired:                srv.preStartContainer != nil,
+		GetPreferredAllocationAvailable: srv.allocationPolicy != nil,
+	}
+	if srv.options == nil {
+		return options
+	}
+
+	// The plugin can opt out of the APIs it implements, but kubelet must
+	// not call the ones it doesn't.
+	options.PreStartRequired = options.PreStartRequired && srv.options.PreStartRequired
+	options.GetPreferredAllocationAvailable = options.GetPreferredAllocationAvailable && srv.options.GetPreferredAllocationAvailable
+
+	return options
 }
 
 func (srv *server) sendDevices(stream pluginapi.DevicePlugin_ListAndWatchServer) error {
 	resp := new(pluginapi.ListAndWatchResponse)
-	for id, device := range srv.devices {
+	for id, device := range srv.getDevices() {
 		resp.Devices = append(resp.Devices, &pluginapi.Device{
 			ID:       id,
 			Health:   device.state,
@@ -90,7 +149,6 @@ func (srv *server) sendDevices(stream pluginapi.DevicePlugin_ListAndWatchServer)
 	}
 	klog.V(4).Info("Sending to kubelet", resp.Devices)
 	if err := stream.Send(resp); err != nil {
-		srv.Stop()
 		return errors.Wrapf(err, "Cannot update device list")
 	}
 
@@ -104,21 +162,44 @@ func (srv *server) ListAndWatch(empty *pluginapi.Empty, stream pluginapi.DeviceP
 		return err
 	}
 
-	for srv.devices = range srv.updatesCh {
-		if err := srv.sendDevices(stream); err != nil {
-			return err
+	for {
+		select {
+		case <-srv.stopCh:
+			return nil
+		case <-stream.Context().Done():
+			// The stream is gone, e.g. after kubelet restart. Leave
+			// the updates to the stream opened by the new kubelet.
+			klog.V(4).Info("ListAndWatch closed for ", srv.devType)
+			return nil
+		case devices := <-srv.updatesCh:
+			srv.setDevices(devices)
+			if err := srv.sendDevices(stream); err != nil {
+				return err
+			}
 		}
 	}
-
-	return nil
 }
 
 func (srv *server) Allocate(ctx context.Context, rqt *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	start := time.Now()
+	response, err := srv.allocate(rqt)
+	srv.audit.allocate(srv.resourceName(), start, rqt, response, err)
+	if err != nil {
+		allocationsCounter.WithLabelValues(srv.devType, allocationFailure).Inc()
+		return nil, err
+	}
+
+	allocationsCounter.WithLabelValues(srv.devType, allocationSuccess).Inc()
+	return response, nil
+}
+
+func (srv *server) allocate(rqt *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
 	response := new(pluginapi.AllocateResponse)
+	devices := srv.getDevices()
 	for _, crqt := range rqt.ContainerRequests {
 		cresp := new(pluginapi.ContainerAllocateResponse)
 		for _, id := range crqt.DevicesIDs {
-			dev, ok := srv.devices[id]
+			dev, ok := devices[id]
 			if !ok {
 				return nil, errors.Errorf("Invalid allocation request with non-existing device %s", id)
 			}
@@ -131,13 +212,18 @@ func (srv *server) Allocate(ctx context.Context, rqt *pluginapi.AllocateRequest)
 			for i := range dev.mounts {
 				cresp.Mounts = append(cresp.Mounts, &dev.mounts[i])
 			}
-			for key, value := range dev.envs {
-				if cresp.Envs == nil {
-					cresp.Envs = make(map[string]string)
+			for _, envs := range []map[string]string{dev.envs, dev.allocateEnvs} {
+				for key, value := range envs {
+					if cresp.Envs == nil {
+						cresp.Envs = make(map[string]string)
+					}
+					cresp.Envs[key] = value
 				}
-				cresp.Envs[key] = value
 			}
 		}
+		if cdiSpecDir != "" {
+			addCDIAnnotation(cresp, srv.namespace, srv.devType, crqt.DevicesIDs)
+		}
 		response.ContainerResponses = append(response.ContainerResponses, cresp)
 	}
 
@@ -150,33 +236,90 @@ func (srv *server) Allocate(ctx context.Context, rqt *pluginapi.AllocateRequest)
 	return response, nil
 }
 
+// GetPreferredAllocation orders the devices kubelet offers with the policy
+// of the plugin. The devices are the ones last sent to kubelet, so they're
+// known to the server.
+func (srv *server) GetPreferredAllocation(ctx context.Context, rqt *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	if srv.allocationPolicy == nil {
+		return nil, errors.New("GetPreferredAllocation() should not be called as this device plugin doesn't implement it")
+	}
+
+	return PreferredAllocation(srv.allocationPolicy(rqt), srv.getDevices(), rqt)
+}
+
 func (srv *server) PreStartContainer(ctx context.Context, rqt *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
-	if srv.preStartContainer != nil {
-		return new(pluginapi.PreStartContainerResponse), srv.preStartContainer(rqt)
+	if srv.preStartContainer == nil {
+		return nil, errors.New("PreStartContainer() should not be called as this device plugin doesn't implement it")
 	}
 
-	return nil, errors.New("PreStartContainer() should not be called as this device plugin doesn't implement it")
+	start := time.Now()
+	err := srv.preStartContainer(rqt)
+	srv.audit.preStartContainer(srv.resourceName(), start, rqt, err)
+	return new(pluginapi.PreStartContainerResponse), err
 }
 
-// Serve starts a gRPC server to serve pluginapi.PluginInterfaceServer interface.
-func (srv *server) Serve(namespace string) error {
-	return srv.setupAndServe(namespace, pluginapi.DevicePluginPath, pluginapi.KubeletSocket)
+// Serve starts a gRPC server to serve pluginapi.PluginInterfaceServer interface
+// in the given kubelet's directory, i.e. the device plugin directory or,
+// with the plugin watcher registration, the plugin registry directory.
+func (srv *server) Serve(namespace, pluginDir string) error {
+	kubeletSocket := path.Join(pluginDir, path.Base(pluginapi.KubeletSocket))
+	return srv.setupAndServe(namespace, pluginDir, kubeletSocket)
 }
 
-// Stop stops serving pluginapi.PluginInterfaceServer interface.
+// Stop stops serving pluginapi.PluginInterfaceServer interface. Stopping
+// a stopped server does nothing, and a server stopped before Serve() never
+// starts serving.
 func (srv *server) Stop() error {
-	if srv.grpcServer == nil {
-		return errors.New("Can't stop non-existing gRPC server. Calling Stop() before Serve()?")
+	srv.stateMutex.Lock()
+	if srv.state == terminating {
+		srv.stateMutex.Unlock()
+		return nil
+	}
+	srv.state = terminating
+	close(srv.stopCh)
+	grpcServer := srv.grpcServer
+	socket := srv.socket
+	srv.stateMutex.Unlock()
+
+	if grpcServer != nil {
+		grpcServer.Stop()
+	}
+	if socket != "" {
+		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Failed to remove socket %s", socket)
+		}
 	}
-	srv.setState(terminating)
-	srv.grpcServer.Stop()
-	close(srv.updatesCh)
 	return nil
 }
 
-// Update sends updates from Manager to ListAndWatch's event loop.
+// Update sends updates from Manager to ListAndWatch's event loop. Updates
+// of a stopped server are dropped.
 func (srv *server) Update(devices map[string]DeviceInfo) {
-	srv.updatesCh <- devices
+	if srv.getState() == terminating {
+		return
+	}
+	setDevicesMetric(srv.devType, devices)
+	select {
+	case srv.updatesCh <- devices:
+	case <-srv.stopCh:
+	}
+}
+
+// resourceName returns the extended resource name of the served devices.
+func (srv *server) resourceName() string {
+	return srv.namespace + "/" + srv.devType
+}
+
+func (srv *server) setDevices(devices map[string]DeviceInfo) {
+	srv.devicesMutex.Lock()
+	defer srv.devicesMutex.Unlock()
+	srv.devices = devices
+}
+
+func (srv *server) getDevices() map[string]DeviceInfo {
+	srv.devicesMutex.Lock()
+	defer srv.devicesMutex.Unlock()
+	return srv.devices
 }
 
 func (srv *server) setState(state serverState) {
@@ -191,18 +334,79 @@ func (srv *server) getState() serverState {
 	return srv.state
 }
 
+// startServing moves the server to serving state unless it's been stopped.
+func (srv *server) startServing() bool {
+	srv.stateMutex.Lock()
+	defer srv.stateMutex.Unlock()
+	if srv.state == terminating {
+		return false
+	}
+	srv.state = serving
+	return true
+}
+
+// newGRPCServer replaces the gRPC server of the server with a new one,
+// nil if the server has been stopped.
+func (srv *server) newGRPCServer() *grpc.Server {
+	srv.stateMutex.Lock()
+	defer srv.stateMutex.Unlock()
+	if srv.state == terminating {
+		return nil
+	}
+	srv.grpcServer = grpc.NewServer()
+	return srv.grpcServer
+}
+
+// setRegistered records the result of the latest registration with kubelet.
+func (srv *server) setRegistered(registered bool, err error) {
+	srv.stateMutex.Lock()
+	defer srv.stateMutex.Unlock()
+	srv.registered = registered
+	srv.registrationError = ""
+	if err != nil {
+		srv.registrationError = err.Error()
+	}
+}
+
+// Status reports the state of the server and its registration.
+func (srv *server) Status() serverStatus {
+	srv.stateMutex.Lock()
+	defer srv.stateMutex.Unlock()
+	return serverStatus{
+		state:             srv.state,
+		registered:        srv.registered,
+		registrationError: srv.registrationError,
+	}
+}
+
+func (srv *server) setSocket(socket string) {
+	srv.stateMutex.Lock()
+	defer srv.stateMutex.Unlock()
+	srv.socket = socket
+}
+
+func (srv *server) getSocket() string {
+	srv.stateMutex.Lock()
+	defer srv.stateMutex.Unlock()
+	return srv.socket
+}
+
 // setupAndServe binds given gRPC server to device manager, starts it and registers it with kubelet.
-func (srv *server) setupAndServe(namespace string, devicePluginPath string, kubeletSocket string) error {
-	resourceName := namespace + "/" + srv.devType
+func (srv *server) setupAndServe(namespace string, pluginDir string, kubeletSocket string) error {
+	srv.namespace = namespace
+	resourceName := srv.resourceName()
 	pluginPrefix := namespace + "-" + srv.devType
-	srv.setState(serving)
+	if !srv.startServing() {
+		return nil
+	}
 
 	for srv.getState() == serving {
 		pluginEndpoint := pluginPrefix + ".sock"
-		pluginSocket := path.Join(devicePluginPath, pluginEndpoint)
+		pluginSocket := path.Join(pluginDir, pluginEndpoint)
+		srv.setSocket(pluginSocket)
 
 		if err := waitForServer(pluginSocket, time.Second); err == nil {
-			return errors.Errorf("Socket %s is already in use", pluginSocket)
+			return Fatal(errors.Errorf("Socket %s is already in use", pluginSocket))
 		}
 		os.Remove(pluginSocket)
 
@@ -211,39 +415,57 @@ func (srv *server) setupAndServe(namespace string, devicePluginPath string, kube
 			return errors.Wrap(err, "Failed to listen to plugin socket")
 		}
 
-		srv.grpcServer = grpc.NewServer()
-		pluginapi.RegisterDevicePluginServer(srv.grpcServer, srv)
+		grpcServer := srv.newGRPCServer()
+		if grpcServer == nil {
+			// Stopped while setting up, closing the listener removes the socket.
+			lis.Close()
+			return nil
+		}
+		pluginapi.RegisterDevicePluginServer(grpcServer, srv)
+		if registrationMode == pluginWatcherRegistration {
+			registerapi.RegisterRegistrationServer(grpcServer, &registrationServer{
+				devType:       srv.devType,
+				resourceName:  resourceName,
+				setRegistered: srv.setRegistered,
+			})
+		}
 
 		// Starts device plugin service.
 		go func() {
 			klog.V(1).Infof("Start server for %s at: %s", srv.devType, pluginSocket)
-			srv.grpcServer.Serve(lis)
+			grpcServer.Serve(lis)
 		}()
 
 		// Wait for the server to start
 		if err = waitForServer(pluginSocket, 10*time.Second); err != nil {
+			if srv.getState() == terminating {
+				return nil
+			}
 			return err
 		}
 
-		options := &pluginapi.DevicePluginOptions{
-			PreStartRequired: srv.preStartContainer != nil,
-		}
-
-		// Register with Kubelet.
-		err = registerWithKubelet(kubeletSocket, pluginEndpoint, resourceName, options)
-		if err != nil {
-			return err
+		// Register with Kubelet unless its plugin watcher does it.
+		if registrationMode == kubeletRegistration {
+			err = registerWithKubelet(kubeletSocket, pluginEndpoint, resourceName, srv.getDevicePluginOptions())
+			srv.setRegistered(err == nil, err)
+			if err != nil {
+				return err
+			}
+			registrationsCounter.WithLabelValues(srv.devType).Inc()
+			klog.V(1).Infof("Device plugin for %s registered", srv.devType)
 		}
-		klog.V(1).Infof("Device plugin for %s registered", srv.devType)
 
 		// Kubelet removes plugin socket when it (re)starts
-		// plugin must restart in this case
+		// plugin must restart in this case. The plugin watcher
+		// finds the socket again instead, so it's removed only
+		// by Stop().
 		if err = watchFile(pluginSocket); err != nil {
 			return err
 		}
 
+		srv.setRegistered(false, nil)
 		if srv.getState() == serving {
-			srv.grpcServer.Stop()
+			grpcServer.Stop()
 			klog.V(1).Infof("Socket %s removed, restarting", pluginSocket)
 		} else {
 			klog.V(1).Infof("Socket %s shut down", pluginSocket)
@@ -128,6 +128,7 @@ func TestSetupAndServe(t *testing.T) {
 			},
 		},
 		updatesCh: make(chan map[string]DeviceInfo),
+		stopCh:    make(chan struct{}),
 	}
 
 	defer srv.Stop()
@@ -151,6 +152,9 @@ func TestSetupAndServe(t *testing.T) {
 	if err == nil {
 		t.Fatalf("Server was able to start on occupied socket %s: %+v", pluginSocket, err)
 	}
+	if !IsFatal(err) {
+		t.Errorf("Occupied socket %s isn't a fatal error: %+v", pluginSocket, err)
+	}
 
 	conn, err := grpc.Dial(pluginSocket, grpc.WithInsecure(),
 		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
@@ -217,9 +221,22 @@ func TestSetupAndServe(t *testing.T) {
 }
 
 func TestStop(t *testing.T) {
-	srv := &server{}
-	if err := srv.Stop(); err == nil {
-		t.Error("Calling Stop() before Serve() is successful")
+	srv := newServer("testtype", nil, nil, nil, nil).(*server)
+	for i := 0; i < 2; i++ {
+		if err := srv.Stop(); err != nil {
+			t.Errorf("Stop() %d failed: %+v", i, err)
+		}
+	}
+
+	// The server stopped before Serve() doesn't start serving.
+	if err := srv.Serve(namespace, devicePluginPath); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if _, err := os.Stat(path.Join(devicePluginPath, namespace+"-testtype.sock")); err == nil {
+		t.Error("stopped server created its socket")
+	}
+	if status := srv.Status(); status.state != terminating {
+		t.Errorf("expected state %v, but got %v", terminating, status.state)
 	}
 }
 
@@ -358,8 +375,46 @@ func TestAllocate(t *testing.T) {
 	}
 }
 
+func TestAllocateCDI(t *testing.T) {
+	cdiSpecDir = "/var/run/cdi"
+	defer func() { cdiSpecDir = "" }()
+
+	srv := &server{
+		devType:   "dev",
+		namespace: "test.intel.com",
+		devices: map[string]DeviceInfo{
+			"dev1": {
+				state:        pluginapi.Healthy,
+				envs:         map[string]string{"A": "1"},
+				allocateEnvs: map[string]string{"B": "2"},
+			},
+		},
+	}
+	rqt := &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{
+				DevicesIDs: []string{"dev1"},
+			},
+		},
+	}
+
+	resp, err := srv.Allocate(context.Background(), rqt)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	annotation := resp.ContainerResponses[0].Annotations["cdi.k8s.io/test_intel_com_dev"]
+	if annotation != "test.intel.com/dev=dev1" {
+		t.Errorf("unexpected CDI annotation '%s'", annotation)
+	}
+	expectedEnvs := map[string]string{"A": "1", "B": "2"}
+	if envs := resp.ContainerResponses[0].Envs; !reflect.DeepEqual(envs, expectedEnvs) {
+		t.Errorf("expected envs %v, but got %v", expectedEnvs, envs)
+	}
+}
+
 // Minimal implementation of pluginapi.DevicePlugin_ListAndWatchServer
 type listAndWatchServerStub struct {
+	ctx         context.Context
 	testServer  *server
 	generateErr int
 	sendCounter int
@@ -379,7 +434,10 @@ func (s *listAndWatchServerStub) Send(resp *pluginapi.ListAndWatchResponse) erro
 }
 
 func (s *listAndWatchServerStub) Context() context.Context {
-	return nil
+	if s.ctx != nil {
+		return s.ctx
+	}
+	return context.Background()
 }
 
 func (s *listAndWatchServerStub) RecvMsg(m interface{}) error {
@@ -452,9 +510,9 @@ func TestListAndWatch(t *testing.T) {
 	}
 
 	for _, tt := range tcases {
-		devCh := make(chan map[string]DeviceInfo, len(tt.updates))
 		testServer := &server{
-			updatesCh: devCh,
+			updatesCh: make(chan map[string]DeviceInfo),
+			stopCh:    make(chan struct{}),
 		}
 
 		server := &listAndWatchServerStub{
@@ -463,13 +521,29 @@ func TestListAndWatch(t *testing.T) {
 			cdata:       make(chan []*pluginapi.Device, len(tt.updates)+1),
 		}
 
-		// push device infos to DM's channel
+		done := make(chan error, 1)
+		go func() {
+			done <- testServer.ListAndWatch(&pluginapi.Empty{}, server)
+		}()
+
+		// push device infos to DM's channel and stop the server
+		// unless ListAndWatch fails first.
+		var err error
+		returned := false
 		for _, update := range tt.updates {
-			devCh <- update
+			select {
+			case testServer.updatesCh <- update:
+				continue
+			case err = <-done:
+				returned = true
+			}
+			break
+		}
+		if !returned {
+			testServer.Stop()
+			err = <-done
 		}
-		close(devCh)
 
-		err := testServer.ListAndWatch(&pluginapi.Empty{}, server)
 		if err != nil && tt.errorOnCall == 0 {
 			t.Errorf("Test case '%s': got unexpected error %+v", tt.name, err)
 		}
@@ -479,9 +553,100 @@ func TestListAndWatch(t *testing.T) {
 	}
 }
 
+func TestListAndWatchStreamClosed(t *testing.T) {
+	devCh := make(chan map[string]DeviceInfo, 1)
+	testServer := &server{
+		updatesCh: devCh,
+		stopCh:    make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &listAndWatchServerStub{
+		ctx:        ctx,
+		testServer: testServer,
+		cdata:      make(chan []*pluginapi.Device, 1),
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- testServer.ListAndWatch(&pluginapi.Empty{}, stream)
+	}()
+	<-stream.cdata
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	// The update is left for other streams.
+	devCh <- map[string]DeviceInfo{}
+	select {
+	case <-devCh:
+	default:
+		t.Error("closed stream consumed the update")
+	}
+}
+
 func TestGetDevicePluginOptions(t *testing.T) {
-	srv := &server{}
-	srv.GetDevicePluginOptions(nil, nil)
+	preStartContainer := func(*pluginapi.PreStartContainerRequest) error { return nil }
+	allocationPolicy := func(*pluginapi.PreferredAllocationRequest) AllocationPolicy {
+		return nil
+	}
+	tcases := []struct {
+		name     string
+		srv      *server
+		expected pluginapi.DevicePluginOptions
+	}{
+		{
+			name: "no optional interfaces",
+			srv:  &server{},
+		},
+		{
+			name: "all optional interfaces",
+			srv: &server{
+				preStartContainer: preStartContainer,
+				allocationPolicy:  allocationPolicy,
+			},
+			expected: pluginapi.DevicePluginOptions{
+				PreStartRequired:                true,
+				GetPreferredAllocationAvailable: true,
+			},
+		},
+		{
+			name: "options turned off by plugin",
+			srv: &server{
+				preStartContainer: preStartContainer,
+				allocationPolicy:  allocationPolicy,
+				options: &pluginapi.DevicePluginOptions{
+					GetPreferredAllocationAvailable: true,
+				},
+			},
+			expected: pluginapi.DevicePluginOptions{
+				GetPreferredAllocationAvailable: true,
+			},
+		},
+		{
+			name: "options without optional interfaces",
+			srv: &server{
+				options: &pluginapi.DevicePluginOptions{
+					PreStartRequired:                true,
+					GetPreferredAllocationAvailable: true,
+				},
+			},
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			options, err := tc.srv.GetDevicePluginOptions(nil, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if options.PreStartRequired != tc.expected.PreStartRequired ||
+				options.GetPreferredAllocationAvailable != tc.expected.GetPreferredAllocationAvailable {
+				t.Errorf("expected options %+v, but got %+v", tc.expected, *options)
+			}
+		})
+	}
 }
 
 func TestPreStartContainer(t *testing.T) {
@@ -517,13 +682,90 @@ func TestPreStartContainer(t *testing.T) {
 	}
 }
 
+func TestGetPreferredAllocation(t *testing.T) {
+	devices := map[string]DeviceInfo{
+		"dev1": {state: pluginapi.Healthy},
+		"dev2": {state: pluginapi.Healthy},
+	}
+	reverse := func(*pluginapi.PreferredAllocationRequest) AllocationPolicy {
+		return func(devices map[string]DeviceInfo, candidates, mustInclude []string) []string {
+			ordered := make([]string, 0, len(candidates))
+			for i := len(candidates) - 1; i >= 0; i-- {
+				ordered = append(ordered, candidates[i])
+			}
+			return ordered
+		}
+	}
+	tcases := []struct {
+		name             string
+		allocationPolicy func(*pluginapi.PreferredAllocationRequest) AllocationPolicy
+		available        []string
+		expectedIDs      []string
+		expectedError    bool
+	}{
+		{
+			name:             "policy applied to known devices",
+			allocationPolicy: reverse,
+			available:        []string{"dev1", "dev2"},
+			expectedIDs:      []string{"dev2"},
+		},
+		{
+			name: "no policy",
+			allocationPolicy: func(*pluginapi.PreferredAllocationRequest) AllocationPolicy {
+				return nil
+			},
+			available:   []string{"dev2", "dev1"},
+			expectedIDs: []string{"dev1"},
+		},
+		{
+			name:             "device unknown to server",
+			allocationPolicy: reverse,
+			available:        []string{"dev1", "dev3"},
+			expectedError:    true,
+		},
+		{
+			name:          "not implemented",
+			available:     []string{"dev1"},
+			expectedError: true,
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := &server{
+				devices:          devices,
+				allocationPolicy: tc.allocationPolicy,
+			}
+			options, _ := srv.GetDevicePluginOptions(nil, nil)
+			if options.GetPreferredAllocationAvailable != (tc.allocationPolicy != nil) {
+				t.Errorf("wrong GetPreferredAllocationAvailable option: %v", options.GetPreferredAllocationAvailable)
+			}
+			resp, err := srv.GetPreferredAllocation(nil, &pluginapi.PreferredAllocationRequest{
+				ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+					{AvailableDeviceIDs: tc.available, AllocationSize: 1},
+				},
+			})
+			if !tc.expectedError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tc.expectedError && err == nil {
+				t.Error("didn't failed when expected to fail")
+			}
+			if err == nil && !reflect.DeepEqual(resp.ContainerResponses[0].DeviceIDs, tc.expectedIDs) {
+				t.Errorf("expected %v, but got %v", tc.expectedIDs, resp.ContainerResponses[0].DeviceIDs)
+			}
+		})
+	}
+}
+
 func TestNewServer(t *testing.T) {
-	_ = newServer("test", nil, nil)
+	_ = newServer("test", nil, nil, nil, nil)
 }
 
 func TestUpdate(t *testing.T) {
-	srv := &server{
-		updatesCh: make(chan map[string]DeviceInfo, 1),
-	}
+	srv := newServer("testtype", nil, nil, nil, nil).(*server)
+	srv.Update(make(map[string]DeviceInfo))
+
+	// Updates of stopped servers are dropped, even if nobody reads them.
+	srv.Stop()
+	srv.Update(make(map[string]DeviceInfo))
 	srv.Update(make(map[string]DeviceInfo))
 }
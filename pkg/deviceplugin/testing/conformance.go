@@ -0,0 +1,262 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testing
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	// Period of health checks, short so that MakeUnhealthy takes effect
+	// well within the timeout.
+	healthCheckPeriod = 100 * time.Millisecond
+	// Device ID no plugin is supposed to have.
+	nonexistentDeviceID = "conformance-nonexistent-device"
+)
+
+// Conformance is a suite of tests every device plugin is expected to pass.
+// The plugin is run by deviceplugin.Manager against a fake kubelet.
+type Conformance struct {
+	// Namespace of the plugin's resources, e.g. "gpu.intel.com".
+	Namespace string
+	// Plugin under test, usually scanning a fake sysfs tree.
+	Plugin dpapi.Scanner
+	// DeviceTypes the plugin is expected to register.
+	DeviceTypes []string
+	// MakeUnhealthy, if set, makes at least one device of every device type
+	// unhealthy, e.g. by changing the fake sysfs tree, so that the plugin's
+	// next scan or HealthChecker reports it. Health checks are done every
+	// 100 milliseconds. Health transitions aren't tested otherwise.
+	MakeUnhealthy func() error
+	// Timeout for the plugin to react, 10 seconds if unset.
+	Timeout time.Duration
+}
+
+// Run runs the suite.
+func (c *Conformance) Run(t *testing.T) {
+	if c.Timeout == 0 {
+		c.Timeout = defaultTimeout
+	}
+
+	// Keep the directory name short, socket paths are limited.
+	dir, err := ioutil.TempDir("", "dp")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	kubelet, err := NewKubelet(dir)
+	if err != nil {
+		t.Fatalf("unable to start fake kubelet: %+v", err)
+	}
+	defer kubelet.Stop()
+
+	mgr := dpapi.NewManager(c.Namespace, c.Plugin)
+	mgr.SetDevicePluginPath(dir)
+	mgr.SetHealthCheckPeriod(healthCheckPeriod)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- mgr.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		if err := <-errCh; err != nil {
+			t.Errorf("device plugin failed: %+v", err)
+		}
+	}()
+
+	if !t.Run("Registration", func(t *testing.T) { c.testRegistration(t, kubelet) }) {
+		return
+	}
+	t.Run("ListAndWatch", func(t *testing.T) { c.testListAndWatch(t, kubelet) })
+	t.Run("Options", func(t *testing.T) { c.testOptions(t, kubelet) })
+	t.Run("Allocate", func(t *testing.T) { c.testAllocate(t, kubelet) })
+	t.Run("KubeletRestart", func(t *testing.T) { c.testKubeletRestart(t, kubelet) })
+	t.Run("HealthTransitions", func(t *testing.T) { c.testHealthTransitions(t, kubelet) })
+}
+
+func (c *Conformance) resourceName(devType string) string {
+	return c.Namespace + "/" + devType
+}
+
+// plugins waits for all the expected device types to get registered.
+func (c *Conformance) plugins(t *testing.T, kubelet *Kubelet) map[string]*Plugin {
+	plugins := make(map[string]*Plugin)
+	for _, devType := range c.DeviceTypes {
+		plugin, err := kubelet.Plugin(c.resourceName(devType), c.Timeout)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		plugins[devType] = plugin
+	}
+
+	return plugins
+}
+
+// devices waits for the plugin to list its devices.
+func (c *Conformance) devices(t *testing.T, plugin *Plugin) []*pluginapi.Device {
+	devices, err := plugin.WaitForDevices(func(devices []*pluginapi.Device) bool {
+		return len(devices) > 0
+	}, c.Timeout)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	return devices
+}
+
+func (c *Conformance) testRegistration(t *testing.T, kubelet *Kubelet) {
+	if len(c.DeviceTypes) == 0 {
+		t.Fatal("no device types expected, nothing to test")
+	}
+
+	for _, devType := range c.DeviceTypes {
+		if err := ValidateResourceName(c.resourceName(devType)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	for devType, plugin := range c.plugins(t, kubelet) {
+		if err := ValidateSocketPath(plugin.Endpoint); err != nil {
+			t.Errorf("%s: %+v", devType, err)
+		}
+	}
+}
+
+func (c *Conformance) testListAndWatch(t *testing.T, kubelet *Kubelet) {
+	for devType, plugin := range c.plugins(t, kubelet) {
+		ids := make(map[string]bool)
+		for _, dev := range c.devices(t, plugin) {
+			if dev.ID == "" {
+				t.Errorf("%s: device with empty ID", devType)
+			}
+			if ids[dev.ID] {
+				t.Errorf("%s: duplicate device ID %s", devType, dev.ID)
+			}
+			ids[dev.ID] = true
+
+			if dev.Health != pluginapi.Healthy && dev.Health != pluginapi.Unhealthy {
+				t.Errorf("%s: device %s has invalid health '%s'", devType, dev.ID, dev.Health)
+			}
+		}
+	}
+}
+
+func (c *Conformance) testOptions(t *testing.T, kubelet *Kubelet) {
+	for devType, plugin := range c.plugins(t, kubelet) {
+		options, err := plugin.GetDevicePluginOptions()
+		if err != nil {
+			t.Errorf("%s: GetDevicePluginOptions() failed: %+v", devType, err)
+			continue
+		}
+
+		if plugin.Options == nil {
+			plugin.Options = &pluginapi.DevicePluginOptions{}
+		}
+		if !reflect.DeepEqual(options, plugin.Options) {
+			t.Errorf("%s: options %v differ from the registered ones %v", devType, options, plugin.Options)
+		}
+	}
+}
+
+func (c *Conformance) testAllocate(t *testing.T, kubelet *Kubelet) {
+	for devType, plugin := range c.plugins(t, kubelet) {
+		for _, dev := range c.devices(t, plugin) {
+			resp, err := plugin.Allocate(dev.ID)
+			if dev.Health != pluginapi.Healthy {
+				if err == nil {
+					t.Errorf("%s: unhealthy device %s allocated", devType, dev.ID)
+				}
+				continue
+			}
+
+			if err != nil {
+				t.Errorf("%s: failed to allocate %s: %+v", devType, dev.ID, err)
+				continue
+			}
+			if len(resp.ContainerResponses) != 1 {
+				t.Errorf("%s: expected 1 container response for %s, but got %d", devType, dev.ID, len(resp.ContainerResponses))
+			}
+		}
+
+		if _, err := plugin.Allocate(nonexistentDeviceID); err == nil {
+			t.Errorf("%s: nonexistent device allocated", devType)
+		}
+	}
+}
+
+func (c *Conformance) testKubeletRestart(t *testing.T, kubelet *Kubelet) {
+	before := make(map[string]int)
+	for devType, plugin := range c.plugins(t, kubelet) {
+		before[devType] = len(c.devices(t, plugin))
+	}
+
+	if err := kubelet.Restart(); err != nil {
+		t.Fatalf("unable to restart fake kubelet: %+v", err)
+	}
+
+	for devType, plugin := range c.plugins(t, kubelet) {
+		if after := len(c.devices(t, plugin)); after != before[devType] {
+			t.Errorf("%s: expected %d devices after kubelet restart, but got %d", devType, before[devType], after)
+		}
+	}
+}
+
+func (c *Conformance) testHealthTransitions(t *testing.T, kubelet *Kubelet) {
+	if c.MakeUnhealthy == nil {
+		t.Skip("no way to make devices unhealthy")
+	}
+
+	plugins := c.plugins(t, kubelet)
+	if err := c.MakeUnhealthy(); err != nil {
+		t.Fatalf("unable to make devices unhealthy: %+v", err)
+	}
+
+	for devType, plugin := range plugins {
+		devices, err := plugin.WaitForDevices(func(devices []*pluginapi.Device) bool {
+			for _, dev := range devices {
+				if dev.Health == pluginapi.Unhealthy {
+					return true
+				}
+			}
+			return false
+		}, c.Timeout)
+		if err != nil {
+			t.Errorf("%s: %+v", devType, err)
+			continue
+		}
+
+		for _, dev := range devices {
+			if dev.Health != pluginapi.Unhealthy {
+				continue
+			}
+			if _, err := plugin.Allocate(dev.ID); err == nil {
+				t.Errorf("%s: device %s allocated after turning unhealthy", devType, dev.ID)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testing
+
+import (
+	"flag"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+)
+
+func init() {
+	flag.Set("v", "4") //Enable debug output
+}
+
+// devicePluginStub reports two devices and makes one of them unhealthy on request.
+type devicePluginStub struct {
+	rescan   chan bool
+	scanDone chan bool
+}
+
+func newDevicePluginStub() *devicePluginStub {
+	return &devicePluginStub{
+		rescan:   make(chan bool, 1),
+		scanDone: make(chan bool, 1),
+	}
+}
+
+func (dp *devicePluginStub) Scan(notifier dpapi.Notifier) error {
+	health := pluginapi.Healthy
+	for {
+		tree := dpapi.NewDeviceTree()
+		tree.AddDevice("stub", "dev0", dpapi.NewDeviceInfo(pluginapi.Healthy, nil, nil, nil))
+		tree.AddDevice("stub", "dev1", dpapi.NewDeviceInfo(health, nil, nil, map[string]string{"STUB": "1"}))
+		notifier.Notify(tree)
+
+		select {
+		case <-dp.scanDone:
+			return nil
+		case <-dp.rescan:
+			health = pluginapi.Unhealthy
+		}
+	}
+}
+
+func (dp *devicePluginStub) StopScan() {
+	dp.scanDone <- true
+}
+
+func TestConformance(t *testing.T) {
+	plugin := newDevicePluginStub()
+	suite := &Conformance{
+		Namespace:   "stub.intel.com",
+		Plugin:      plugin,
+		DeviceTypes: []string{"stub"},
+		MakeUnhealthy: func() error {
+			plugin.rescan <- true
+			return nil
+		},
+	}
+	suite.Run(t)
+}
+
+func TestValidateResourceName(t *testing.T) {
+	tcases := []struct {
+		resourceName string
+		expectedErr  bool
+	}{
+		{resourceName: "gpu.intel.com/i915"},
+		{resourceName: "fpga.intel.com/af-695.d84.aVKNtusxV3qMNmj5-qCB9thCTcSko8QT-J5DNoP5BAs"},
+		{resourceName: "i915", expectedErr: true},
+		{resourceName: "gpu.intel.com/i915/0", expectedErr: true},
+		{resourceName: "gpu.intel.com/i 915", expectedErr: true},
+		{resourceName: "kubernetes.io/gpu", expectedErr: true},
+		{resourceName: "node.kubernetes.io/gpu", expectedErr: true},
+	}
+
+	for _, tt := range tcases {
+		err := ValidateResourceName(tt.resourceName)
+		if tt.expectedErr && err == nil {
+			t.Errorf("%s: expected error, but got nothing", tt.resourceName)
+		}
+		if !tt.expectedErr && err != nil {
+			t.Errorf("%s: unexpected error: %+v", tt.resourceName, err)
+		}
+	}
+}
+
+func TestValidateSocketPath(t *testing.T) {
+	if err := ValidateSocketPath("gpu.intel.com-i915.sock"); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	long := "fpga.intel.com-af-695.d84.aVKNtusxV3qMNmj5-qCB9thCTcSko8QT-J5DNoP5BAs-and-some-more.sock"
+	if err := ValidateSocketPath(long); err == nil {
+		t.Error("expected error, but got nothing")
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testing provides an in-process fake kubelet and a conformance
+// suite for device plugins built with the deviceplugin package.
+package testing
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// Maximum length of a unix socket path, see sun_path in unix(7).
+	maxSocketPathLen = 107
+
+	pollInterval = 10 * time.Millisecond
+)
+
+// Kubelet is a fake kubelet serving the device plugin registration API in
+// a directory of choice. It talks to the registered device plugins over
+// real unix sockets like kubelet does.
+type Kubelet struct {
+	dir        string
+	grpcServer *grpc.Server
+	plugins    map[string]*Plugin
+	mutex      sync.Mutex
+}
+
+// NewKubelet starts a fake kubelet in the given directory.
+func NewKubelet(dir string) (*Kubelet, error) {
+	k := &Kubelet{
+		dir:     dir,
+		plugins: make(map[string]*Plugin),
+	}
+
+	if err := k.start(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Dir returns the directory device plugins should use.
+func (k *Kubelet) Dir() string {
+	return k.dir
+}
+
+// Socket returns the path to the registration socket.
+func (k *Kubelet) Socket() string {
+	return path.Join(k.dir, path.Base(pluginapi.KubeletSocket))
+}
+
+func (k *Kubelet) start() error {
+	socket := k.Socket()
+	os.Remove(socket)
+
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to listen to %s", socket)
+	}
+
+	k.grpcServer = grpc.NewServer()
+	pluginapi.RegisterRegistrationServer(k.grpcServer, k)
+	go k.grpcServer.Serve(lis)
+
+	return nil
+}
+
+// Stop stops the fake kubelet and disconnects from the registered plugins.
+func (k *Kubelet) Stop() {
+	k.grpcServer.Stop()
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	for resourceName, plugin := range k.plugins {
+		plugin.close()
+		delete(k.plugins, resourceName)
+	}
+}
+
+// Restart simulates a kubelet restart. Like kubelet, the fake removes all
+// the sockets in its directory, so device plugins have to register again.
+func (k *Kubelet) Restart() error {
+	k.Stop()
+
+	files, err := ioutil.ReadDir(k.dir)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read %s", k.dir)
+	}
+	for _, file := range files {
+		if file.Mode()&os.ModeSocket == 0 {
+			continue
+		}
+		if err = os.Remove(path.Join(k.dir, file.Name())); err != nil {
+			return errors.Wrapf(err, "Failed to remove %s", file.Name())
+		}
+	}
+
+	return k.start()
+}
+
+// Register implements pluginapi.RegistrationServer interface. It validates
+// the request the way kubelet does and starts watching the plugin's devices.
+func (k *Kubelet) Register(ctx context.Context, rqt *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	if rqt.Version != pluginapi.Version {
+		return nil, errors.Errorf("Unsupported device plugin API version %s", rqt.Version)
+	}
+
+	if err := ValidateResourceName(rqt.ResourceName); err != nil {
+		return nil, err
+	}
+
+	plugin, err := newPlugin(rqt, path.Join(k.dir, rqt.Endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if old, ok := k.plugins[rqt.ResourceName]; ok {
+		old.close()
+	}
+	k.plugins[rqt.ResourceName] = plugin
+	klog.V(4).Infof("Fake kubelet registered %s at %s", rqt.ResourceName, rqt.Endpoint)
+
+	return &pluginapi.Empty{}, nil
+}
+
+// Plugin waits for the device plugin of the given resource to register
+// and returns it.
+func (k *Kubelet) Plugin(resourceName string, timeout time.Duration) (*Plugin, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		k.mutex.Lock()
+		plugin, ok := k.plugins[resourceName]
+		k.mutex.Unlock()
+
+		if ok {
+			return plugin, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.Errorf("Device plugin for %s hasn't registered in %v", resourceName, timeout)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// ValidateResourceName checks the given name is a valid extended resource
+// name, e.g. "color.example.com/yellow".
+func ValidateResourceName(resourceName string) error {
+	if errs := validation.IsQualifiedName(resourceName); len(errs) > 0 {
+		return errors.Errorf("Invalid resource name %s: %s", resourceName, strings.Join(errs, ", "))
+	}
+
+	parts := strings.Split(resourceName, "/")
+	if len(parts) != 2 {
+		return errors.Errorf("Resource name %s has no namespace", resourceName)
+	}
+	if parts[0] == "kubernetes.io" || strings.HasSuffix(parts[0], ".kubernetes.io") {
+		return errors.Errorf("Resource name %s is in reserved namespace", resourceName)
+	}
+
+	return nil
+}
+
+// ValidateSocketPath checks the socket of the given endpoint fits in the
+// default kubelet directory.
+func ValidateSocketPath(endpoint string) error {
+	socket := path.Join(pluginapi.DevicePluginPath, endpoint)
+	if len(socket) > maxSocketPathLen {
+		return errors.Errorf("Socket path %s is longer than %d characters", socket, maxSocketPathLen)
+	}
+
+	return nil
+}
+
+// Plugin is a device plugin registered with the fake kubelet.
+type Plugin struct {
+	ResourceName string
+	Endpoint     string
+	Options      *pluginapi.DevicePluginOptions
+
+	conn    *grpc.ClientConn
+	client  pluginapi.DevicePluginClient
+	cancel  context.CancelFunc
+	devices []*pluginapi.Device
+	err     error
+	mutex   sync.Mutex
+}
+
+func newPlugin(rqt *pluginapi.RegisterRequest, socket string) (*Plugin, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, socket, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to connect to device plugin at %s", socket)
+	}
+
+	p := &Plugin{
+		ResourceName: rqt.ResourceName,
+		Endpoint:     rqt.Endpoint,
+		Options:      rqt.Options,
+		conn:         conn,
+		client:       pluginapi.NewDevicePluginClient(conn),
+	}
+
+	streamCtx, streamCancel := context.WithCancel(context.Background())
+	p.cancel = streamCancel
+
+	stream, err := p.client.ListAndWatch(streamCtx, &pluginapi.Empty{})
+	if err != nil {
+		p.close()
+		return nil, errors.Wrap(err, "Failed to start ListAndWatch")
+	}
+	go p.watch(stream)
+
+	return p, nil
+}
+
+func (p *Plugin) watch(stream pluginapi.DevicePlugin_ListAndWatchClient) {
+	for {
+		resp, err := stream.Recv()
+
+		p.mutex.Lock()
+		if err != nil {
+			p.err = err
+			p.mutex.Unlock()
+			return
+		}
+		p.devices = resp.Devices
+		p.mutex.Unlock()
+	}
+}
+
+func (p *Plugin) close() {
+	p.cancel()
+	p.conn.Close()
+}
+
+// Devices returns the devices last listed by the plugin.
+func (p *Plugin) Devices() []*pluginapi.Device {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.devices
+}
+
+// WaitForDevices waits until the devices listed by the plugin satisfy
+// the given condition and returns them.
+func (p *Plugin) WaitForDevices(cond func([]*pluginapi.Device) bool, timeout time.Duration) ([]*pluginapi.Device, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		p.mutex.Lock()
+		devices, err := p.devices, p.err
+		p.mutex.Unlock()
+
+		if cond(devices) {
+			return devices, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "ListAndWatch for %s failed", p.ResourceName)
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.Errorf("Devices of %s haven't met the condition in %v", p.ResourceName, timeout)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// GetDevicePluginOptions calls the plugin's GetDevicePluginOptions().
+func (p *Plugin) GetDevicePluginOptions() (*pluginapi.DevicePluginOptions, error) {
+	return p.client.GetDevicePluginOptions(context.Background(), &pluginapi.Empty{})
+}
+
+// Allocate requests the given devices for one container.
+func (p *Plugin) Allocate(ids ...string) (*pluginapi.AllocateResponse, error) {
+	return p.client.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: ids},
+		},
+	})
+}
+
+// PreStartContainer calls the plugin's PreStartContainer() for the given devices.
+func (p *Plugin) PreStartContainer(ids ...string) error {
+	_, err := p.client.PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{
+		DevicesIDs: ids,
+	})
+
+	return err
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog"
+)
+
+const (
+	// Multicast group of the events sent by kernel (as opposed to udev).
+	kernelUeventGroup = 1
+	ueventBufferSize  = 64 * 1024
+)
+
+// netlinkUeventSource reads uevents from a NETLINK_KOBJECT_UEVENT socket.
+// Close wakes up a pending read through a pipe, the file descriptors are
+// closed only after the read has returned.
+type netlinkUeventSource struct {
+	fd int
+	// wake is the pipe polled together with fd.
+	wake [2]int
+	// readLock is held while reading.
+	readLock sync.Mutex
+	closed   int32
+}
+
+func newNetlinkUeventSource() (UeventSource, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create netlink socket")
+	}
+
+	if err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: kernelUeventGroup}); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrap(err, "Failed to bind netlink socket")
+	}
+
+	s := &netlinkUeventSource{fd: fd}
+	if err = unix.Pipe2(s.wake[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrap(err, "Failed to create wake-up pipe")
+	}
+
+	return s, nil
+}
+
+func (s *netlinkUeventSource) ReadUevent() (*Uevent, error) {
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+
+	buf := make([]byte, ueventBufferSize)
+
+	for atomic.LoadInt32(&s.closed) == 0 {
+		fds := []unix.PollFd{
+			{Fd: int32(s.fd), Events: unix.POLLIN},
+			{Fd: int32(s.wake[0]), Events: unix.POLLIN},
+		}
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return nil, errors.Wrap(err, "Failed to poll netlink socket")
+		}
+		if fds[1].Revents != 0 {
+			break
+		}
+
+		n, _, err := unix.Recvfrom(s.fd, buf, unix.MSG_DONTWAIT)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err == unix.ENOBUFS {
+			// The socket buffer overflowed, the socket is still usable.
+			return nil, ErrUeventsLost
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read netlink socket")
+		}
+
+		uevent, err := parseUevent(buf[:n])
+		if err != nil {
+			klog.V(4).Infof("Skipping uevent: %+v", err)
+			continue
+		}
+
+		return uevent, nil
+	}
+
+	return nil, errors.New("uevent source is closed")
+}
+
+func (s *netlinkUeventSource) Close() error {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return nil
+	}
+
+	if _, err := unix.Write(s.wake[1], []byte{0}); err != nil {
+		return errors.Wrap(err, "Failed to wake up uevent reader")
+	}
+
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+
+	err := unix.Close(s.fd)
+	for _, fd := range s.wake {
+		if pipeErr := unix.Close(fd); pipeErr != nil && err == nil {
+			err = pipeErr
+		}
+	}
+
+	return errors.WithStack(err)
+}
+
+// parseUevent parses a kernel uevent message of the form
+// "action@devpath\0KEY=VALUE\0KEY=VALUE\0...".
+func parseUevent(msg []byte) (*Uevent, error) {
+	fields := bytes.Split(bytes.TrimRight(msg, "\x00"), []byte{0})
+
+	header := bytes.SplitN(fields[0], []byte("@"), 2)
+	if len(header) != 2 {
+		return nil, errors.Errorf("malformed uevent header %q", fields[0])
+	}
+
+	uevent := &Uevent{
+		Action:  string(header[0]),
+		DevPath: string(header[1]),
+		Env:     make(map[string]string),
+	}
+	for _, field := range fields[1:] {
+		kv := bytes.SplitN(field, []byte("="), 2)
+		if len(kv) != 2 {
+			continue
+		}
+		uevent.Env[string(kv[0])] = string(kv[1])
+	}
+	uevent.Subsystem = uevent.Env["SUBSYSTEM"]
+
+	return uevent, nil
+}
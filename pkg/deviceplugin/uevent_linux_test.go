@@ -0,0 +1,105 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseUevent(t *testing.T) {
+	tcases := []struct {
+		name        string
+		msg         string
+		expected    *Uevent
+		expectedErr bool
+	}{
+		{
+			name: "Valid uevent",
+			msg:  "add@/devices/pci0000:00/0000:00:02.0/drm/card0\x00ACTION=add\x00DEVPATH=/devices/pci0000:00/0000:00:02.0/drm/card0\x00SUBSYSTEM=drm\x00DEVNAME=dri/card0\x00",
+			expected: &Uevent{
+				Action:    "add",
+				DevPath:   "/devices/pci0000:00/0000:00:02.0/drm/card0",
+				Subsystem: "drm",
+				Env: map[string]string{
+					"ACTION":    "add",
+					"DEVPATH":   "/devices/pci0000:00/0000:00:02.0/drm/card0",
+					"SUBSYSTEM": "drm",
+					"DEVNAME":   "dri/card0",
+				},
+			},
+		},
+		{
+			name:        "Malformed header",
+			msg:         "libudev\x00SUBSYSTEM=drm\x00",
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tcases {
+		t.Run(tt.name, func(t *testing.T) {
+			uevent, err := parseUevent([]byte(tt.msg))
+			if tt.expectedErr {
+				if err == nil {
+					t.Error("expected error, but got nothing")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if !reflect.DeepEqual(uevent, tt.expected) {
+				t.Errorf("expected %+v, but got %+v", tt.expected, uevent)
+			}
+		})
+	}
+}
+
+func TestNetlinkUeventSourceClose(t *testing.T) {
+	source, err := newNetlinkUeventSource()
+	if err != nil {
+		t.Skipf("netlink uevents not available: %+v", err)
+	}
+
+	errs := make(chan error)
+	go func() {
+		for {
+			if _, err := source.ReadUevent(); err != nil && err != ErrUeventsLost {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	// Let the reader block before closing.
+	time.Sleep(50 * time.Millisecond)
+	if err = source.Close(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	select {
+	case err = <-errs:
+		if err == nil {
+			t.Error("expected error from a closed source")
+		}
+	case <-time.After(time.Second):
+		t.Error("pending read not woken up by Close()")
+	}
+
+	if err = source.Close(); err != nil {
+		t.Errorf("unexpected error on second Close(): %+v", err)
+	}
+}
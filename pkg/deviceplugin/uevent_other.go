@@ -0,0 +1,27 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux
+
+package deviceplugin
+
+import (
+	"github.com/pkg/errors"
+)
+
+// newNetlinkUeventSource fails as kernel uevents are read from netlink
+// sockets only on Linux. Watcher polls instead.
+func newNetlinkUeventSource() (UeventSource, error) {
+	return nil, errors.New("kernel uevents are supported only on Linux")
+}
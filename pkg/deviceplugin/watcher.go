@@ -0,0 +1,267 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"k8s.io/klog"
+)
+
+const (
+	// Period of fallback rescans when kernel uevents are received.
+	fallbackScanPeriod = time.Minute
+	// Period of rescans when kernel uevents can't be received,
+	// e.g. when the plugin doesn't run in the host network namespace.
+	pollScanPeriod = 5 * time.Second
+)
+
+// Uevent is a kernel object event.
+type Uevent struct {
+	Action    string
+	DevPath   string
+	Subsystem string
+	Env       map[string]string
+}
+
+// ErrUeventsLost is returned by UeventSource.ReadUevent() if uevents have
+// been dropped, e.g. because the socket buffer overflowed. Reading can
+// continue after it.
+var ErrUeventsLost = errors.New("uevents lost")
+
+// UeventSource is a source of kernel uevents.
+type UeventSource interface {
+	// ReadUevent blocks until the next uevent is received. Errors other
+	// than ErrUeventsLost are fatal.
+	ReadUevent() (*Uevent, error)
+	// Close makes pending and future ReadUevent() calls fail.
+	Close() error
+}
+
+// Watcher turns kernel uevents and file system changes into device
+// rescan triggers. A periodic trigger is kept as a fallback.
+type Watcher struct {
+	uevents   UeventSource
+	fsWatcher *fsnotify.Watcher
+	// Watched directory -> the watched files in it, nil for all.
+	watched    map[string]map[string]bool
+	subsystems map[string]bool
+	period     time.Duration
+	// Period used instead of period if reading uevents fails.
+	pollPeriod time.Duration
+	triggerCh  chan struct{}
+	done       chan struct{}
+	closeOnce  sync.Once
+	wg         sync.WaitGroup
+}
+
+// NewWatcher creates a Watcher triggering rescans on uevents from the given
+// subsystems (all subsystems if empty) and on changes of the given paths.
+// Directories are watched for changes in them, other paths are watched
+// for being created or removed in their parent directories, which must
+// exist. sysfs doesn't notify of changes, so sysfs paths are watched with
+// uevents only.
+func NewWatcher(subsystems []string, paths []string) (*Watcher, error) {
+	var source UeventSource
+
+	period := fallbackScanPeriod
+	source, err := newNetlinkUeventSource()
+	if err != nil {
+		klog.Warningf("Kernel uevents are not available, falling back to polling: %+v", err)
+		source = nil
+		period = pollScanPeriod
+	}
+
+	w, err := newWatcher(source, period, subsystems, paths)
+	if err != nil && source != nil {
+		source.Close()
+	}
+
+	return w, err
+}
+
+func newWatcher(source UeventSource, period time.Duration, subsystems []string, paths []string) (*Watcher, error) {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create file system watcher")
+	}
+
+	watched := make(map[string]map[string]bool)
+	for _, p := range paths {
+		p = path.Clean(p)
+		dir, file := p, ""
+		if fi, err := os.Stat(p); err != nil || !fi.IsDir() {
+			dir, file = path.Dir(p), p
+		}
+
+		files, ok := watched[dir]
+		if !ok {
+			if err := fsWatcher.Add(dir); err != nil {
+				klog.V(4).Infof("Not watching %s: %v", p, err)
+				continue
+			}
+			files = make(map[string]bool)
+			watched[dir] = files
+		}
+		switch {
+		case files == nil:
+		case file == "":
+			watched[dir] = nil
+		default:
+			files[file] = true
+		}
+	}
+
+	w := &Watcher{
+		uevents:    source,
+		fsWatcher:  fsWatcher,
+		watched:    watched,
+		subsystems: make(map[string]bool),
+		period:     period,
+		pollPeriod: pollScanPeriod,
+		triggerCh:  make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	for _, subsystem := range subsystems {
+		w.subsystems[subsystem] = true
+	}
+
+	ueventsCh := make(chan *Uevent)
+	if source != nil {
+		w.wg.Add(1)
+		go w.readUevents(ueventsCh)
+	}
+
+	w.wg.Add(1)
+	go w.run(ueventsCh)
+
+	return w, nil
+}
+
+// Triggers returns a channel receiving a value whenever devices need to be
+// rescanned. Triggers happening before the previous one is consumed are
+// coalesced into one.
+func (w *Watcher) Triggers() <-chan struct{} {
+	return w.triggerCh
+}
+
+// Close stops watching.
+func (w *Watcher) Close() error {
+	var err error
+
+	w.closeOnce.Do(func() {
+		close(w.done)
+		if w.uevents != nil {
+			err = w.uevents.Close()
+		}
+		if fsErr := w.fsWatcher.Close(); fsErr != nil && err == nil {
+			err = errors.WithStack(fsErr)
+		}
+		w.wg.Wait()
+	})
+
+	return err
+}
+
+func (w *Watcher) trigger(reason string) {
+	select {
+	case w.triggerCh <- struct{}{}:
+		klog.V(4).Info("Rescan triggered by ", reason)
+	default:
+	}
+}
+
+// readUevents passes the uevents to the run loop, nil if uevents were lost.
+// The channel is closed if reading the uevents fails.
+func (w *Watcher) readUevents(ueventsCh chan<- *Uevent) {
+	defer w.wg.Done()
+
+	for {
+		uevent, err := w.uevents.ReadUevent()
+		if err == ErrUeventsLost {
+			klog.V(2).Info("Uevents lost, rescanning")
+			err = nil
+		}
+		if err != nil {
+			select {
+			case <-w.done:
+			default:
+				klog.Warningf("Failed to read uevents, falling back to polling every %v: %+v", w.pollPeriod, err)
+				close(ueventsCh)
+			}
+			return
+		}
+
+		select {
+		case ueventsCh <- uevent:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *Watcher) run(ueventsCh <-chan *Uevent) {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.period)
+	defer func() {
+		ticker.Stop()
+	}()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.trigger("timer")
+		case uevent, ok := <-ueventsCh:
+			if !ok {
+				// Changes may have been missed, rescan right away.
+				ueventsCh = nil
+				ticker.Stop()
+				ticker = time.NewTicker(w.pollPeriod)
+				w.trigger("uevent failure")
+				continue
+			}
+			if uevent == nil {
+				w.trigger("lost uevents")
+				continue
+			}
+			if len(w.subsystems) == 0 || w.subsystems[uevent.Subsystem] {
+				w.trigger(uevent.Action + " uevent for " + uevent.DevPath)
+			}
+		case ev, ok := <-w.fsWatcher.Events:
+			if ok && ev.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 && w.isWatched(ev.Name) {
+				w.trigger(ev.String())
+			}
+		case err, ok := <-w.fsWatcher.Errors:
+			if ok {
+				klog.Warningf("File system watcher error: %+v", err)
+			}
+		}
+	}
+}
+
+// isWatched checks if changes of the given path trigger rescans.
+func (w *Watcher) isWatched(name string) bool {
+	files, ok := w.watched[path.Dir(name)]
+
+	return ok && (files == nil || files[path.Clean(name)])
+}
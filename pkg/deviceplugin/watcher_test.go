@@ -0,0 +1,190 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fakeUeventSource implements UeventSource interface.
+type fakeUeventSource struct {
+	uevents chan *Uevent
+	errs    chan error
+	done    chan struct{}
+}
+
+func newFakeUeventSource() *fakeUeventSource {
+	return &fakeUeventSource{
+		uevents: make(chan *Uevent),
+		errs:    make(chan error),
+		done:    make(chan struct{}),
+	}
+}
+
+func (s *fakeUeventSource) ReadUevent() (*Uevent, error) {
+	select {
+	case uevent := <-s.uevents:
+		return uevent, nil
+	case err := <-s.errs:
+		return nil, err
+	case <-s.done:
+		return nil, errors.New("closed")
+	}
+}
+
+func (s *fakeUeventSource) Close() error {
+	close(s.done)
+	return nil
+}
+
+func expectTrigger(t *testing.T, w *Watcher, expected bool) {
+	select {
+	case <-w.Triggers():
+		if !expected {
+			t.Error("unexpected rescan trigger")
+		}
+	case <-time.After(200 * time.Millisecond):
+		if expected {
+			t.Error("expected rescan trigger, but got nothing")
+		}
+	}
+}
+
+func TestWatcherUevents(t *testing.T) {
+	source := newFakeUeventSource()
+	w, err := newWatcher(source, time.Hour, []string{"drm"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer w.Close()
+
+	source.uevents <- &Uevent{Action: "add", DevPath: "/devices/usb1", Subsystem: "usb"}
+	expectTrigger(t, w, false)
+
+	source.uevents <- &Uevent{Action: "add", DevPath: "/devices/pci0000:00/0000:00:02.0/drm/card1", Subsystem: "drm"}
+	expectTrigger(t, w, true)
+
+	// Several events are coalesced into one trigger.
+	source.uevents <- &Uevent{Action: "remove", DevPath: "/devices/pci0000:00/0000:00:02.0/drm/card1", Subsystem: "drm"}
+	source.uevents <- &Uevent{Action: "add", DevPath: "/devices/pci0000:00/0000:00:02.0/drm/card1", Subsystem: "drm"}
+	// Let the watcher handle the last event before checking.
+	time.Sleep(50 * time.Millisecond)
+	expectTrigger(t, w, true)
+	expectTrigger(t, w, false)
+}
+
+func TestWatcherUeventFailure(t *testing.T) {
+	source := newFakeUeventSource()
+	w, err := newWatcher(source, time.Hour, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer w.Close()
+	w.pollPeriod = 50 * time.Millisecond
+
+	// The failure triggers a rescan, then the watcher polls.
+	source.errs <- errors.New("fake netlink error")
+	expectTrigger(t, w, true)
+	expectTrigger(t, w, true)
+}
+
+func TestWatcherUeventsLost(t *testing.T) {
+	source := newFakeUeventSource()
+	w, err := newWatcher(source, time.Hour, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer w.Close()
+	w.pollPeriod = 50 * time.Millisecond
+
+	// Lost uevents trigger a rescan, but the watcher keeps reading uevents.
+	source.errs <- ErrUeventsLost
+	expectTrigger(t, w, true)
+	expectTrigger(t, w, false)
+
+	source.uevents <- &Uevent{Action: "add", DevPath: "/devices/usb1", Subsystem: "usb"}
+	expectTrigger(t, w, true)
+}
+
+func TestWatcherFiles(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "watcher-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	w, err := newWatcher(nil, time.Hour, nil, []string{tmpdir, path.Join(tmpdir, "nonexistent")})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer w.Close()
+
+	if err = ioutil.WriteFile(path.Join(tmpdir, "card0"), nil, 0644); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	expectTrigger(t, w, true)
+}
+
+func TestWatcherFile(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "watcher-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	sock := path.Join(tmpdir, "service.sock")
+	w, err := newWatcher(nil, time.Hour, nil, []string{sock})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer w.Close()
+
+	// Other files in the directory don't trigger rescans.
+	if err = ioutil.WriteFile(path.Join(tmpdir, "other"), nil, 0644); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	expectTrigger(t, w, false)
+
+	if err = ioutil.WriteFile(sock, nil, 0644); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	expectTrigger(t, w, true)
+
+	if err = os.Remove(sock); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	expectTrigger(t, w, true)
+}
+
+func TestWatcherPeriodic(t *testing.T) {
+	w, err := newWatcher(nil, 10*time.Millisecond, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	expectTrigger(t, w, true)
+
+	if err = w.Close(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Errorf("unexpected error on second Close(): %+v", err)
+	}
+}
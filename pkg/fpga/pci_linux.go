@@ -18,100 +18,25 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"regexp"
-	"strconv"
-	"strings"
 	"syscall"
 
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
-)
 
-const (
-	pciAddressRegex = `^([[:xdigit:]]{4}):([[:xdigit:]]{2}):([[:xdigit:]]{2})\.([[:xdigit:]])$`
-	vendorIntel     = "0x8086"
-	fpgaClass       = "0x120000"
+	"github.com/intel/intel-device-plugins-for-kubernetes/pkg/pci"
 )
 
-var (
-	pciAddressRE = regexp.MustCompile(pciAddressRegex)
+const (
+	vendorIntel = "0x8086"
+	fpgaClass   = "0x120000"
 )
 
 // PCIDevice represents most valuable sysfs information about PCI device
-type PCIDevice struct {
-	SysFsPath string
-	BDF       string
-	Vendor    string
-	Device    string
-	Class     string
-	CPUs      string
-	NUMA      string
-	VFs       string
-	TotalVFs  string
-	PhysFn    *PCIDevice
-}
+type PCIDevice = pci.Device
 
 // NewPCIDevice returns sysfs entry for specified PCI device
 func NewPCIDevice(devPath string) (*PCIDevice, error) {
-	realDevPath, err := filepath.EvalSymlinks(devPath)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed get realpath for %s", devPath)
-	}
-	pci := new(PCIDevice)
-	for p := realDevPath; strings.HasPrefix(p, "/sys/devices/pci"); p = filepath.Dir(p) {
-		subs := pciAddressRE.FindStringSubmatch(filepath.Base(p))
-		if subs == nil || len(subs) != 5 {
-			continue
-		}
-		pci.SysFsPath = p
-		pci.BDF = subs[0]
-		break
-	}
-	if pci.SysFsPath == "" || pci.BDF == "" {
-		return nil, errors.Errorf("can't find PCI device address for sysfs entry %s", realDevPath)
-	}
-	fileMap := map[string]*string{
-		"vendor":         &pci.Vendor,
-		"device":         &pci.Device,
-		"class":          &pci.Class,
-		"local_cpulist":  &pci.CPUs,
-		"numa_node":      &pci.NUMA,
-		"sriov_numvfs":   &pci.VFs,
-		"sriov_totalvfs": &pci.TotalVFs,
-	}
-	if err = readFilesInDirectory(fileMap, pci.SysFsPath); err != nil {
-		return nil, err
-	}
-	if pci.Vendor == "" || pci.Device == "" {
-		return nil, errors.Errorf("%s vendor or device id can't be empty (%q/%q)", pci.SysFsPath, pci.Vendor, pci.Device)
-	}
-	if physFn, err := NewPCIDevice(filepath.Join(pci.SysFsPath, "physfn")); err == nil {
-		pci.PhysFn = physFn
-	}
-	return pci, nil
-}
-
-// NumVFs returns number of configured VFs
-func (pci *PCIDevice) NumVFs() int64 {
-	if numvfs, err := strconv.ParseInt(pci.VFs, 10, 32); err == nil {
-		return numvfs
-	}
-	return -1
-}
-
-// GetVFs returns array of PCI device sysfs entries for VFs
-func (pci *PCIDevice) GetVFs() (ret []*PCIDevice, err error) {
-	if pci.NumVFs() > 0 {
-		dirs, _ := filepath.Glob(filepath.Join(pci.SysFsPath, "virtfn*"))
-		for _, dir := range dirs {
-			vf, er := NewPCIDevice(dir)
-			if er != nil {
-				return nil, er
-			}
-			ret = append(ret, vf)
-		}
-	}
-	return
+	return pci.NewDevice(devPath)
 }
 
 // FindSysFsDevice returns sysfs entry for specified device node or device that holds specified file
@@ -0,0 +1,190 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pci reads PCI devices and their SR-IOV virtual functions from sysfs.
+package pci
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	addressRegex = `^([[:xdigit:]]{4}):([[:xdigit:]]{2}):([[:xdigit:]]{2})\.([[:xdigit:]])$`
+)
+
+var (
+	addressRE = regexp.MustCompile(addressRegex)
+)
+
+// Device represents most valuable sysfs information about PCI device
+type Device struct {
+	SysFsPath string
+	BDF       string
+	Vendor    string
+	Device    string
+	Class     string
+	CPUs      string
+	NUMA      string
+	VFs       string
+	TotalVFs  string
+	PhysFn    *Device
+
+	// sysfs is the root of the sysfs the device is read from.
+	sysfs string
+}
+
+// NewDevice returns sysfs entry for the PCI device the given sysfs path
+// belongs to. Only the devices under /sys/devices/pci* are PCI devices.
+func NewDevice(devPath string) (*Device, error) {
+	return NewDeviceIn("/sys", devPath)
+}
+
+// NewDeviceIn returns sysfs entry for the PCI device the given sysfs path
+// belongs to in the sysfs mounted at the given directory.
+func NewDeviceIn(sysfs, devPath string) (*Device, error) {
+	realDevPath, err := filepath.EvalSymlinks(devPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed get realpath for %s", devPath)
+	}
+	if realSysfs, err := filepath.EvalSymlinks(sysfs); err == nil {
+		sysfs = realSysfs
+	}
+	pci := &Device{sysfs: sysfs}
+	for p := realDevPath; strings.HasPrefix(p, filepath.Join(sysfs, "devices", "pci")); p = filepath.Dir(p) {
+		if !addressRE.MatchString(filepath.Base(p)) {
+			continue
+		}
+		pci.SysFsPath = p
+		pci.BDF = filepath.Base(p)
+		break
+	}
+	if pci.SysFsPath == "" || pci.BDF == "" {
+		return nil, errors.Errorf("can't find PCI device address for sysfs entry %s", realDevPath)
+	}
+	fileMap := map[string]*string{
+		"vendor":         &pci.Vendor,
+		"device":         &pci.Device,
+		"class":          &pci.Class,
+		"local_cpulist":  &pci.CPUs,
+		"numa_node":      &pci.NUMA,
+		"sriov_numvfs":   &pci.VFs,
+		"sriov_totalvfs": &pci.TotalVFs,
+	}
+	if err = readFilesInDirectory(fileMap, pci.SysFsPath); err != nil {
+		return nil, err
+	}
+	if pci.Vendor == "" || pci.Device == "" {
+		return nil, errors.Errorf("%s vendor or device id can't be empty (%q/%q)", pci.SysFsPath, pci.Vendor, pci.Device)
+	}
+	if physFn, err := NewDeviceIn(sysfs, filepath.Join(pci.SysFsPath, "physfn")); err == nil {
+		pci.PhysFn = physFn
+	}
+	return pci, nil
+}
+
+// NumVFs returns number of configured VFs
+func (pci *Device) NumVFs() int64 {
+	if numvfs, err := strconv.ParseInt(pci.VFs, 10, 32); err == nil {
+		return numvfs
+	}
+	return -1
+}
+
+// MaxVFs returns the number of VFs the device supports, 0 if the device
+// isn't SR-IOV capable.
+func (pci *Device) MaxVFs() int64 {
+	if totalvfs, err := strconv.ParseInt(pci.TotalVFs, 10, 32); err == nil {
+		return totalvfs
+	}
+	return 0
+}
+
+// GetVFs returns array of PCI device sysfs entries for VFs
+func (pci *Device) GetVFs() (ret []*Device, err error) {
+	if pci.NumVFs() > 0 {
+		dirs, _ := filepath.Glob(filepath.Join(pci.SysFsPath, "virtfn*"))
+		for _, dir := range dirs {
+			vf, er := NewDeviceIn(pci.sysfs, dir)
+			if er != nil {
+				return nil, er
+			}
+			ret = append(ret, vf)
+		}
+	}
+	return
+}
+
+// SetNumVFs creates the given number of VFs. The existing VFs are removed
+// first as the kernel doesn't allow changing the number directly.
+func (pci *Device) SetNumVFs(numvfs int64) error {
+	if numvfs < 0 || numvfs > pci.MaxVFs() {
+		return errors.Errorf("%s supports up to %d VFs, %d requested", pci.BDF, pci.MaxVFs(), numvfs)
+	}
+	if pci.NumVFs() == numvfs {
+		return nil
+	}
+
+	file := filepath.Join(pci.SysFsPath, "sriov_numvfs")
+	if pci.NumVFs() > 0 {
+		if err := ioutil.WriteFile(file, []byte("0"), 0600); err != nil {
+			return errors.Wrapf(err, "failed to remove VFs of %s", pci.BDF)
+		}
+	}
+	if err := ioutil.WriteFile(file, []byte(strconv.FormatInt(numvfs, 10)), 0600); err != nil {
+		return errors.Wrapf(err, "failed to create %d VFs of %s", numvfs, pci.BDF)
+	}
+	pci.VFs = strconv.FormatInt(numvfs, 10)
+
+	return nil
+}
+
+// Driver returns the name of the driver bound to the device, empty if none.
+func (pci *Device) Driver() string {
+	driver, err := os.Readlink(filepath.Join(pci.SysFsPath, "driver"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(driver)
+}
+
+// IOMMUGroup returns the IOMMU group of the device, empty if none.
+func (pci *Device) IOMMUGroup() string {
+	group, err := os.Readlink(filepath.Join(pci.SysFsPath, "iommu_group"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(group)
+}
+
+// small helper function that reads several files into provided set of variables
+func readFilesInDirectory(fileMap map[string]*string, dir string) error {
+	for k, v := range fileMap {
+		b, err := ioutil.ReadFile(filepath.Join(dir, k))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return errors.Wrapf(err, "%s: unable to read file %q", dir, k)
+		}
+		*v = strings.TrimSpace(string(b))
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pci
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// createTestTree creates a PF 0000:00:02.0 with two VFs, one of them bound
+// to vfio-pci.
+func createTestTree(t *testing.T, root string) string {
+	devices := path.Join(root, "devices/pci0000:00")
+	files := map[string]string{
+		"0000:00:02.0/vendor":         "0x8086",
+		"0000:00:02.0/device":         "0x4905",
+		"0000:00:02.0/sriov_totalvfs": "7",
+		"0000:00:02.0/sriov_numvfs":   "2",
+		"0000:00:02.1/vendor":         "0x8086",
+		"0000:00:02.1/device":         "0x4905",
+		"0000:00:02.2/vendor":         "0x8086",
+		"0000:00:02.2/device":         "0x4905",
+	}
+	for file, content := range files {
+		if err := os.MkdirAll(path.Dir(path.Join(devices, file)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(devices, file), []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"0000:00:02.0/virtfn0":     "../0000:00:02.1",
+		"0000:00:02.0/virtfn1":     "../0000:00:02.2",
+		"0000:00:02.0/driver":      "../../../bus/pci/drivers/i915",
+		"0000:00:02.1/physfn":      "../0000:00:02.0",
+		"0000:00:02.2/physfn":      "../0000:00:02.0",
+		"0000:00:02.2/driver":      "../../../bus/pci/drivers/vfio-pci",
+		"0000:00:02.2/iommu_group": "../../../kernel/iommu_groups/5",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, path.Join(devices, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(path.Join(devices, "0000:00:02.0/drm/card0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return devices
+}
+
+func TestNewDevice(t *testing.T) {
+	root, err := ioutil.TempDir("", "pci")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(root)
+	devices := createTestTree(t, root)
+
+	pf, err := NewDeviceIn(root, path.Join(devices, "0000:00:02.0/drm/card0"))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if pf.BDF != "0000:00:02.0" || pf.Device != "0x4905" || pf.PhysFn != nil {
+		t.Errorf("unexpected PF %+v", pf)
+	}
+	if pf.NumVFs() != 2 || pf.MaxVFs() != 7 || pf.Driver() != "i915" {
+		t.Errorf("expected i915 PF with 2/7 VFs, but got %d/%d bound to %q", pf.NumVFs(), pf.MaxVFs(), pf.Driver())
+	}
+
+	vfs, err := pf.GetVFs()
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(vfs) != 2 {
+		t.Fatalf("expected 2 VFs, but got %d", len(vfs))
+	}
+	vf := vfs[1]
+	if vf.BDF != "0000:00:02.2" || vf.PhysFn == nil || vf.PhysFn.BDF != pf.BDF {
+		t.Errorf("unexpected VF %+v", vf)
+	}
+	if vf.Driver() != "vfio-pci" || vf.IOMMUGroup() != "5" || vf.MaxVFs() != 0 {
+		t.Errorf("expected vfio-pci VF in IOMMU group 5, but got %q in %q", vf.Driver(), vf.IOMMUGroup())
+	}
+
+	if _, err = NewDeviceIn(root, root); err == nil {
+		t.Error("expected error for non-PCI path, but got success")
+	}
+	// The PCI devices of other sysfs mounts are not the devices of the host.
+	if _, err = NewDevice(path.Join(devices, "0000:00:02.0")); err == nil {
+		t.Error("expected error for device outside /sys/devices/pci*, but got success")
+	}
+}
+
+func TestSetNumVFs(t *testing.T) {
+	root, err := ioutil.TempDir("", "pci")
+	if err != nil {
+		t.Fatalf("unable to create test directory: %+v", err)
+	}
+	defer os.RemoveAll(root)
+	devices := createTestTree(t, root)
+
+	pf, err := NewDeviceIn(root, path.Join(devices, "0000:00:02.0"))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if err = pf.SetNumVFs(8); err == nil {
+		t.Error("expected error for too many VFs, but got success")
+	}
+	if err = pf.SetNumVFs(4); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	data, err := ioutil.ReadFile(path.Join(devices, "0000:00:02.0/sriov_numvfs"))
+	if err != nil || string(data) != "4" || pf.NumVFs() != 4 {
+		t.Errorf("expected 4 VFs, but got %q", data)
+	}
+}